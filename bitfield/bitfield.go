@@ -11,6 +11,32 @@ import (
 
 type Bitfield []byte
 
+// New returns an empty bitfield for the number of pieces.
+func New(pieces int) Bitfield {
+	return make(Bitfield, (pieces+7)/8)
+}
+
+// Full returns a bitfield with all pieces set, spare bits stay cleared.
+func Full(pieces int) Bitfield {
+	b := New(pieces)
+	for i := 0; i < pieces; i++ {
+		b.SetPiece(i)
+	}
+	return b
+}
+
+// Valid reports whether the bitfield has the length for the number of
+// pieces with its spare bits cleared.
+func (b Bitfield) Valid(pieces int) bool {
+	if len(b) != (pieces+7)/8 {
+		return false
+	}
+	if spare := len(b)*8 - pieces; spare > 0 {
+		return b[len(b)-1]&(1<<uint(spare)-1) == 0
+	}
+	return true
+}
+
 func (b Bitfield) HasPiece(index int) bool {
 	byteIndex := index / 8
 	offset := index % 8
@@ -46,9 +72,10 @@ func RecvBitfield(conn net.Conn) (Bitfield, error) {
 		return nil, errors.New("invalid bitfield received: msg is nil")
 	}
 
-	if msg.ID != message.MsgBitfield {
+	var m message.Bitfield
+	err = m.Unmarshal(msg)
+	if err != nil {
 		return nil, errors.New("invalid bitfield received: wrong id")
 	}
-
-	return msg.Payload, nil
+	return m.Bitfield, nil
 }
@@ -47,3 +47,17 @@ func TestSetPiece(t *testing.T) {
 		assert.Equal(t, test.output, bf)
 	}
 }
+
+func TestFull(t *testing.T) {
+	assert.Equal(t, Bitfield{0b00000000, 0b00000000}, New(10))
+	assert.Equal(t, Bitfield{0b11111111, 0b11000000}, Full(10))
+	assert.Equal(t, Bitfield{0b11111111}, Full(8))
+}
+
+func TestValid(t *testing.T) {
+	assert.True(t, Full(10).Valid(10))
+	assert.True(t, Full(8).Valid(8))
+	assert.False(t, Bitfield{0b11111111}.Valid(10))
+	assert.False(t, Bitfield{0b11111111, 0b11000000, 0}.Valid(10))
+	assert.False(t, Bitfield{0b11111111, 0b11100000}.Valid(10))
+}
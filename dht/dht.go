@@ -0,0 +1,673 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mitander/bitrush/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPort is the udp port the node listens on
+	DefaultPort  = 6881
+	queryTimeout = 2 * time.Second
+	// parallel queries of a lookup
+	alpha           = 3
+	secretInterval  = 5 * time.Minute
+	peerTTL         = 30 * time.Minute
+	refreshInterval = 15 * time.Minute
+	// bounds of the peers stored from announces
+	maxPeers      = 200
+	maxInfoHashes = 1000
+	// peers returned in a single get_peers response
+	maxValues     = 50
+	maxPacketSize = 4096
+)
+
+// DefaultRouters are well known nodes used to join the network.
+var DefaultRouters = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+var (
+	ErrNoNodes error = errors.New("no dht nodes known")
+	ErrTimeout error = errors.New("dht query timed out")
+)
+
+type Config struct {
+	// Addr is the udp address to listen on, e.g. ":6881"
+	Addr string
+	// ID of the node, random when zero
+	ID ID
+	// Routers and Nodes are the nodes queried by Bootstrap
+	Routers []string
+	Nodes   []string
+}
+
+// announced is a peer announced to us.
+type announced struct {
+	peer  peer.Peer
+	added time.Time
+}
+
+// pending is a query waiting for its response.
+type pending struct {
+	addr string
+	resC chan *msg
+}
+
+// [https://www.bittorrent.org/beps/bep_0005.html]
+type DHT struct {
+	ID        ID
+	conn      net.PacketConn
+	table     *table
+	bootstrap []string
+	pending   map[string]*pending
+	peers     map[ID]map[string]announced
+	// current and previous token secret
+	secrets [2][]byte
+	tid     uint16
+	timeout time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+}
+
+func New(cfg Config) (*DHT, error) {
+	id := cfg.ID
+	if id == (ID{}) {
+		_, err := rand.Read(id[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.ListenPacket("udp4", cfg.Addr)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "addr": cfg.Addr}).Error("failed to start dht")
+		return nil, err
+	}
+
+	d := &DHT{
+		ID:        id,
+		conn:      conn,
+		table:     newTable(id),
+		bootstrap: append(append([]string(nil), cfg.Nodes...), cfg.Routers...),
+		pending:   make(map[string]*pending),
+		peers:     make(map[ID]map[string]announced),
+		timeout:   queryTimeout,
+		now:       time.Now,
+	}
+	d.rotate()
+	d.rotate()
+	return d, nil
+}
+
+func (d *DHT) Addr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+func (d *DHT) Close() error {
+	return d.conn.Close()
+}
+
+// Len returns the number of good nodes in the routing table.
+func (d *DHT) Len() int {
+	return d.table.len()
+}
+
+// Serve handles incoming messages until ctx is cancelled.
+func (d *DHT) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		d.conn.Close()
+	}()
+	go d.maintain(ctx)
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.WithFields(log.Fields{"reason": err.Error()}).Debug("failed to read dht message")
+			continue
+		}
+
+		udp, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		m, err := unmarshal(buf[:n])
+		if err != nil {
+			log.WithFields(log.Fields{"reason": err.Error(), "node": addr}).Debug("invalid krpc message")
+			continue
+		}
+		d.handle(udp, m)
+	}
+}
+
+func (d *DHT) maintain(ctx context.Context) {
+	ticker := time.NewTicker(secretInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		d.rotate()
+		d.expire()
+		for _, i := range d.table.stale(d.now().Add(-refreshInterval)) {
+			_, _, err := d.lookup(ctx, d.randomID(i), methodFindNode, nil)
+			if err != nil {
+				log.WithFields(log.Fields{"reason": err.Error(), "bucket": i}).Debug("failed to refresh bucket")
+			}
+		}
+	}
+}
+
+func (d *DHT) handle(addr *net.UDPAddr, m *msg) {
+	if m.Y == typeQuery {
+		d.handleQuery(addr, m)
+		return
+	}
+
+	d.mu.Lock()
+	p, ok := d.pending[m.T]
+	d.mu.Unlock()
+	if !ok || p.addr != addr.String() {
+		log.WithFields(log.Fields{"node": addr}).Debug("ignoring unexpected krpc response")
+		return
+	}
+	select {
+	case p.resC <- m:
+	default:
+	}
+}
+
+func (d *DHT) handleQuery(addr *net.UDPAddr, m *msg) {
+	id, ok := m.A.id("id")
+	if !ok {
+		d.sendError(addr, m.T, ErrProtocol, "invalid id")
+		return
+	}
+
+	r := dict{"id": string(d.ID[:])}
+	switch m.Q {
+	case methodPing:
+
+	case methodFindNode:
+		target, ok := m.A.id("target")
+		if !ok {
+			d.sendError(addr, m.T, ErrProtocol, "invalid target")
+			return
+		}
+		r["nodes"] = string(marshalNodes(d.table.closest(target, K)))
+
+	case methodGetPeers:
+		infoHash, ok := m.A.id("info_hash")
+		if !ok {
+			d.sendError(addr, m.T, ErrProtocol, "invalid info_hash")
+			return
+		}
+		r["token"] = token(d.secret(0), addr.IP)
+		if values := d.values(infoHash); len(values) > 0 {
+			r["values"] = values
+		} else {
+			r["nodes"] = string(marshalNodes(d.table.closest(infoHash, K)))
+		}
+
+	case methodAnnouncePeer:
+		infoHash, ok := m.A.id("info_hash")
+		if !ok {
+			d.sendError(addr, m.T, ErrProtocol, "invalid info_hash")
+			return
+		}
+		if !d.validToken(m.A.str("token"), addr.IP) {
+			d.sendError(addr, m.T, ErrProtocol, "invalid token")
+			return
+		}
+		port := m.A.int("port")
+		if m.A.int("implied_port") != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 0xFFFF {
+			d.sendError(addr, m.T, ErrProtocol, "invalid port")
+			return
+		}
+		if !d.store(infoHash, peer.Peer{IP: addr.IP, Port: uint16(port)}) {
+			d.sendError(addr, m.T, ErrServer, "too many info hashes")
+			return
+		}
+
+	default:
+		d.sendError(addr, m.T, ErrMethodUnknown, "method unknown")
+		return
+	}
+
+	d.table.add(Node{ID: id, Addr: addr})
+	d.send(addr, &msg{T: m.T, Y: typeResponse, R: r})
+}
+
+func (d *DHT) send(addr *net.UDPAddr, m *msg) error {
+	b, err := m.marshal()
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteTo(b, addr)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "node": addr}).Debug("failed to send krpc message")
+	}
+	return err
+}
+
+func (d *DHT) sendError(addr *net.UDPAddr, t string, code int, message string) {
+	d.send(addr, &msg{T: t, Y: typeError, E: &Error{Code: code, Message: message}})
+}
+
+// query sends a query to the node at addr and waits for its response.
+func (d *DHT) query(ctx context.Context, addr *net.UDPAddr, method string, args dict) (dict, error) {
+	if args == nil {
+		args = dict{}
+	}
+	args["id"] = string(d.ID[:])
+
+	d.mu.Lock()
+	d.tid++
+	t := string(binary.BigEndian.AppendUint16(nil, d.tid))
+	p := &pending{addr: addr.String(), resC: make(chan *msg, 1)}
+	d.pending[t] = p
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, t)
+		d.mu.Unlock()
+	}()
+
+	err := d.send(addr, &msg{T: t, Y: typeQuery, Q: method, A: args})
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+	select {
+	case m := <-p.resC:
+		if m.Y == typeError {
+			return nil, m.E
+		}
+		id, ok := m.R.id("id")
+		if !ok {
+			return nil, &Error{Code: ErrProtocol, Message: "response without id"}
+		}
+		d.table.add(Node{ID: id, Addr: addr})
+		return m.R, nil
+	case <-timer.C:
+		d.table.fail(addr)
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ping returns the id of the node at addr.
+func (d *DHT) Ping(ctx context.Context, addr string) (ID, error) {
+	udp, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return ID{}, err
+	}
+	r, err := d.query(ctx, udp, methodPing, nil)
+	if err != nil {
+		return ID{}, err
+	}
+	id, _ := r.id("id")
+	return id, nil
+}
+
+// Bootstrap joins the network through the configured nodes and addrs.
+func (d *DHT) Bootstrap(ctx context.Context, addrs ...string) error {
+	addrs = append(append([]string(nil), addrs...), d.bootstrap...)
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			udp, err := net.ResolveUDPAddr("udp4", addr)
+			if err != nil {
+				log.WithFields(log.Fields{"reason": err.Error(), "node": addr}).Debug("failed to resolve dht node")
+				return
+			}
+			_, err = d.query(ctx, udp, methodFindNode, dict{"target": string(d.ID[:])})
+			if err != nil {
+				log.WithFields(log.Fields{"reason": err.Error(), "node": addr}).Debug("dht bootstrap node failed")
+			}
+		}(addr)
+	}
+	wg.Wait()
+
+	_, _, err := d.lookup(ctx, d.ID, methodFindNode, nil)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Warn("dht bootstrap failed")
+		return err
+	}
+	log.WithFields(log.Fields{"nodes": d.Len()}).Debug("dht bootstrapped")
+	return nil
+}
+
+// GetPeers looks up the peers of an info hash.
+func (d *DHT) GetPeers(ctx context.Context, infoHash [20]byte) ([]peer.Peer, error) {
+	_, peers, err := d.lookup(ctx, infoHash, methodGetPeers, dict{"info_hash": string(infoHash[:])})
+	return peers, err
+}
+
+// Announce looks up the peers of an info hash and announces port to them.
+func (d *DHT) Announce(ctx context.Context, infoHash [20]byte, port int) ([]peer.Peer, error) {
+	closest, peers, err := d.lookup(ctx, infoHash, methodGetPeers, dict{"info_hash": string(infoHash[:])})
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range closest {
+		if c.token == "" {
+			continue
+		}
+		args := dict{"info_hash": string(infoHash[:]), "port": port, "token": c.token}
+		if port == 0 {
+			args["implied_port"] = 1
+		}
+		wg.Add(1)
+		go func(c *candidate) {
+			defer wg.Done()
+			_, err := d.query(ctx, c.Addr, methodAnnouncePeer, args)
+			if err != nil {
+				log.WithFields(log.Fields{"reason": err.Error(), "node": c.Addr}).Debug("announce_peer failed")
+			}
+		}(c)
+	}
+	wg.Wait()
+	return peers, nil
+}
+
+// candidate is a node visited by a lookup.
+type candidate struct {
+	Node
+	queried bool
+	failed  bool
+	token   string
+}
+
+// lookup queries the nodes closest to target until the K closest responded.
+func (d *DHT) lookup(ctx context.Context, target ID, method string, args dict) ([]*candidate, []peer.Peer, error) {
+	if args == nil {
+		args = dict{"target": string(target[:])}
+	}
+
+	var candidates []*candidate
+	seen := make(map[string]bool)
+	add := func(n Node) {
+		if n.ID == d.ID || seen[n.Addr.String()] {
+			return
+		}
+		seen[n.Addr.String()] = true
+		candidates = append(candidates, &candidate{Node: n})
+	}
+	for _, n := range d.table.closest(target, K) {
+		add(n)
+	}
+	if len(candidates) == 0 {
+		return nil, nil, ErrNoNodes
+	}
+
+	type result struct {
+		c   *candidate
+		r   dict
+		err error
+	}
+	resC := make(chan result)
+	inflight := 0
+
+	var peers []peer.Peer
+	seenPeers := make(map[string]bool)
+	if method == methodGetPeers {
+		peers = d.stored(target)
+		for _, p := range peers {
+			seenPeers[p.String()] = true
+		}
+	}
+	for {
+		sort.Slice(candidates, func(i, j int) bool {
+			return closer(target, candidates[i].ID, candidates[j].ID)
+		})
+		n := 0
+		for _, c := range candidates {
+			if c.failed {
+				continue
+			}
+			if n++; n > K {
+				break
+			}
+			if !c.queried && inflight < alpha && ctx.Err() == nil {
+				c.queried = true
+				inflight++
+				a := dict{}
+				for k, v := range args {
+					a[k] = v
+				}
+				go func(c *candidate) {
+					r, err := d.query(ctx, c.Addr, method, a)
+					resC <- result{c, r, err}
+				}(c)
+			}
+		}
+		if inflight == 0 {
+			break
+		}
+
+		res := <-resC
+		inflight--
+		if res.err != nil {
+			res.c.failed = true
+			continue
+		}
+
+		res.c.token = res.r.str("token")
+		nodes, err := unmarshalNodes([]byte(res.r.str("nodes")))
+		if err == nil {
+			for _, n := range nodes {
+				add(n)
+			}
+		}
+		for _, v := range res.r.list("values") {
+			ps, err := peer.Unmarshal([]byte(v))
+			if err != nil {
+				continue
+			}
+			for _, p := range ps {
+				if !seenPeers[p.String()] {
+					seenPeers[p.String()] = true
+					peers = append(peers, p)
+				}
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+
+	var closest []*candidate
+	for _, c := range candidates {
+		if c.queried && !c.failed && len(closest) < K {
+			closest = append(closest, c)
+		}
+	}
+	if len(closest) == 0 {
+		return nil, nil, ErrNoNodes
+	}
+	return closest, peers, nil
+}
+
+// randomID returns a random id falling into bucket i.
+func (d *DHT) randomID(i int) ID {
+	var id ID
+	rand.Read(id[:])
+	for b := 0; b < i; b++ {
+		mask := byte(0x80) >> (b % 8)
+		id[b/8] = id[b/8]&^mask | d.ID[b/8]&mask
+	}
+	mask := byte(0x80) >> (i % 8)
+	id[i/8] = id[i/8]&^mask | ^d.ID[i/8]&mask
+	return id
+}
+
+// rotate replaces the token secret, tokens of the previous secret stay valid.
+func (d *DHT) rotate() {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.secrets[1] = d.secrets[0]
+	d.secrets[0] = secret
+}
+
+func (d *DHT) secret(i int) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.secrets[i]
+}
+
+func (d *DHT) validToken(t string, ip net.IP) bool {
+	return t != "" && (t == token(d.secret(0), ip) || t == token(d.secret(1), ip))
+}
+
+// store returns false when maxInfoHashes are stored already.
+func (d *DHT) store(infoHash ID, p peer.Peer) bool {
+	if ip4 := p.IP.To4(); ip4 != nil {
+		p.IP = ip4
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	peers := d.peers[infoHash]
+	if peers == nil {
+		if len(d.peers) >= maxInfoHashes {
+			return false
+		}
+		peers = make(map[string]announced)
+		d.peers[infoHash] = peers
+	}
+
+	addr := p.String()
+	if _, ok := peers[addr]; !ok && len(peers) >= maxPeers {
+		var oldest string
+		for a, s := range peers {
+			if oldest == "" || s.added.Before(peers[oldest].added) {
+				oldest = a
+			}
+		}
+		delete(peers, oldest)
+	}
+	peers[addr] = announced{peer: p, added: d.now()}
+	return true
+}
+
+// stored returns the peers announced for infoHash.
+func (d *DHT) stored(infoHash ID) []peer.Peer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var peers []peer.Peer
+	for _, s := range d.peers[infoHash] {
+		peers = append(peers, s.peer)
+	}
+	return peers
+}
+
+func (d *DHT) values(infoHash ID) []string {
+	var values []string
+	for _, p := range d.stored(infoHash) {
+		if len(values) == maxValues {
+			break
+		}
+		if b := peer.Marshal([]peer.Peer{p}); len(b) > 0 {
+			values = append(values, string(b))
+		}
+	}
+	return values
+}
+
+func (d *DHT) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	for infoHash, peers := range d.peers {
+		for addr, s := range peers {
+			if now.Sub(s.added) > peerTTL {
+				delete(peers, addr)
+			}
+		}
+		if len(peers) == 0 {
+			delete(d.peers, infoHash)
+		}
+	}
+}
+
+// nodeFile is the persisted routing table.
+type nodeFile struct {
+	ID    ID
+	Nodes []string
+}
+
+// Save writes our id and the nodes of the routing table to path.
+func (d *DHT) Save(path string) error {
+	nf := nodeFile{ID: d.ID}
+	for _, n := range d.table.nodes() {
+		nf.Nodes = append(nf.Nodes, n.Addr.String())
+	}
+
+	b, err := json.Marshal(nf)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, b, 0644)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "path": path}).Error("failed to save dht nodes")
+	}
+	return err
+}
+
+// Load reads the id and nodes saved to path.
+func Load(path string) (ID, []string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ID{}, nil, err
+	}
+	nf := nodeFile{}
+	err = json.Unmarshal(b, &nf)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "path": path}).Debug("invalid dht node file")
+		return ID{}, nil, err
+	}
+	return nf.ID, nf.Nodes, nil
+}
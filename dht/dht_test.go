@@ -0,0 +1,198 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mitander/bitrush/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newNetwork starts n nodes on the loopback interface, all joining through
+// the first one.
+func newNetwork(t *testing.T, ctx context.Context, n int) []*DHT {
+	var nodes []*DHT
+	for i := 0; i < n; i++ {
+		d, err := New(Config{Addr: "127.0.0.1:0"})
+		require.Nil(t, err)
+		d.timeout = 500 * time.Millisecond
+		go d.Serve(ctx)
+		nodes = append(nodes, d)
+	}
+	for _, d := range nodes[1:] {
+		require.Nil(t, d.Bootstrap(ctx, nodes[0].Addr().String()))
+	}
+	return nodes
+}
+
+func TestBootstrap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nodes := newNetwork(t, ctx, 20)
+
+	for _, d := range nodes {
+		assert.Greater(t, d.Len(), 0)
+	}
+	// the last node learned about more than the node it joined through
+	assert.Greater(t, nodes[len(nodes)-1].Len(), 1)
+
+	id, err := nodes[1].Ping(ctx, nodes[2].Addr().String())
+	require.Nil(t, err)
+	assert.Equal(t, nodes[2].ID, id)
+
+	d, err := New(Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	defer d.Close()
+	assert.Equal(t, ErrNoNodes, d.Bootstrap(ctx))
+}
+
+func TestAnnounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nodes := newNetwork(t, ctx, 20)
+	infoHash := [20]byte{0xAB, 0xCD}
+
+	peers, err := nodes[5].GetPeers(ctx, infoHash)
+	require.Nil(t, err)
+	assert.Empty(t, peers)
+
+	peers, err = nodes[5].Announce(ctx, infoHash, 6889)
+	require.Nil(t, err)
+	assert.Empty(t, peers)
+
+	// zero port announces the port of the node
+	_, err = nodes[8].Announce(ctx, infoHash, 0)
+	require.Nil(t, err)
+
+	peers, err = nodes[15].GetPeers(ctx, infoHash)
+	require.Nil(t, err)
+	implied := uint16(nodes[8].Addr().(*net.UDPAddr).Port)
+	assert.ElementsMatch(t, []peer.Peer{
+		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
+		{IP: net.IP{127, 0, 0, 1}, Port: implied},
+	}, peers)
+}
+
+func TestHandleQuery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d, err := New(Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	go d.Serve(ctx)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+	self := ID{1, 2, 3}
+	infoHash := ID{0xAB}
+
+	// sends a query as a node without a routing table
+	query := func(method string, args dict) *msg {
+		args["id"] = string(self[:])
+		b, err := (&msg{T: "tt", Y: typeQuery, Q: method, A: args}).marshal()
+		require.Nil(t, err)
+		_, err = conn.WriteTo(b, d.Addr())
+		require.Nil(t, err)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, maxPacketSize)
+		n, _, err := conn.ReadFrom(buf)
+		require.Nil(t, err)
+		m, err := unmarshal(buf[:n])
+		require.Nil(t, err)
+		assert.Equal(t, "tt", m.T)
+		return m
+	}
+
+	m := query(methodPing, dict{})
+	assert.Equal(t, typeResponse, m.Y)
+	assert.Equal(t, string(d.ID[:]), m.R.str("id"))
+	assert.Equal(t, 1, d.Len())
+
+	m = query("vote", dict{})
+	assert.Equal(t, &Error{Code: ErrMethodUnknown, Message: "method unknown"}, m.E)
+
+	m = query(methodAnnouncePeer, dict{"info_hash": string(infoHash[:]), "port": 6889, "token": "wrong"})
+	assert.Equal(t, ErrProtocol, m.E.Code)
+
+	m = query(methodGetPeers, dict{"info_hash": string(infoHash[:])})
+	assert.Empty(t, m.R.list("values"))
+	tok := m.R.str("token")
+	assert.NotEmpty(t, tok)
+
+	m = query(methodAnnouncePeer, dict{"info_hash": string(infoHash[:]), "port": 6889, "token": tok})
+	assert.Equal(t, typeResponse, m.Y)
+
+	// tokens stay valid for one more rotation
+	d.rotate()
+	m = query(methodGetPeers, dict{"info_hash": string(infoHash[:])})
+	assert.Equal(t, []string{"\x7f\x00\x00\x01\x1a\xe9"}, m.R.list("values"))
+	m = query(methodAnnouncePeer, dict{"info_hash": string(infoHash[:]), "port": 6889, "token": tok})
+	assert.Equal(t, typeResponse, m.Y)
+	d.rotate()
+	m = query(methodAnnouncePeer, dict{"info_hash": string(infoHash[:]), "port": 6889, "token": tok})
+	assert.Equal(t, typeError, m.Y)
+
+	// announced peers expire
+	d.now = func() time.Time { return time.Now().Add(peerTTL + time.Minute) }
+	d.expire()
+	m = query(methodGetPeers, dict{"info_hash": string(infoHash[:])})
+	assert.Empty(t, m.R.list("values"))
+}
+
+func TestSaveLoad(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nodes := newNetwork(t, ctx, 5)
+
+	path := filepath.Join(t.TempDir(), "dht.json")
+	require.Nil(t, nodes[1].Save(path))
+
+	id, addrs, err := Load(path)
+	require.Nil(t, err)
+	assert.Equal(t, nodes[1].ID, id)
+	assert.Equal(t, nodes[1].Len(), len(addrs))
+
+	// a restarted node joins through the saved nodes
+	d, err := New(Config{Addr: "127.0.0.1:0", ID: id, Nodes: addrs})
+	require.Nil(t, err)
+	go d.Serve(ctx)
+	require.Nil(t, d.Bootstrap(ctx))
+	assert.Equal(t, nodes[1].ID, d.ID)
+	assert.Greater(t, d.Len(), 0)
+
+	_, _, err = Load(filepath.Join(t.TempDir(), "missing"))
+	assert.NotNil(t, err)
+}
+
+func TestStoreLimits(t *testing.T) {
+	d, err := New(Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	defer d.conn.Close()
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	// the oldest peer of a full info hash is replaced
+	infoHash := ID{0xAB}
+	for i := 0; i < maxPeers; i++ {
+		now = now.Add(time.Second)
+		require.True(t, d.store(infoHash, peer.Peer{IP: net.IP{10, 0, byte(i >> 8), byte(i)}, Port: 6889}))
+	}
+	now = now.Add(time.Second)
+	require.True(t, d.store(infoHash, peer.Peer{IP: net.IP{10, 1, 0, 0}, Port: 6889}))
+	peers := d.stored(infoHash)
+	assert.Equal(t, maxPeers, len(peers))
+	assert.NotContains(t, peers, peer.Peer{IP: net.IP{10, 0, 0, 0}, Port: 6889})
+	assert.Contains(t, peers, peer.Peer{IP: net.IP{10, 1, 0, 0}, Port: 6889})
+
+	// new info hashes are rejected once the table is full
+	for i := 1; i < maxInfoHashes; i++ {
+		require.True(t, d.store(ID{byte(i >> 8), byte(i)}, peer.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6889}))
+	}
+	assert.False(t, d.store(ID{0xFF, 0xFF}, peer.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6889}))
+	assert.True(t, d.store(infoHash, peer.Peer{IP: net.IP{10, 1, 0, 1}, Port: 6889}))
+}
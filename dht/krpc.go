@@ -0,0 +1,235 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// KRPC message types and error codes
+// [https://www.bittorrent.org/beps/bep_0005.html#krpc-protocol]
+const (
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+
+	ErrGeneric       = 201
+	ErrServer        = 202
+	ErrProtocol      = 203
+	ErrMethodUnknown = 204
+
+	// 20 bytes id, 4 bytes ip, 2 bytes port
+	compactNodeLen = 26
+)
+
+// ID is a node id, info hashes share the same 160 bit space.
+type ID [20]byte
+
+func (id ID) String() string {
+	return fmt.Sprintf("%x", id[:])
+}
+
+// distance is the XOR metric of Kademlia.
+func (id ID) distance(other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// prefixLen returns the number of leading bits id and other share.
+func (id ID) prefixLen(other ID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(id) * 8
+}
+
+// closer reports whether a is closer to target than b.
+func closer(target, a, b ID) bool {
+	da, db := target.distance(a), target.distance(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// Error is a KRPC error returned by a remote node.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+// dict is a decoded bencode dictionary.
+type dict map[string]interface{}
+
+func (d dict) str(key string) string {
+	s, _ := d[key].(string)
+	return s
+}
+
+func (d dict) int(key string) int {
+	i, _ := d[key].(int64)
+	return int(i)
+}
+
+func (d dict) id(key string) (ID, bool) {
+	var id ID
+	s := d.str(key)
+	if len(s) != len(id) {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
+
+func (d dict) list(key string) []string {
+	l, _ := d[key].([]interface{})
+	var res []string
+	for _, v := range l {
+		if s, ok := v.(string); ok {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// msg is a KRPC message.
+type msg struct {
+	T string
+	Y string
+	Q string
+	A dict
+	R dict
+	E *Error
+}
+
+func (m *msg) marshal() ([]byte, error) {
+	d := map[string]interface{}{"t": m.T, "y": m.Y}
+	switch m.Y {
+	case typeQuery:
+		d["q"] = m.Q
+		d["a"] = map[string]interface{}(m.A)
+	case typeResponse:
+		d["r"] = map[string]interface{}(m.R)
+	case typeError:
+		d["e"] = []interface{}{m.E.Code, m.E.Message}
+	}
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, d)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to marshal krpc message")
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshal(b []byte) (*msg, error) {
+	v, err := bencode.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("krpc message is not a dictionary")
+	}
+
+	m := &msg{T: dict(d).str("t"), Y: dict(d).str("y"), Q: dict(d).str("q")}
+	if m.T == "" {
+		return nil, errors.New("krpc message without transaction id")
+	}
+
+	switch m.Y {
+	case typeQuery:
+		a, ok := d["a"].(map[string]interface{})
+		if !ok || m.Q == "" {
+			return nil, errors.New("krpc query without method or arguments")
+		}
+		m.A = a
+	case typeResponse:
+		r, ok := d["r"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("krpc response without values")
+		}
+		m.R = r
+	case typeError:
+		e, _ := d["e"].([]interface{})
+		m.E = &Error{Code: ErrGeneric}
+		if len(e) > 0 {
+			if code, ok := e[0].(int64); ok {
+				m.E.Code = int(code)
+			}
+		}
+		if len(e) > 1 {
+			m.E.Message, _ = e[1].(string)
+		}
+	default:
+		return nil, fmt.Errorf("unknown krpc message type %q", m.Y)
+	}
+	return m, nil
+}
+
+// Node is a DHT node as sent in compact node info.
+type Node struct {
+	ID   ID
+	Addr *net.UDPAddr
+}
+
+// marshalNodes returns the compact node info of the IPv4 nodes.
+func marshalNodes(nodes []Node) []byte {
+	b := make([]byte, 0, len(nodes)*compactNodeLen)
+	for _, n := range nodes {
+		ip := n.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		b = append(b, n.ID[:]...)
+		b = append(b, ip...)
+		b = binary.BigEndian.AppendUint16(b, uint16(n.Addr.Port))
+	}
+	return b
+}
+
+func unmarshalNodes(b []byte) ([]Node, error) {
+	if len(b)%compactNodeLen != 0 {
+		err := errors.New("invalid compact node info length")
+		log.WithFields(log.Fields{"length": len(b)}).Debug(err.Error())
+		return nil, err
+	}
+
+	nodes := make([]Node, 0, len(b)/compactNodeLen)
+	for i := 0; i < len(b); i += compactNodeLen {
+		n := Node{Addr: &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), b[i+20:i+24]...)),
+			Port: int(binary.BigEndian.Uint16(b[i+24 : i+26])),
+		}}
+		copy(n.ID[:], b[i:i+20])
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// token is bound to the ip of the node asking for peers.
+func token(secret []byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(ip.To16())
+	return string(h.Sum(nil)[:8])
+}
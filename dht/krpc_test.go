@@ -0,0 +1,85 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage(t *testing.T) {
+	tests := map[string]struct {
+		input  []byte
+		output *msg
+		fails  bool
+	}{
+		"ping query": {
+			input:  []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"),
+			output: &msg{T: "aa", Y: typeQuery, Q: methodPing, A: dict{"id": "abcdefghij0123456789"}},
+			fails:  false,
+		},
+		"get_peers response": {
+			input:  []byte("d1:rd2:id20:mnopqrstuvwxyz1234565:token8:aoeusnth6:valuesl6:axje.u6:idhtnmee1:t2:aa1:y1:re"),
+			output: &msg{T: "aa", Y: typeResponse, R: dict{"id": "mnopqrstuvwxyz123456", "token": "aoeusnth", "values": []interface{}{"axje.u", "idhtnm"}}},
+			fails:  false,
+		},
+		"error": {
+			input:  []byte("d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee"),
+			output: &msg{T: "aa", Y: typeError, E: &Error{Code: ErrGeneric, Message: "A Generic Error Ocurred"}},
+			fails:  false,
+		},
+		"missing transaction id": {
+			input:  []byte("d1:rd2:id20:mnopqrstuvwxyz123456e1:y1:re"),
+			output: nil,
+			fails:  true,
+		},
+		"query without arguments": {
+			input:  []byte("d1:q4:ping1:t2:aa1:y1:qe"),
+			output: nil,
+			fails:  true,
+		},
+		"unknown type": {
+			input:  []byte("d1:t2:aa1:y1:xe"),
+			output: nil,
+			fails:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, err := unmarshal(test.input)
+			if test.fails {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, test.output, m)
+
+			// keys are encoded in sorted order
+			b, err := test.output.marshal()
+			require.Nil(t, err)
+			assert.Equal(t, test.input, b)
+		})
+	}
+}
+
+func TestNodes(t *testing.T) {
+	nodes := []Node{
+		{ID: ID{1}, Addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881}},
+		{ID: ID{2}, Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}},
+		{ID: ID{3}, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}},
+	}
+	b := marshalNodes(nodes)
+	assert.Equal(t, 2*compactNodeLen, len(b)) // IPv6 nodes are left out
+
+	got, err := unmarshalNodes(b)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(got))
+	assert.Equal(t, ID{1}, got[0].ID)
+	assert.Equal(t, "192.0.2.1:6881", got[0].Addr.String())
+	assert.Equal(t, "127.0.0.1:1", got[1].Addr.String())
+
+	_, err = unmarshalNodes(b[:compactNodeLen+1])
+	assert.NotNil(t, err)
+}
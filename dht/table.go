@@ -0,0 +1,146 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// K is the number of nodes in a bucket
+	K = 8
+	// nodes failing to respond this many times in a row are replaced
+	maxFails = 3
+)
+
+// contact is a node in the routing table.
+type contact struct {
+	Node
+	seen  time.Time
+	fails int
+}
+
+// table is the routing table of a node.
+type table struct {
+	self    ID
+	buckets [len(ID{}) * 8][]*contact
+	// last change of every bucket
+	changed [len(ID{}) * 8]time.Time
+	now     func() time.Time
+	mu      sync.Mutex
+}
+
+func newTable(self ID) *table {
+	return &table{self: self, now: time.Now}
+}
+
+func (t *table) bucket(id ID) int {
+	i := t.self.prefixLen(id)
+	if i == len(t.buckets) {
+		// our own id
+		return -1
+	}
+	return i
+}
+
+// add inserts a node that responded to us, or marks it seen.
+func (t *table) add(n Node) bool {
+	i := t.bucket(n.ID)
+	if i < 0 || n.Addr == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	b := t.buckets[i]
+	for j, c := range b {
+		if c.ID == n.ID {
+			c.Addr = n.Addr
+			c.seen = now
+			c.fails = 0
+			// most recently seen last
+			t.buckets[i] = append(append(b[:j:j], b[j+1:]...), c)
+			t.changed[i] = now
+			return true
+		}
+	}
+
+	c := &contact{Node: n, seen: now}
+	if len(b) < K {
+		t.buckets[i] = append(b, c)
+		t.changed[i] = now
+		return true
+	}
+	for j, old := range b {
+		if old.fails >= maxFails {
+			t.buckets[i] = append(append(b[:j:j], b[j+1:]...), c)
+			t.changed[i] = now
+			return true
+		}
+	}
+	return false
+}
+
+// fail records the node at addr not responding to a query.
+func (t *table) fail(addr *net.UDPAddr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, b := range t.buckets {
+		for _, c := range b {
+			if c.Addr.String() == addr.String() {
+				c.fails++
+				return
+			}
+		}
+	}
+}
+
+// closest returns up to n good nodes closest to target.
+func (t *table) closest(target ID, n int) []Node {
+	nodes := t.nodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].ID, nodes[j].ID)
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// nodes returns all nodes that did not fail too often.
+func (t *table) nodes() []Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []Node
+	for _, b := range t.buckets {
+		for _, c := range b {
+			if c.fails < maxFails {
+				nodes = append(nodes, c.Node)
+			}
+		}
+	}
+	return nodes
+}
+
+func (t *table) len() int {
+	return len(t.nodes())
+}
+
+// stale returns the buckets holding nodes that did not change since before.
+func (t *table) stale(before time.Time) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var stale []int
+	for i, b := range t.buckets {
+		if len(b) > 0 && t.changed[i].Before(before) {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testNode(id ID, port int) Node {
+	return Node{ID: id, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+}
+
+func TestTable(t *testing.T) {
+	tb := newTable(ID{})
+
+	// our own id is never added
+	assert.False(t, tb.add(testNode(ID{}, 1)))
+
+	// ids with the first bit set share no prefix and go to bucket 0
+	for i := 0; i < K; i++ {
+		assert.True(t, tb.add(testNode(ID{0x80, byte(i)}, 100+i)))
+	}
+	assert.False(t, tb.add(testNode(ID{0x80, 0xFF}, 200)))
+	assert.Equal(t, K, tb.len())
+
+	// seen again, moved to the end of the bucket
+	assert.True(t, tb.add(testNode(ID{0x80, 0}, 100)))
+	assert.Equal(t, ID{0x80, 0}, tb.buckets[0][K-1].ID)
+
+	// a node failing too often is replaced
+	for i := 0; i < maxFails; i++ {
+		tb.fail(testNode(ID{}, 101).Addr)
+	}
+	assert.Equal(t, K-1, tb.len())
+	assert.True(t, tb.add(testNode(ID{0x80, 0xFF}, 200)))
+	assert.Equal(t, K, tb.len())
+
+	// other buckets have room
+	assert.True(t, tb.add(testNode(ID{0x01}, 300)))
+	assert.Equal(t, 7, tb.bucket(ID{0x01}))
+}
+
+func TestClosest(t *testing.T) {
+	tb := newTable(ID{})
+	for _, id := range []ID{{0x80}, {0x40}, {0x20}, {0x10}, {0x01}} {
+		tb.add(testNode(id, int(id[0])))
+	}
+
+	tests := map[string]struct {
+		target ID
+		n      int
+		output []ID
+	}{
+		"closest to ourselves": {
+			target: ID{},
+			n:      3,
+			output: []ID{{0x01}, {0x10}, {0x20}},
+		},
+		"closest to other id": {
+			target: ID{0xC0},
+			n:      2,
+			output: []ID{{0x80}, {0x40}},
+		},
+		"more than known": {
+			target: ID{0x11},
+			n:      K,
+			output: []ID{{0x10}, {0x01}, {0x20}, {0x40}, {0x80}},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var ids []ID
+			for _, n := range tb.closest(test.target, test.n) {
+				ids = append(ids, n.ID)
+			}
+			assert.Equal(t, test.output, ids)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package extension
+
+import (
+	"bytes"
+	"errors"
+	"net"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/mitander/bitrush/message"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	InvalidExtendedMessage error = errors.New("invalid extended message")
+)
+
+// [https://www.bittorrent.org/beps/bep_0010.html]
+const HandshakeID uint8 = 0
+
+// Handshake is the bencoded payload of the extension handshake.
+type Handshake struct {
+	M            map[string]int `bencode:"m"`
+	V            string         `bencode:"v,omitempty"`
+	P            int            `bencode:"p,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+	YourIP       string         `bencode:"yourip,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+// CompactIP returns ip in the 4 or 16 byte form used by yourip.
+func CompactIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4)
+	}
+	return string(ip.To16())
+}
+
+// IP returns the address the sender sees us at, nil if not sent or invalid.
+func (h *Handshake) IP() net.IP {
+	if len(h.YourIP) != net.IPv4len && len(h.YourIP) != net.IPv6len {
+		return nil
+	}
+	return net.IP(h.YourIP)
+}
+
+// extended: <id=20><extended message id><payload>
+func FormatMsg(id uint8, payload []byte) *message.Message {
+	return message.Extended{ExtendedID: id, Payload: payload}.Marshal()
+}
+
+// ParseMsg returns the extended message id and payload of an extended message.
+func ParseMsg(msg *message.Message) (uint8, []byte, error) {
+	var m message.Extended
+	err := m.Unmarshal(msg)
+	return m.ExtendedID, m.Payload, err
+}
+
+func FormatHandshakeMsg(h *Handshake) (*message.Message, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, *h)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to marshal extension handshake")
+		return nil, err
+	}
+	return FormatMsg(HandshakeID, buf.Bytes()), nil
+}
+
+func ParseHandshakeMsg(msg *message.Message) (*Handshake, error) {
+	id, payload, err := ParseMsg(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != HandshakeID {
+		log.WithFields(log.Fields{"got": id, "expected": HandshakeID}).Debug(InvalidExtendedMessage.Error())
+		return nil, InvalidExtendedMessage
+	}
+
+	h := Handshake{}
+	err = bencode.Unmarshal(bytes.NewReader(payload), &h)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Debug("failed to unmarshal extension handshake")
+		return nil, err
+	}
+	return &h, nil
+}
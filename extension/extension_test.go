@@ -0,0 +1,73 @@
+package extension
+
+import (
+	"testing"
+
+	"github.com/mitander/bitrush/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatMsg(t *testing.T) {
+	msg := FormatMsg(3, []byte{0xaa, 0xbb})
+	expected := &message.Message{
+		ID:      message.MsgExtended,
+		Payload: []byte{0x03, 0xaa, 0xbb},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestParseMsg(t *testing.T) {
+	tests := map[string]struct {
+		input   *message.Message
+		id      uint8
+		payload []byte
+		fails   bool
+	}{
+		"correct input": {
+			input:   &message.Message{ID: message.MsgExtended, Payload: []byte{0x03, 0xaa, 0xbb}},
+			id:      3,
+			payload: []byte{0xaa, 0xbb},
+			fails:   false,
+		},
+		"invalid message type": {
+			input: &message.Message{ID: message.MsgHave, Payload: []byte{0x03, 0xaa, 0xbb}},
+			fails: true,
+		},
+		"invalid payload length": {
+			input: &message.Message{ID: message.MsgExtended, Payload: []byte{}},
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		id, payload, err := ParseMsg(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.id, id, name)
+		assert.Equal(t, test.payload, payload, name)
+	}
+}
+
+func TestHandshakeMsg(t *testing.T) {
+	hs := &Handshake{
+		M:            map[string]int{"ut_metadata": 3},
+		V:            "bitrush",
+		P:            6881,
+		Reqq:         250,
+		YourIP:       "\x7f\x00\x00\x01",
+		MetadataSize: 31235,
+	}
+	msg, err := FormatHandshakeMsg(hs)
+	assert.Nil(t, err)
+	assert.Equal(t, "d1:md11:ut_metadatai3ee13:metadata_sizei31235e1:pi6881e4:reqqi250e1:v7:bitrush6:yourip4:\x7f\x00\x00\x01e", string(msg.Payload[1:]))
+
+	res, err := ParseHandshakeMsg(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, hs, res)
+
+	_, err = ParseHandshakeMsg(FormatMsg(1, msg.Payload[1:]))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,234 @@
+package extension
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/mitander/bitrush/message"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNotSupported error = errors.New("extension not supported by peer")
+	ErrRegistered   error = errors.New("extension already registered")
+)
+
+// Extension handles the messages of a named extension, e.g. ut_pex.
+type Extension interface {
+	Name() string
+	Handle(s *Session, payload []byte) error
+}
+
+// HandshakeHandler is implemented by extensions acting on peer handshakes.
+type HandshakeHandler interface {
+	HandleHandshake(s *Session, h *Handshake) error
+}
+
+// Closer is implemented by extensions keeping state per session.
+type Closer interface {
+	Close(s *Session)
+}
+
+// Registry holds the extensions offered on connections, numbered from 1.
+type Registry struct {
+	// sent in our handshake when set
+	Port         func() int
+	MetadataSize int
+	extensions   []Extension
+	mu           sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds an extension, names are unique.
+func (r *Registry) Register(e Extension) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, ext := range r.extensions {
+		if ext.Name() == e.Name() {
+			log.WithFields(log.Fields{"extension": e.Name()}).Error(ErrRegistered.Error())
+			return ErrRegistered
+		}
+	}
+	if len(r.extensions) == 255 {
+		return errors.New("too many extensions")
+	}
+	r.extensions = append(r.extensions, e)
+	return nil
+}
+
+func (r *Registry) m() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := make(map[string]int, len(r.extensions))
+	for i, e := range r.extensions {
+		m[e.Name()] = i + 1
+	}
+	return m
+}
+
+func (r *Registry) all() []Extension {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Extension(nil), r.extensions...)
+}
+
+func (r *Registry) extension(id uint8) Extension {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id == HandshakeID || int(id) > len(r.extensions) {
+		return nil
+	}
+	return r.extensions[id-1]
+}
+
+// Session is the extension protocol state of a single connection.
+type Session struct {
+	Addr     string
+	registry *Registry
+	send     func(msg *message.Message) error
+	remote   *Handshake
+	mu       sync.Mutex
+}
+
+func (r *Registry) NewSession(addr string, send func(msg *message.Message) error) *Session {
+	return &Session{
+		Addr:     addr,
+		registry: r,
+		send:     send,
+	}
+}
+
+// SendHandshake sends our extension handshake with the registry fields set.
+func (s *Session) SendHandshake(h Handshake) error {
+	h.M = s.registry.m()
+	if s.registry.Port != nil {
+		h.P = s.registry.Port()
+	}
+	if s.registry.MetadataSize != 0 {
+		h.MetadataSize = s.registry.MetadataSize
+	}
+
+	msg, err := FormatHandshakeMsg(&h)
+	if err != nil {
+		return err
+	}
+	return s.send(msg)
+}
+
+// Handle dispatches an extended message of the peer, unknown ids are ignored.
+func (s *Session) Handle(msg *message.Message) error {
+	id, payload, err := ParseMsg(msg)
+	if err != nil {
+		return err
+	}
+
+	if id != HandshakeID {
+		e := s.registry.extension(id)
+		if e == nil {
+			log.WithFields(log.Fields{"id": id, "peer": s.Addr}).Debug("ignoring unknown extended message")
+			return nil
+		}
+		return e.Handle(s, payload)
+	}
+
+	h, err := ParseHandshakeMsg(msg)
+	if err != nil {
+		return err
+	}
+	s.update(h)
+
+	for _, e := range s.registry.all() {
+		if hh, ok := e.(HandshakeHandler); ok {
+			err = hh.HandleHandshake(s, h)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// update merges a later handshake, id 0 disables an extension.
+func (s *Session) update(h *Handshake) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.remote == nil {
+		s.remote = &Handshake{M: make(map[string]int)}
+	}
+	for name, id := range h.M {
+		if id == 0 {
+			delete(s.remote.M, name)
+		} else {
+			s.remote.M[name] = id
+		}
+	}
+	if h.V != "" {
+		s.remote.V = h.V
+	}
+	if h.P != 0 {
+		s.remote.P = h.P
+	}
+	if h.Reqq != 0 {
+		s.remote.Reqq = h.Reqq
+	}
+	if h.YourIP != "" {
+		s.remote.YourIP = h.YourIP
+	}
+	if h.MetadataSize != 0 {
+		s.remote.MetadataSize = h.MetadataSize
+	}
+}
+
+// Remote returns the extension handshake of the peer, nil until received.
+func (s *Session) Remote() *Handshake {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.remote == nil {
+		return nil
+	}
+	h := *s.remote
+	h.M = make(map[string]int, len(s.remote.M))
+	for name, id := range s.remote.M {
+		h.M[name] = id
+	}
+	return &h
+}
+
+// Supports reports whether the peer accepts messages of the extension.
+func (s *Session) Supports(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remote != nil && s.remote.M[name] > 0
+}
+
+// Send sends the payload of an extension with the id the peer assigned to it.
+func (s *Session) Send(name string, payload []byte) error {
+	s.mu.Lock()
+	id := 0
+	if s.remote != nil {
+		id = s.remote.M[name]
+	}
+	s.mu.Unlock()
+
+	if id <= 0 || id > 255 {
+		return ErrNotSupported
+	}
+	return s.send(FormatMsg(uint8(id), payload))
+}
+
+// Close lets the extensions drop the state they keep for the session.
+func (s *Session) Close() {
+	for _, e := range s.registry.all() {
+		if c, ok := e.(Closer); ok {
+			c.Close(s)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package extension
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mitander/bitrush/message"
+	"github.com/stretchr/testify/assert"
+)
+
+type testExtension struct {
+	name       string
+	payloads   [][]byte
+	handshakes int
+	closed     int
+}
+
+func (e *testExtension) Name() string {
+	return e.name
+}
+
+func (e *testExtension) Handle(s *Session, payload []byte) error {
+	e.payloads = append(e.payloads, payload)
+	return s.Send(e.name, []byte("pong"))
+}
+
+func (e *testExtension) HandleHandshake(s *Session, h *Handshake) error {
+	e.handshakes++
+	return nil
+}
+
+func (e *testExtension) Close(s *Session) {
+	e.closed++
+}
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+	assert.Nil(t, r.Register(&testExtension{name: "ut_pex"}))
+	assert.Nil(t, r.Register(&testExtension{name: "ut_metadata"}))
+	assert.Equal(t, ErrRegistered, r.Register(&testExtension{name: "ut_pex"})) // <- fails here, names are unique
+	assert.Equal(t, map[string]int{"ut_pex": 1, "ut_metadata": 2}, r.m())
+}
+
+func TestSession(t *testing.T) {
+	pex := &testExtension{name: "ut_pex"}
+	r := NewRegistry()
+	r.Port = func() int { return 6889 }
+	r.Register(&testExtension{name: "ut_metadata"})
+	r.Register(pex)
+
+	var sent []*message.Message
+	s := r.NewSession("127.0.0.1:6881", func(msg *message.Message) error {
+		sent = append(sent, msg)
+		return nil
+	})
+
+	// our handshake carries the ids and fields of the registry
+	err := s.SendHandshake(Handshake{V: "bitrush", YourIP: CompactIP(net.IP{127, 0, 0, 1})})
+	assert.Nil(t, err)
+	h, err := ParseHandshakeMsg(sent[0])
+	assert.Nil(t, err)
+	assert.Equal(t, &Handshake{M: map[string]int{"ut_metadata": 1, "ut_pex": 2}, V: "bitrush", P: 6889, YourIP: "\x7f\x00\x00\x01"}, h)
+	assert.Equal(t, net.IP{127, 0, 0, 1}, h.IP())
+
+	// messages can only be sent once the peer assigned an id
+	assert.False(t, s.Supports("ut_pex"))
+	assert.Equal(t, ErrNotSupported, s.Send("ut_pex", nil))
+
+	msg, _ := FormatHandshakeMsg(&Handshake{M: map[string]int{"ut_pex": 7}, Reqq: 100})
+	assert.Nil(t, s.Handle(msg))
+	assert.True(t, s.Supports("ut_pex"))
+	assert.Equal(t, 100, s.Remote().Reqq)
+	assert.Equal(t, 1, pex.handshakes)
+
+	// messages are dispatched by our id and answered with the peer's id
+	assert.Nil(t, s.Handle(FormatMsg(2, []byte("ping"))))
+	assert.Equal(t, [][]byte{[]byte("ping")}, pex.payloads)
+	assert.Equal(t, FormatMsg(7, []byte("pong")), sent[1])
+	assert.Nil(t, s.Handle(FormatMsg(9, []byte("unknown"))))
+
+	// later handshakes update the recorded one, id 0 disables an extension
+	msg, _ = FormatHandshakeMsg(&Handshake{M: map[string]int{"ut_pex": 0}})
+	assert.Nil(t, s.Handle(msg))
+	assert.False(t, s.Supports("ut_pex"))
+	assert.Equal(t, 100, s.Remote().Reqq)
+
+	s.Close()
+	assert.Equal(t, 1, pex.closed)
+}
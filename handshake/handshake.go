@@ -13,10 +13,44 @@ import (
 // https://wiki.theory.org/BitTorrentSpecification#Handshake
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+// extension protocol support is bit 20 counted from the right
+// [https://www.bittorrent.org/beps/bep_0010.html]
+const (
+	extensionByte = 5
+	extensionBit  = 0x10
+)
+
+// EnableExtensions sets the reserved bit announcing support of the
+// extension protocol.
+func (h *Handshake) EnableExtensions() {
+	h.Reserved[extensionByte] |= extensionBit
+}
+
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[extensionByte]&extensionBit != 0
+}
+
+// fast extension support is bit 3 counted from the right
+// [https://www.bittorrent.org/beps/bep_0006.html]
+const (
+	fastByte = 7
+	fastBit  = 0x04
+)
+
+// EnableFast sets the reserved bit announcing support of the fast extension.
+func (h *Handshake) EnableFast() {
+	h.Reserved[fastByte] |= fastBit
+}
+
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[fastByte]&fastBit != 0
+}
+
 func NewHandshake(infoHash [20]byte, peerID [20]byte) *Handshake {
 	return &Handshake{
 		Pstr:     "BitTorrent protocol",
@@ -48,13 +82,27 @@ func (h *Handshake) Send(conn net.Conn) (*Handshake, error) {
 	return res, nil
 }
 
+// Reply writes the handshake as the answer to an inbound handshake
+// which has already been read from conn.
+func (h *Handshake) Reply(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	_, err := conn.Write(h.serialize())
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to reply to handshake")
+		return err
+	}
+	return nil
+}
+
 // handshake: <pstrlen><pstr><reserved><info_hash><peer_id>
 func (h *Handshake) serialize() []byte {
 	buf := make([]byte, len(h.Pstr)+49)
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8))
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -79,14 +127,17 @@ func ReadHandshake(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash [20]byte
 	var peerID [20]byte
 
+	copy(reserved[:], buf[pstrlen:pstrlen+8])
 	copy(infoHash[:], buf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], buf[pstrlen+8+20:])
 
 	return &Handshake{
 		Pstr:     string(buf[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}, nil
@@ -91,3 +91,31 @@ func TestSerialize(t *testing.T) {
 		assert.Equal(t, test.output, buf)
 	}
 }
+
+func TestExtensions(t *testing.T) {
+	hs := NewHandshake([20]byte{}, [20]byte{})
+	assert.False(t, hs.SupportsExtensions())
+
+	hs.EnableExtensions()
+	assert.True(t, hs.SupportsExtensions())
+	assert.Equal(t, [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0}, hs.Reserved)
+
+	res, err := ReadHandshake(bytes.NewReader(hs.serialize()))
+	assert.Nil(t, err)
+	assert.True(t, res.SupportsExtensions())
+}
+
+func TestFast(t *testing.T) {
+	hs := NewHandshake([20]byte{}, [20]byte{})
+	assert.False(t, hs.SupportsFast())
+
+	hs.EnableFast()
+	hs.EnableExtensions()
+	assert.True(t, hs.SupportsFast())
+	assert.Equal(t, [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x04}, hs.Reserved)
+
+	res, err := ReadHandshake(bytes.NewReader(hs.serialize()))
+	assert.Nil(t, err)
+	assert.True(t, res.SupportsFast())
+	assert.True(t, res.SupportsExtensions())
+}
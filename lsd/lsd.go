@@ -0,0 +1,261 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitander/bitrush/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// [https://www.bittorrent.org/beps/bep_0014.html]
+const (
+	Port = 6771
+	// Interval is the time between two announces of a torrent
+	Interval = 5 * time.Minute
+	// announces of new torrents are delayed to send at most one a minute
+	minInterval = time.Minute
+	// announcements larger than this are split
+	maxPacketSize = 1400
+)
+
+// multicast groups announcements are sent to
+var (
+	Group4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: Port}
+	Group6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: Port}
+)
+
+// Announcement is a BT-SEARCH message, announcing the torrents a peer on
+// the local network accepts connections for.
+type Announcement struct {
+	Port       int
+	InfoHashes [][20]byte
+	// Cookie identifies the sender, to ignore our own announcements
+	Cookie string
+}
+
+// Marshal returns the announcement addressed to the multicast group host.
+func (a *Announcement) Marshal(host string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", host, a.Port)
+	for _, ih := range a.InfoHashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", ih)
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(&b, "cookie: %s\r\n", a.Cookie)
+	}
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+// Parse parses a BT-SEARCH message, invalid info hashes are left out.
+func Parse(b []byte) (*Announcement, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != "BT-SEARCH" {
+		return nil, fmt.Errorf("invalid lsd method %q", req.Method)
+	}
+
+	port, err := strconv.Atoi(req.Header.Get("Port"))
+	if err != nil || port <= 0 || port > 0xFFFF {
+		return nil, errors.New("invalid lsd port")
+	}
+
+	a := &Announcement{Port: port, Cookie: req.Header.Get("Cookie")}
+	for _, v := range req.Header.Values("Infohash") {
+		var ih [20]byte
+		v = strings.TrimSpace(v)
+		if len(v) != hex.EncodedLen(len(ih)) {
+			continue
+		}
+		if _, err := hex.Decode(ih[:], []byte(v)); err != nil {
+			continue
+		}
+		a.InfoHashes = append(a.InfoHashes, ih)
+	}
+	return a, nil
+}
+
+// LSD announces the registered torrents to the local network and hands the
+// peers announcing them to the torrents.
+type LSD struct {
+	// Port is the port we accept peer connections on
+	Port     int
+	cookie   string
+	torrents map[[20]byte]func(peers []peer.Peer)
+	// registering a torrent triggers an announce
+	announceC chan struct{}
+	mu        sync.Mutex
+}
+
+func New(port int) *LSD {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &LSD{
+		Port:      port,
+		cookie:    hex.EncodeToString(b),
+		torrents:  make(map[[20]byte]func(peers []peer.Peer)),
+		announceC: make(chan struct{}, 1),
+	}
+}
+
+// Register announces the torrent, add is called with the peers found for it.
+func (l *LSD) Register(infoHash [20]byte, add func(peers []peer.Peer)) {
+	l.mu.Lock()
+	l.torrents[infoHash] = add
+	l.mu.Unlock()
+
+	select {
+	case l.announceC <- struct{}{}:
+	default:
+	}
+}
+
+func (l *LSD) Unregister(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.torrents, infoHash)
+}
+
+// Serve joins the IPv4 and IPv6 groups and announces every Interval until
+// ctx is cancelled, it fails if neither group can be joined.
+func (l *LSD) Serve(ctx context.Context) error {
+	type group struct {
+		addr *net.UDPAddr
+		conn *net.UDPConn
+	}
+
+	var groups []group
+	for _, addr := range []*net.UDPAddr{Group4, Group6} {
+		network := "udp4"
+		if addr.IP.To4() == nil {
+			network = "udp6"
+		}
+		conn, err := net.ListenMulticastUDP(network, nil, addr)
+		if err != nil {
+			log.WithFields(log.Fields{"reason": err.Error(), "group": addr}).Debug("failed to join lsd group")
+			continue
+		}
+		groups = append(groups, group{addr, conn})
+		go l.read(conn)
+	}
+	if len(groups) == 0 {
+		err := errors.New("failed to join any lsd group")
+		log.Warn(err.Error())
+		return err
+	}
+	defer func() {
+		for _, g := range groups {
+			g.conn.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	var last time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.announceC:
+			// wait for the rate limit, further torrents join this announce
+			select {
+			case <-time.After(time.Until(last.Add(minInterval))):
+			case <-ctx.Done():
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+
+		last = time.Now()
+		for _, g := range groups {
+			err := l.announce(g.conn, g.addr)
+			if err != nil {
+				log.WithFields(log.Fields{"reason": err.Error(), "group": g.addr}).Debug("lsd announce failed")
+			}
+		}
+	}
+}
+
+// announce sends the info hashes of all registered torrents to addr, in as
+// few messages as fit in a packet.
+func (l *LSD) announce(conn net.PacketConn, addr *net.UDPAddr) error {
+	l.mu.Lock()
+	var infoHashes [][20]byte
+	for ih := range l.torrents {
+		infoHashes = append(infoHashes, ih)
+	}
+	l.mu.Unlock()
+
+	a := &Announcement{Port: l.Port, Cookie: l.cookie}
+	// an info hash line is 52 bytes
+	n := (maxPacketSize - len(a.Marshal(addr.String()))) / 52
+	for len(infoHashes) > 0 {
+		a.InfoHashes = infoHashes[:min(n, len(infoHashes))]
+		infoHashes = infoHashes[len(a.InfoHashes):]
+		_, err := conn.WriteTo(a.Marshal(addr.String()), addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *LSD) read(conn net.PacketConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.WithFields(log.Fields{"reason": err.Error()}).Debug("failed to read lsd message")
+			continue
+		}
+		udp, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		l.handle(buf[:n], udp)
+	}
+}
+
+// handle passes the sender of an announcement to the torrents it announces.
+func (l *LSD) handle(b []byte, from *net.UDPAddr) {
+	a, err := Parse(b)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "peer": from}).Debug("invalid lsd announcement")
+		return
+	}
+	if a.Cookie == l.cookie {
+		return
+	}
+
+	ip := from.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	p := peer.Peer{IP: ip, Port: uint16(a.Port)}
+	for _, ih := range a.InfoHashes {
+		l.mu.Lock()
+		add, ok := l.torrents[ih]
+		l.mu.Unlock()
+		if ok {
+			log.WithFields(log.Fields{"peer": p.String()}).Debug("found local peer")
+			add([]peer.Peer{p})
+		}
+	}
+}
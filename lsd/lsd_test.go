@@ -0,0 +1,107 @@
+package lsd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mitander/bitrush/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnouncement(t *testing.T) {
+	ih := [20]byte{0xAB, 0xCD}
+	tests := map[string]struct {
+		input  string
+		output *Announcement
+		fails  bool
+	}{
+		"announcement": {
+			input:  "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6889\r\nInfohash: abcd000000000000000000000000000000000000\r\ncookie: abc\r\n\r\n\r\n",
+			output: &Announcement{Port: 6889, InfoHashes: [][20]byte{ih}, Cookie: "abc"},
+			fails:  false,
+		},
+		"invalid info hashes": {
+			input:  "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6889\r\nInfohash: abcd\r\nInfohash: ABCD000000000000000000000000000000000000\r\nInfohash: xbcd000000000000000000000000000000000000\r\n\r\n\r\n",
+			output: &Announcement{Port: 6889, InfoHashes: [][20]byte{ih}},
+			fails:  false,
+		},
+		"missing port": {
+			input:  "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nInfohash: abcd000000000000000000000000000000000000\r\n\r\n\r\n", // <- fails here
+			output: nil,
+			fails:  true,
+		},
+		"wrong method": {
+			input:  "NOTIFY * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6889\r\n\r\n\r\n", // <- fails here
+			output: nil,
+			fails:  true,
+		},
+	}
+
+	for name, test := range tests {
+		a, err := Parse([]byte(test.input))
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, a, name)
+	}
+
+	a := tests["announcement"].output
+	assert.Equal(t, tests["announcement"].input, string(a.Marshal(Group4.String())))
+}
+
+func TestHandle(t *testing.T) {
+	l := New(6889)
+	var found []peer.Peer
+	l.Register([20]byte{1}, func(peers []peer.Peer) {
+		found = append(found, peers...)
+	})
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: Port}
+
+	// our own announcement
+	own := &Announcement{Port: 6889, InfoHashes: [][20]byte{{1}}, Cookie: l.cookie}
+	l.handle(own.Marshal(Group4.String()), from)
+	assert.Empty(t, found)
+
+	// unknown torrents are ignored
+	other := &Announcement{Port: 6890, InfoHashes: [][20]byte{{2}, {1}}, Cookie: "other"}
+	l.handle(other.Marshal(Group4.String()), from)
+	assert.Equal(t, []peer.Peer{{IP: net.IP{192, 168, 1, 2}, Port: 6890}}, found)
+
+	l.Unregister([20]byte{1})
+	l.handle(other.Marshal(Group4.String()), from)
+	assert.Equal(t, 1, len(found))
+}
+
+func TestAnnounce(t *testing.T) {
+	l := New(6889)
+	for i := 0; i < 60; i++ {
+		l.Register([20]byte{byte(i)}, nil)
+	}
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+	require.Nil(t, l.announce(conn, conn.LocalAddr().(*net.UDPAddr)))
+
+	// the info hashes are split over packets
+	got := make(map[[20]byte]bool)
+	packets := 0
+	buf := make([]byte, 2048)
+	for len(got) < 60 {
+		n, _, err := conn.ReadFrom(buf)
+		require.Nil(t, err)
+		assert.LessOrEqual(t, n, maxPacketSize)
+		a, err := Parse(buf[:n])
+		require.Nil(t, err)
+		assert.Equal(t, 6889, a.Port)
+		assert.Equal(t, l.cookie, a.Cookie)
+		for _, ih := range a.InfoHashes {
+			got[ih] = true
+		}
+		packets++
+	}
+	assert.Equal(t, 3, packets)
+}
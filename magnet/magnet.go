@@ -0,0 +1,151 @@
+package magnet
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/mitander/bitrush/dht"
+	"github.com/mitander/bitrush/metainfo"
+	"github.com/mitander/bitrush/peer"
+	"github.com/mitander/bitrush/tracker"
+	log "github.com/sirupsen/logrus"
+)
+
+// Magnet is a parsed magnet link
+// [https://www.bittorrent.org/beps/bep_0009.html#magnet-uri-format]
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+}
+
+func Parse(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to parse magnet link")
+		return nil, err
+	}
+
+	if u.Scheme != "magnet" {
+		err := errors.New("invalid magnet link: wrong scheme")
+		log.WithFields(log.Fields{"got": u.Scheme, "expected": "magnet"}).Error(err.Error())
+		return nil, err
+	}
+
+	q := u.Query()
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+	}
+
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		m.InfoHash, err = parseInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	err = errors.New("invalid magnet link: missing info hash")
+	log.Error(err.Error())
+	return nil, err
+}
+
+// info hash is either 40 characters hex or 32 characters base32 encoded
+func parseInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+	var b []byte
+	var err error
+
+	switch len(s) {
+	case 40:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = errors.New("invalid info hash length")
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "info_hash": s}).Error("failed to parse info hash")
+		return infoHash, err
+	}
+
+	copy(infoHash[:], b)
+	return infoHash, nil
+}
+
+// MetaInfo fetches the info dictionary from peers found through the magnet
+// trackers and the DHT, if not nil, and builds the meta info from it. Peers
+// are connected to through dl.
+func (m *Magnet) MetaInfo(ctx context.Context, peerID [20]byte, d *dht.DHT, dl *peer.Dialer) (*metainfo.MetaInfo, error) {
+	peers := m.requestPeers(ctx, peerID, d)
+	if len(peers) == 0 {
+		err := errors.New("no peers found for magnet link")
+		log.WithFields(log.Fields{"name": m.Name}).Error(err.Error())
+		return nil, err
+	}
+	log.Debugf("fetching metadata from %d peers", len(peers))
+
+	info, err := fetchMetadata(ctx, dl, peers, m.InfoHash, peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	var announce [][]string
+	if len(m.Trackers) != 0 {
+		announce = [][]string{m.Trackers}
+	}
+	return metainfo.NewMetaInfoFromInfo(info, announce)
+}
+
+func (m *Magnet) requestPeers(ctx context.Context, peerID [20]byte, d *dht.DHT) []peer.Peer {
+	var peers []peer.Peer
+	seen := make(map[string]bool)
+	add := func(found []peer.Peer) {
+		for _, p := range found {
+			if !seen[p.String()] {
+				seen[p.String()] = true
+				peers = append(peers, p)
+			}
+		}
+	}
+
+	for _, announce := range m.Trackers {
+		// length is unknown until metadata is fetched,
+		// announce as a leecher with one byte left
+		tr, err := tracker.NewTracker(announce, m.InfoHash, peerID)
+		if err != nil {
+			continue
+		}
+
+		actx, cancel := context.WithTimeout(ctx, tracker.AnnounceTimeout)
+		res, err := tr.Announce(actx, tracker.AnnounceRequest{Left: 1, NumWant: tracker.DefaultNumWant})
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		add(res.Peers)
+	}
+
+	if d != nil {
+		var err error
+		if d.Len() == 0 {
+			err = d.Bootstrap(ctx)
+		}
+		if err == nil {
+			found, err := d.GetPeers(ctx, m.InfoHash)
+			if err == nil {
+				add(found)
+			}
+		}
+	}
+	return peers
+}
@@ -0,0 +1,59 @@
+package magnet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	tests := map[string]struct {
+		input  string
+		output *Magnet
+		fails  bool
+	}{
+		"correct input: hex": {
+			input: "magnet:?xt=urn:btih:86d4c80024a469be4c50bc5a102cf71780310074&dn=debian-10.9.0-amd64-netinst.iso&tr=http%3A%2F%2Fbttracker.debian.org%3A6969%2Fannounce",
+			output: &Magnet{
+				InfoHash: infoHash,
+				Name:     "debian-10.9.0-amd64-netinst.iso",
+				Trackers: []string{"http://bttracker.debian.org:6969/announce"},
+			},
+			fails: false,
+		},
+		"correct input: base32": {
+			input: "magnet:?xt=urn:btih:Q3KMQABEURU34TCQXRNBALHXC6ADCADU&tr=udp%3A%2F%2Ffirst.tracker.org%3A1337&tr=http%3A%2F%2Fsecond.tracker.org%2Fannounce",
+			output: &Magnet{
+				InfoHash: infoHash,
+				Trackers: []string{"udp://first.tracker.org:1337", "http://second.tracker.org/announce"},
+			},
+			fails: false,
+		},
+		"invalid scheme": {
+			input:  "http://xt=urn:btih:86d4c80024a469be4c50bc5a102cf71780310074",
+			output: nil,
+			fails:  true,
+		},
+		"missing info hash": {
+			input:  "magnet:?dn=test.iso",
+			output: nil,
+			fails:  true,
+		},
+		"invalid info hash": {
+			input:  "magnet:?xt=urn:btih:86d4c80024a469be4c50bc5a102cf717803100", // <- fails here: 38 characters
+			output: nil,
+			fails:  true,
+		},
+	}
+
+	for name, test := range tests {
+		m, err := Parse(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, m, name)
+	}
+}
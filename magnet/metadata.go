@@ -0,0 +1,258 @@
+package magnet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/mitander/bitrush/extension"
+	"github.com/mitander/bitrush/handshake"
+	"github.com/mitander/bitrush/message"
+	"github.com/mitander/bitrush/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// [https://www.bittorrent.org/beps/bep_0009.html]
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+const (
+	MetadataPieceSize = 16384
+	MaxMetadataSize   = 8 * 1024 * 1024
+	// extended message id we ask peers to use for ut_metadata
+	utMetadataID = 1
+	// number of peers asked for metadata at the same time
+	maxFetchers = 10
+)
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+func formatMetadataMsg(id uint8, mm metadataMsg, data []byte) (*message.Message, error) {
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, mm)
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(data)
+	return extension.FormatMsg(id, buf.Bytes()), nil
+}
+
+// metadata data messages carry the raw piece after the bencoded dictionary
+func parseMetadataMsg(payload []byte) (metadataMsg, []byte, error) {
+	mm := metadataMsg{}
+	r := bufio.NewReader(bytes.NewReader(payload))
+	err := bencode.Unmarshal(r, &mm)
+	if err != nil {
+		return mm, nil, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return mm, nil, err
+	}
+	return mm, data, nil
+}
+
+// fetchMetadata asks peers for the info dictionary until one of them
+// delivers metadata matching the info hash.
+func fetchMetadata(ctx context.Context, dl *peer.Dialer, peers []peer.Peer, infoHash, peerID [20]byte) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := maxFetchers
+	if len(peers) < workers {
+		workers = len(peers)
+	}
+
+	peerC := make(chan peer.Peer)
+	resultC := make(chan []byte)
+	doneC := make(chan struct{}, workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for p := range peerC {
+				info, err := fetchPeerMetadata(ctx, dl, p, infoHash, peerID)
+				if err != nil {
+					log.WithFields(log.Fields{"reason": err.Error(), "peer": p.String()}).Debug("failed to fetch metadata")
+					continue
+				}
+				select {
+				case resultC <- info:
+				case <-ctx.Done():
+				}
+				return
+			}
+			doneC <- struct{}{}
+		}()
+	}
+
+	go func() {
+		defer close(peerC)
+		for _, p := range peers {
+			select {
+			case peerC <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for workers > 0 {
+		select {
+		case info := <-resultC:
+			return info, nil
+		case <-doneC:
+			workers--
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	err := errors.New("no peer delivered metadata")
+	log.Error(err.Error())
+	return nil, err
+}
+
+func fetchPeerMetadata(ctx context.Context, dl *peer.Dialer, p peer.Peer, infoHash, peerID [20]byte) ([]byte, error) {
+	conn, err := dl.Dial(p, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	hs := handshake.NewHandshake(infoHash, peerID)
+	hs.EnableExtensions()
+	res, err := hs.Send(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !res.SupportsExtensions() {
+		return nil, errors.New("peer does not support extensions")
+	}
+
+	// 30 seconds deadline to fetch all metadata
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	msg, err := extension.FormatHandshakeMsg(&extension.Handshake{
+		M: map[string]int{"ut_metadata": utMetadataID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(msg.Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata []byte
+	var pieces []bool
+	received := 0
+	for {
+		msg, err := message.ReadMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+
+		id, payload, err := extension.ParseMsg(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		switch id {
+		case extension.HandshakeID:
+			eh, err := extension.ParseHandshakeMsg(msg)
+			if err != nil {
+				return nil, err
+			}
+			metadata, err = requestMetadata(conn, eh)
+			if err != nil {
+				return nil, err
+			}
+			pieces = make([]bool, numMetadataPieces(len(metadata)))
+
+		case utMetadataID:
+			mm, data, err := parseMetadataMsg(payload)
+			if err != nil {
+				return nil, err
+			}
+			if mm.MsgType == metadataReject {
+				return nil, errors.New("peer rejected metadata request")
+			}
+			if mm.MsgType != metadataData || metadata == nil {
+				continue
+			}
+
+			begin := mm.Piece * MetadataPieceSize
+			end := begin + MetadataPieceSize
+			if end > len(metadata) {
+				end = len(metadata)
+			}
+			if begin < 0 || begin >= len(metadata) || len(data) != end-begin {
+				return nil, errors.New("invalid metadata piece")
+			}
+			if pieces[mm.Piece] {
+				continue
+			}
+			copy(metadata[begin:end], data)
+			pieces[mm.Piece] = true
+			received++
+
+			if received == len(pieces) {
+				hash := sha1.Sum(metadata)
+				if !bytes.Equal(hash[:], infoHash[:]) {
+					return nil, errors.New("metadata validation failed")
+				}
+				return metadata, nil
+			}
+		}
+	}
+}
+
+// requestMetadata requests every metadata piece from the peer and returns
+// the buffer the pieces are received into.
+func requestMetadata(conn net.Conn, eh *extension.Handshake) ([]byte, error) {
+	id, ok := eh.M["ut_metadata"]
+	if !ok || id == 0 {
+		return nil, errors.New("peer does not support ut_metadata")
+	}
+	if eh.MetadataSize <= 0 || eh.MetadataSize > MaxMetadataSize {
+		return nil, errors.New("invalid metadata size")
+	}
+
+	for i := 0; i < numMetadataPieces(eh.MetadataSize); i++ {
+		msg, err := formatMetadataMsg(uint8(id), metadataMsg{MsgType: metadataRequest, Piece: i}, nil)
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.Write(msg.Serialize())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return make([]byte, eh.MetadataSize), nil
+}
+
+func numMetadataPieces(size int) int {
+	return (size + MetadataPieceSize - 1) / MetadataPieceSize
+}
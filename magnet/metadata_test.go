@@ -0,0 +1,110 @@
+package magnet
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mitander/bitrush/extension"
+	"github.com/mitander/bitrush/handshake"
+	"github.com/mitander/bitrush/message"
+	"github.com/mitander/bitrush/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveMetadata accepts a single connection and answers metadata requests
+func serveMetadata(t *testing.T, l net.Listener, info []byte, reject bool) {
+	conn, err := l.Accept()
+	require.Nil(t, err)
+	defer conn.Close()
+
+	hs, err := handshake.ReadHandshake(conn)
+	require.Nil(t, err)
+	reply := handshake.NewHandshake(hs.InfoHash, [20]byte{1})
+	reply.EnableExtensions()
+	require.Nil(t, reply.Reply(conn))
+
+	msg, err := extension.FormatHandshakeMsg(&extension.Handshake{
+		M:            map[string]int{"ut_metadata": 3},
+		MetadataSize: len(info),
+	})
+	require.Nil(t, err)
+	conn.Write(msg.Serialize())
+
+	for {
+		msg, err := message.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		id, payload, err := extension.ParseMsg(msg)
+		require.Nil(t, err)
+		if id != 3 {
+			continue
+		}
+
+		mm, _, err := parseMetadataMsg(payload)
+		require.Nil(t, err)
+		if reject {
+			res, _ := formatMetadataMsg(utMetadataID, metadataMsg{MsgType: metadataReject, Piece: mm.Piece}, nil)
+			conn.Write(res.Serialize())
+			continue
+		}
+
+		begin := mm.Piece * MetadataPieceSize
+		end := begin + MetadataPieceSize
+		if end > len(info) {
+			end = len(info)
+		}
+		res, _ := formatMetadataMsg(utMetadataID, metadataMsg{MsgType: metadataData, Piece: mm.Piece, TotalSize: len(info)}, info[begin:end])
+		conn.Write(res.Serialize())
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	// large enough to span two metadata pieces
+	pieces := strings.Repeat("T0e1S2t3P4i5E6c7E8s9", 1000)
+	info := []byte(fmt.Sprintf("d6:lengthi16000e4:name8:test.iso12:piece lengthi16e6:pieces%d:%se", len(pieces), pieces))
+
+	tests := map[string]struct {
+		infoHash [20]byte
+		reject   bool
+		fails    bool
+	}{
+		"correct input": {
+			infoHash: sha1.Sum(info),
+			reject:   false,
+			fails:    false,
+		},
+		"peer rejects request": {
+			infoHash: sha1.Sum(info),
+			reject:   true, // <- fails here
+			fails:    true,
+		},
+		"metadata hash mismatch": {
+			infoHash: [20]byte{1, 2, 3}, // <- fails here
+			reject:   false,
+			fails:    true,
+		},
+	}
+
+	for name, test := range tests {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		require.Nil(t, err, name)
+		go serveMetadata(t, l, info, test.reject)
+
+		addr := l.Addr().(*net.TCPAddr)
+		peers := []peer.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}
+		res, err := fetchMetadata(context.Background(), &peer.Dialer{}, peers, test.infoHash, [20]byte{2})
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, info, res, name)
+		}
+		l.Close()
+	}
+}
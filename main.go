@@ -1,28 +1,55 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/mitander/bitrush/dht"
+	"github.com/mitander/bitrush/lsd"
+	"github.com/mitander/bitrush/magnet"
 	"github.com/mitander/bitrush/metainfo"
+	"github.com/mitander/bitrush/mse"
+	"github.com/mitander/bitrush/peer"
 	"github.com/mitander/bitrush/torrent"
+	"github.com/mitander/bitrush/tracker"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	read  = flag.String("f", "./metainfo/testdata/debian-10.9.0-amd64-netinst.iso.torrent", "open .torrent file")
+	read  = flag.String("f", "./metainfo/testdata/debian-10.9.0-amd64-netinst.iso.torrent", "open .torrent file or magnet link")
 	write = flag.String("o", "out", "download directory")
 	help  = flag.Bool("h", false, "show help")
 	debug = flag.Bool("d", false, "enable debug mode")
+	ratio = flag.Float64("r", 0, "seed until upload ratio is reached")
+	seed  = flag.Duration("s", 0, "seed for duration after download")
+	qmin  = flag.Int("qmin", torrent.DefaultMinRequests, "minimum outstanding block requests per peer")
+	qmax  = flag.Int("qmax", torrent.DefaultMaxRequests, "maximum outstanding block requests per peer")
+	slots = flag.Int("u", torrent.DefaultUploadSlots, "number of peers uploaded to at a time")
+	crypt = flag.String("e", mse.PreferEncrypted.String(), "encryption policy: plaintext, prefer or require")
+	local = flag.Bool("lsd", true, "find peers on the local network")
+	micro = flag.Bool("utp", true, "connect to peers over utp before tcp")
+	node  = flag.String("dht", fmt.Sprintf(":%d", dht.DefaultPort), "udp address of the dht node, empty disables the dht")
 )
 
 func main() {
-	flag.Parse()
-
 	log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+
+	if len(os.Args) > 1 && os.Args[1] == "scrape" {
+		runScrape(os.Args[2:])
+		return
+	}
+
+	flag.Parse()
 	if *debug {
 		log.SetLevel(log.DebugLevel)
 	}
@@ -32,12 +59,39 @@ func main() {
 		os.Exit(1)
 	}
 
-	if !strings.Contains(*read, ".torrent") {
+	policy, err := mse.ParsePolicy(*crypt)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	d := startDHT(ctx)
+
+	// the listener is started first so metadata is fetched over uTP as well
+	dl := &peer.Dialer{Encryption: policy}
+	l, err := torrent.NewListener(tracker.TrackerPort)
+	if err != nil {
+		log.Warnf("not accepting incoming peers: %s", err.Error())
+	} else {
+		l.Encryption = policy
+		if *micro {
+			dl.UTP = l.UTP()
+		}
+		go l.Serve(ctx)
+	}
+
+	var m *metainfo.MetaInfo
+	switch {
+	case strings.HasPrefix(*read, "magnet:"):
+		m, err = openMagnet(ctx, *read, d, dl)
+	case strings.Contains(*read, ".torrent"):
+		m, err = metainfo.NewMetaInfo(*read)
+	default:
 		printNoArgs()
 		os.Exit(1)
 	}
-
-	m, err := metainfo.NewMetaInfo(*read)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -47,8 +101,35 @@ func main() {
 		log.Fatal(err)
 	}
 
-	err = t.Download(*write)
+	t.SeedRatio = *ratio
+	t.SeedTime = *seed
+	t.MinRequests = *qmin
+	t.MaxRequests = *qmax
+	t.UploadSlots = *slots
+	t.DHT = d
+	t.Encryption = policy
+	t.UTP = dl.UTP
+	t.ResumeFile = filepath.Join(*write, "."+t.Name+".resume")
+
+	if l != nil {
+		l.Register(t)
+
+		if *local {
+			s := lsd.New(l.Addr().(*net.TCPAddr).Port)
+			s.Register(t.InfoHash, t.AddPeers)
+			go s.Serve(ctx)
+		}
+	}
+
+	err = t.Download(ctx, *write)
+	saveDHT(d)
+	if errors.Is(err, context.Canceled) {
+		log.Info("Download stopped")
+		printTrackerStatus(t)
+		return
+	}
 	if err != nil {
+		printTrackerStatus(t)
 		log.Fatal(err)
 	}
 
@@ -57,18 +138,113 @@ func main() {
 	os.Exit(1)
 }
 
+// startDHT starts the dht node, it joins through the nodes saved by the
+// previous run and the default routers. Returns nil if disabled or failed.
+func startDHT(ctx context.Context) *dht.DHT {
+	if *node == "" {
+		return nil
+	}
+
+	id, nodes, _ := dht.Load(filepath.Join(*write, ".dht"))
+	d, err := dht.New(dht.Config{Addr: *node, ID: id, Nodes: nodes, Routers: dht.DefaultRouters})
+	if err != nil {
+		log.Warnf("not using the dht: %s", err.Error())
+		return nil
+	}
+	go d.Serve(ctx)
+	return d
+}
+
+func saveDHT(d *dht.DHT) {
+	if d != nil {
+		d.Save(filepath.Join(*write, ".dht"))
+	}
+}
+
+func openMagnet(ctx context.Context, uri string, d *dht.DHT, dl *peer.Dialer) (*metainfo.MetaInfo, error) {
+	mag, err := magnet.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := torrent.NewPeerID()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Fetching metadata: %s", mag.Name)
+	return mag.MetaInfo(ctx, id, d, dl)
+}
+
+func printTrackerStatus(t *torrent.Torrent) {
+	for _, s := range t.TrackerStatus() {
+		fields := log.Fields{"announce": s.URL, "seeders": s.Seeders, "leechers": s.Leechers}
+		if !s.LastSuccess.IsZero() {
+			fields["last_success"] = s.LastSuccess.Format(time.RFC3339)
+		}
+		if s.Warning != "" {
+			fields["warning"] = s.Warning
+		}
+
+		var trErr *tracker.Error
+		switch {
+		case errors.As(s.LastError, &trErr):
+			fields["kind"] = trErr.Kind
+			log.WithFields(fields).Warn(trErr.Error())
+		case s.LastError != nil:
+			log.WithFields(fields).Warn(s.LastError.Error())
+		default:
+			log.WithFields(fields).Info("tracker ok")
+		}
+	}
+}
+
 func printHelpMenu() {
 	fmt.Println("")
 	fmt.Println("BitRush")
 	fmt.Println("-------")
 	fmt.Println("-f [file] (required)")
-	fmt.Println("Info: torrent file you want to open")
+	fmt.Println("Info: torrent file or magnet link you want to open")
 	fmt.Println("Usage: bitrush -f <torrent file>")
+	fmt.Println("Usage: bitrush -f 'magnet:?xt=urn:btih:<info hash>'")
 	fmt.Println("")
 	fmt.Println("-o [out file] (optional)")
 	fmt.Println("Info: output file location - default '.' (current directory)")
 	fmt.Println("Usage: bitrush -o <output file>")
 	fmt.Println("")
+	fmt.Println("-r [ratio] (optional)")
+	fmt.Println("Info: keep seeding until upload ratio is reached - default 0 (no seeding)")
+	fmt.Println("Usage: bitrush -r 1.5")
+	fmt.Println("")
+	fmt.Println("-s [seed time] (optional)")
+	fmt.Println("Info: keep seeding for duration after download - default 0 (no seeding)")
+	fmt.Println("Usage: bitrush -s 1h")
+	fmt.Println("")
+	fmt.Println("-qmin, -qmax [requests] (optional)")
+	fmt.Println("Info: bounds of outstanding block requests per peer, adapted to its download rate - default 2 and 250")
+	fmt.Println("Usage: bitrush -qmin 4 -qmax 500")
+	fmt.Println("")
+	fmt.Println("-u [upload slots] (optional)")
+	fmt.Println("Info: number of peers unchoked at a time, one of them at random - default 4")
+	fmt.Println("Usage: bitrush -u 8")
+	fmt.Println("")
+	fmt.Println("-dht [address] (optional)")
+	fmt.Println("Info: udp address of the dht node finding peers without trackers, empty disables it - default ':6881'")
+	fmt.Println("Usage: bitrush -dht :6882")
+	fmt.Println("Usage: bitrush -dht ''")
+	fmt.Println("")
+	fmt.Println("-e [policy] (optional)")
+	fmt.Println("Info: encryption of peer connections: plaintext, prefer or require - default prefer")
+	fmt.Println("Usage: bitrush -e require")
+	fmt.Println("")
+	fmt.Println("-lsd [enabled] (optional)")
+	fmt.Println("Info: announce the torrent to peers on the local network and connect to them - default true")
+	fmt.Println("Usage: bitrush -lsd=false")
+	fmt.Println("")
+	fmt.Println("-utp [enabled] (optional)")
+	fmt.Println("Info: connect to peers over utp and fall back to tcp, incoming utp connections are accepted either way - default true")
+	fmt.Println("Usage: bitrush -utp=false")
+	fmt.Println("")
 	fmt.Println("-h [help] (optional)")
 	fmt.Println("Info: show help menu")
 	fmt.Println("Usage: bitrush -h")
@@ -76,6 +252,11 @@ func printHelpMenu() {
 	fmt.Println("-d [debug] (optional")
 	fmt.Println("info: enable debug")
 	fmt.Println("Usage: bitrush -d")
+	fmt.Println("")
+	fmt.Println("scrape [command]")
+	fmt.Println("Info: show seeders, leechers and completed downloads reported by each tracker")
+	fmt.Println("Usage: bitrush scrape -f <torrent file>")
+	fmt.Println("Usage: bitrush scrape -f <torrent file> -t 30s")
 	fmt.Println("-------")
 	fmt.Println("")
 }
@@ -84,7 +265,7 @@ func printNoArgs() {
 	fmt.Println("")
 	fmt.Println("BitRush")
 	fmt.Println("-------")
-	fmt.Println("No .torrent file selected!")
+	fmt.Println("No .torrent file or magnet link selected!")
 	fmt.Println("")
 	fmt.Println("Usage: bitrush -f <torrent file>")
 	fmt.Println("Help: bitrush -h")
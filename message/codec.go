@@ -0,0 +1,330 @@
+package message
+
+import (
+	"encoding/binary"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Typed is a message decoded from its wire format, Marshal and Unmarshal
+// convert it to and from a Message. Payload lengths are validated strictly.
+type Typed interface {
+	ID() MessageID
+	Marshal() *Message
+	Unmarshal(msg *Message) error
+}
+
+type (
+	Choke         struct{}
+	Unchoke       struct{}
+	Interested    struct{}
+	NotInterested struct{}
+	HaveAll       struct{}
+	HaveNone      struct{}
+)
+
+// Have: <index>
+type Have struct {
+	Index int
+}
+
+// SuggestPiece: <index>
+type SuggestPiece struct {
+	Index int
+}
+
+// AllowedFast: <index>
+type AllowedFast struct {
+	Index int
+}
+
+// Bitfield: <bitfield>, its length is validated against the number of
+// pieces by the caller.
+type Bitfield struct {
+	Bitfield []byte
+}
+
+// Request: <index><begin><length>
+type Request struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// Cancel: <index><begin><length>
+type Cancel struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// RejectRequest: <index><begin><length>
+type RejectRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// Piece: <index><begin><block>, an unmarshalled block shares the payload
+// of the message.
+type Piece struct {
+	Index int
+	Begin int
+	Block []byte
+}
+
+// Port: <port>
+type Port struct {
+	Port int
+}
+
+// Extended: <extended message id><payload>
+// [https://www.bittorrent.org/beps/bep_0010.html]
+type Extended struct {
+	ExtendedID uint8
+	Payload    []byte
+}
+
+// Parse decodes a message into its typed form, keep-alives decode to nil.
+func Parse(msg *Message) (Typed, error) {
+	if msg == nil {
+		return nil, nil
+	}
+
+	var t Typed
+	switch msg.ID {
+	case MsgChoke:
+		t = &Choke{}
+	case MsgUnchoke:
+		t = &Unchoke{}
+	case MsgInterested:
+		t = &Interested{}
+	case MsgNotInterested:
+		t = &NotInterested{}
+	case MsgHave:
+		t = &Have{}
+	case MsgBitfield:
+		t = &Bitfield{}
+	case MsgRequest:
+		t = &Request{}
+	case MsgPiece:
+		t = &Piece{}
+	case MsgCancel:
+		t = &Cancel{}
+	case MsgPort:
+		t = &Port{}
+	case MsgSuggestPiece:
+		t = &SuggestPiece{}
+	case MsgHaveAll:
+		t = &HaveAll{}
+	case MsgHaveNone:
+		t = &HaveNone{}
+	case MsgRejectRequest:
+		t = &RejectRequest{}
+	case MsgAllowedFast:
+		t = &AllowedFast{}
+	case MsgExtended:
+		t = &Extended{}
+	default:
+		log.WithFields(log.Fields{"got": msg.ID}).Debug(UnknownMessageId.Error())
+		return nil, UnknownMessageId
+	}
+
+	err := t.Unmarshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (Choke) ID() MessageID         { return MsgChoke }
+func (Unchoke) ID() MessageID       { return MsgUnchoke }
+func (Interested) ID() MessageID    { return MsgInterested }
+func (NotInterested) ID() MessageID { return MsgNotInterested }
+func (HaveAll) ID() MessageID       { return MsgHaveAll }
+func (HaveNone) ID() MessageID      { return MsgHaveNone }
+func (Have) ID() MessageID          { return MsgHave }
+func (SuggestPiece) ID() MessageID  { return MsgSuggestPiece }
+func (AllowedFast) ID() MessageID   { return MsgAllowedFast }
+func (Bitfield) ID() MessageID      { return MsgBitfield }
+func (Request) ID() MessageID       { return MsgRequest }
+func (Cancel) ID() MessageID        { return MsgCancel }
+func (RejectRequest) ID() MessageID { return MsgRejectRequest }
+func (Piece) ID() MessageID         { return MsgPiece }
+func (Port) ID() MessageID          { return MsgPort }
+func (Extended) ID() MessageID      { return MsgExtended }
+
+func (m Choke) Marshal() *Message         { return &Message{ID: m.ID()} }
+func (m Unchoke) Marshal() *Message       { return &Message{ID: m.ID()} }
+func (m Interested) Marshal() *Message    { return &Message{ID: m.ID()} }
+func (m NotInterested) Marshal() *Message { return &Message{ID: m.ID()} }
+func (m HaveAll) Marshal() *Message       { return &Message{ID: m.ID()} }
+func (m HaveNone) Marshal() *Message      { return &Message{ID: m.ID()} }
+func (m Have) Marshal() *Message          { return marshalIndex(m.ID(), m.Index) }
+func (m SuggestPiece) Marshal() *Message  { return marshalIndex(m.ID(), m.Index) }
+func (m AllowedFast) Marshal() *Message   { return marshalIndex(m.ID(), m.Index) }
+
+func (m Request) Marshal() *Message {
+	return marshalBlock(m.ID(), m.Index, m.Begin, m.Length)
+}
+
+func (m Cancel) Marshal() *Message {
+	return marshalBlock(m.ID(), m.Index, m.Begin, m.Length)
+}
+
+func (m RejectRequest) Marshal() *Message {
+	return marshalBlock(m.ID(), m.Index, m.Begin, m.Length)
+}
+
+func (m Bitfield) Marshal() *Message {
+	return &Message{ID: m.ID(), Payload: append([]byte{}, m.Bitfield...)}
+}
+
+func (m Piece) Marshal() *Message {
+	payload := make([]byte, 8+len(m.Block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(m.Index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(m.Begin))
+	copy(payload[8:], m.Block)
+	return &Message{ID: m.ID(), Payload: payload}
+}
+
+func (m Port) Marshal() *Message {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(m.Port))
+	return &Message{ID: m.ID(), Payload: payload}
+}
+
+func (m Extended) Marshal() *Message {
+	payload := make([]byte, 1+len(m.Payload))
+	payload[0] = m.ExtendedID
+	copy(payload[1:], m.Payload)
+	return &Message{ID: m.ID(), Payload: payload}
+}
+
+func (m *Choke) Unmarshal(msg *Message) error         { return check(msg, m.ID(), 0, 0) }
+func (m *Unchoke) Unmarshal(msg *Message) error       { return check(msg, m.ID(), 0, 0) }
+func (m *Interested) Unmarshal(msg *Message) error    { return check(msg, m.ID(), 0, 0) }
+func (m *NotInterested) Unmarshal(msg *Message) error { return check(msg, m.ID(), 0, 0) }
+func (m *HaveAll) Unmarshal(msg *Message) error       { return check(msg, m.ID(), 0, 0) }
+func (m *HaveNone) Unmarshal(msg *Message) error      { return check(msg, m.ID(), 0, 0) }
+
+func (m *Have) Unmarshal(msg *Message) (err error) {
+	m.Index, err = unmarshalIndex(msg, m.ID())
+	return err
+}
+
+func (m *SuggestPiece) Unmarshal(msg *Message) (err error) {
+	m.Index, err = unmarshalIndex(msg, m.ID())
+	return err
+}
+
+func (m *AllowedFast) Unmarshal(msg *Message) (err error) {
+	m.Index, err = unmarshalIndex(msg, m.ID())
+	return err
+}
+
+func (m *Request) Unmarshal(msg *Message) (err error) {
+	m.Index, m.Begin, m.Length, err = unmarshalBlock(msg, m.ID())
+	return err
+}
+
+func (m *Cancel) Unmarshal(msg *Message) (err error) {
+	m.Index, m.Begin, m.Length, err = unmarshalBlock(msg, m.ID())
+	return err
+}
+
+func (m *RejectRequest) Unmarshal(msg *Message) (err error) {
+	m.Index, m.Begin, m.Length, err = unmarshalBlock(msg, m.ID())
+	return err
+}
+
+func (m *Bitfield) Unmarshal(msg *Message) error {
+	err := check(msg, m.ID(), 0, -1)
+	if err != nil {
+		return err
+	}
+	m.Bitfield = msg.Payload
+	return nil
+}
+
+func (m *Piece) Unmarshal(msg *Message) error {
+	err := check(msg, m.ID(), 8, -1)
+	if err != nil {
+		return err
+	}
+	m.Index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	m.Begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	m.Block = msg.Payload[8:]
+	return nil
+}
+
+func (m *Port) Unmarshal(msg *Message) error {
+	err := check(msg, m.ID(), 2, 2)
+	if err != nil {
+		return err
+	}
+	m.Port = int(binary.BigEndian.Uint16(msg.Payload))
+	return nil
+}
+
+func (m *Extended) Unmarshal(msg *Message) error {
+	err := check(msg, m.ID(), 1, -1)
+	if err != nil {
+		return err
+	}
+	m.ExtendedID = msg.Payload[0]
+	m.Payload = msg.Payload[1:]
+	return nil
+}
+
+// check validates the id and the payload length of a message, a negative
+// max allows payloads of any length.
+func check(msg *Message, id MessageID, min, max int) error {
+	if msg == nil || msg.ID != id {
+		got := "keep-alive"
+		if msg != nil {
+			got = msg.name()
+		}
+		log.WithFields(log.Fields{"got": got, "expected": id}).Debug(InvalidMessageId.Error())
+		return InvalidMessageId
+	}
+
+	if len(msg.Payload) < min || (max >= 0 && len(msg.Payload) > max) {
+		log.WithFields(log.Fields{"got": len(msg.Payload), "expected-min": min, "expected-max": max}).Debug(InvalidPayloadLength.Error())
+		return InvalidPayloadLength
+	}
+	return nil
+}
+
+func marshalIndex(id MessageID, index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{ID: id, Payload: payload}
+}
+
+func unmarshalIndex(msg *Message, id MessageID) (int, error) {
+	err := check(msg, id, 4, 4)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+func marshalBlock(id MessageID, index, begin, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &Message{ID: id, Payload: payload}
+}
+
+func unmarshalBlock(msg *Message, id MessageID) (index, begin, length int, err error) {
+	err = check(msg, id, 12, 12)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
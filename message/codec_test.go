@@ -0,0 +1,128 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := map[string]struct {
+		input Typed
+		wire  []byte
+	}{
+		"choke":          {input: &Choke{}, wire: []byte{0, 0, 0, 1, 0}},
+		"unchoke":        {input: &Unchoke{}, wire: []byte{0, 0, 0, 1, 1}},
+		"interested":     {input: &Interested{}, wire: []byte{0, 0, 0, 1, 2}},
+		"not interested": {input: &NotInterested{}, wire: []byte{0, 0, 0, 1, 3}},
+		"have":           {input: &Have{Index: 258}, wire: []byte{0, 0, 0, 5, 4, 0, 0, 1, 2}},
+		"bitfield":       {input: &Bitfield{Bitfield: []byte{0b10100000, 0b1}}, wire: []byte{0, 0, 0, 3, 5, 0b10100000, 0b1}},
+		"request":        {input: &Request{Index: 1, Begin: 16384, Length: 16384}, wire: []byte{0, 0, 0, 13, 6, 0, 0, 0, 1, 0, 0, 0x40, 0, 0, 0, 0x40, 0}},
+		"piece":          {input: &Piece{Index: 1, Begin: 2, Block: []byte{0xAA, 0xBB}}, wire: []byte{0, 0, 0, 11, 7, 0, 0, 0, 1, 0, 0, 0, 2, 0xAA, 0xBB}},
+		"cancel":         {input: &Cancel{Index: 1, Begin: 2, Length: 3}, wire: []byte{0, 0, 0, 13, 8, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}},
+		"port":           {input: &Port{Port: 6881}, wire: []byte{0, 0, 0, 3, 9, 0x1A, 0xE1}},
+		"suggest piece":  {input: &SuggestPiece{Index: 7}, wire: []byte{0, 0, 0, 5, 13, 0, 0, 0, 7}},
+		"have all":       {input: &HaveAll{}, wire: []byte{0, 0, 0, 1, 14}},
+		"have none":      {input: &HaveNone{}, wire: []byte{0, 0, 0, 1, 15}},
+		"reject request": {input: &RejectRequest{Index: 1, Begin: 2, Length: 3}, wire: []byte{0, 0, 0, 13, 16, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3}},
+		"allowed fast":   {input: &AllowedFast{Index: 7}, wire: []byte{0, 0, 0, 5, 17, 0, 0, 0, 7}},
+		"extended":       {input: &Extended{ExtendedID: 1, Payload: []byte("d1:ai1ee")}, wire: append([]byte{0, 0, 0, 10, 20, 1}, "d1:ai1ee"...)},
+	}
+
+	for name, test := range tests {
+		wire := test.input.Marshal().Serialize()
+		assert.Equal(t, test.wire, wire, name)
+
+		msg, err := ReadMessage(bytes.NewReader(wire))
+		require.Nil(t, err, name)
+		got, err := Parse(msg)
+		require.Nil(t, err, name)
+		assert.Equal(t, test.input, got, name)
+		assert.Equal(t, msg.ID, got.ID(), name)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		input  *Message
+		output Typed
+		err    error
+	}{
+		"keep-alive": {
+			input:  nil,
+			output: nil,
+			err:    nil,
+		},
+		"empty bitfield": {
+			input:  &Message{ID: MsgBitfield, Payload: []byte{}},
+			output: &Bitfield{Bitfield: []byte{}},
+			err:    nil,
+		},
+		"empty block": {
+			input:  &Message{ID: MsgPiece, Payload: []byte{0, 0, 0, 1, 0, 0, 0, 2}},
+			output: &Piece{Index: 1, Begin: 2, Block: []byte{}},
+			err:    nil,
+		},
+		"choke with payload": {
+			input:  &Message{ID: MsgChoke, Payload: []byte{1}}, // <- fails here
+			output: nil,
+			err:    InvalidPayloadLength,
+		},
+		"have all with payload": {
+			input:  &Message{ID: MsgHaveAll, Payload: []byte{1}}, // <- fails here
+			output: nil,
+			err:    InvalidPayloadLength,
+		},
+		"short have": {
+			input:  &Message{ID: MsgHave, Payload: []byte{0, 0, 1}}, // <- fails here
+			output: nil,
+			err:    InvalidPayloadLength,
+		},
+		"long request": {
+			input:  &Message{ID: MsgRequest, Payload: make([]byte, 13)}, // <- fails here
+			output: nil,
+			err:    InvalidPayloadLength,
+		},
+		"short cancel": {
+			input:  &Message{ID: MsgCancel, Payload: make([]byte, 11)}, // <- fails here
+			output: nil,
+			err:    InvalidPayloadLength,
+		},
+		"short piece": {
+			input:  &Message{ID: MsgPiece, Payload: make([]byte, 7)}, // <- fails here
+			output: nil,
+			err:    InvalidPayloadLength,
+		},
+		"short port": {
+			input:  &Message{ID: MsgPort, Payload: []byte{1}}, // <- fails here
+			output: nil,
+			err:    InvalidPayloadLength,
+		},
+		"empty extended": {
+			input:  &Message{ID: MsgExtended, Payload: []byte{}}, // <- fails here
+			output: nil,
+			err:    InvalidPayloadLength,
+		},
+		"unknown id": {
+			input:  &Message{ID: 10, Payload: []byte{1}}, // <- fails here
+			output: nil,
+			err:    UnknownMessageId,
+		},
+	}
+
+	for name, test := range tests {
+		got, err := Parse(test.input)
+		assert.Equal(t, test.err, err, name)
+		assert.Equal(t, test.output, got, name)
+	}
+}
+
+func TestUnmarshalWrongID(t *testing.T) {
+	var have Have
+	assert.Equal(t, InvalidMessageId, have.Unmarshal(FormatSuggestMsg(1)))
+	assert.Equal(t, InvalidMessageId, have.Unmarshal(nil))
+	var request Request
+	assert.Equal(t, InvalidMessageId, request.Unmarshal(FormatCancelMsg(1, 2, 3)))
+}
@@ -11,8 +11,9 @@ import (
 
 var (
 	InvalidMessageId     error = errors.New("invalid message id")
+	UnknownMessageId     error = errors.New("unknown message id")
 	InvalidPayloadLength error = errors.New("invalid payload length")
-	InvalidMessageIndex  error = errors.New("invalid payload length")
+	InvalidMessageIndex  error = errors.New("invalid message index")
 	InvalidBufferLength  error = errors.New("invalid buffer length")
 	InvalidDataLength    error = errors.New("invalid data length")
 )
@@ -35,77 +36,123 @@ const (
 	MsgRequest       MessageID = 6
 	MsgPiece         MessageID = 7
 	MsgCancel        MessageID = 8
-	MsgKeepAlive     MessageID = 9
+	MsgExtended      MessageID = 20
 )
 
+// [https://www.bittorrent.org/beps/bep_0005.html]
+const MsgPort MessageID = 9
+
+// [https://www.bittorrent.org/beps/bep_0006.html]
+const (
+	MsgSuggestPiece  MessageID = 13
+	MsgHaveAll       MessageID = 14
+	MsgHaveNone      MessageID = 15
+	MsgRejectRequest MessageID = 16
+	MsgAllowedFast   MessageID = 17
+)
+
+// MaxMessageLength bounds the frames read from peers, it fits the largest
+// blocks peers request and bitfields of millions of pieces.
+const MaxMessageLength = 1 << 20
+
 func FormatRequestMsg(index, begin, length int) *Message {
-	payload := make([]byte, 12)
-	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
-	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
-	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
-	return &Message{
-		ID:      MsgRequest,
-		Payload: payload,
-	}
+	return Request{Index: index, Begin: begin, Length: length}.Marshal()
+}
+
+func FormatCancelMsg(index, begin, length int) *Message {
+	return Cancel{Index: index, Begin: begin, Length: length}.Marshal()
+}
+
+func FormatRejectMsg(index, begin, length int) *Message {
+	return RejectRequest{Index: index, Begin: begin, Length: length}.Marshal()
+}
+
+func FormatPieceMsg(index, begin int, block []byte) *Message {
+	return Piece{Index: index, Begin: begin, Block: block}.Marshal()
 }
 
 func FormatHaveMsg(index int) *Message {
-	payload := make([]byte, 4)
-	binary.BigEndian.PutUint32(payload, uint32(index))
-	return &Message{
-		ID:      MsgHave,
-		Payload: payload,
-	}
+	return Have{Index: index}.Marshal()
+}
+
+func FormatSuggestMsg(index int) *Message {
+	return SuggestPiece{Index: index}.Marshal()
+}
+
+func FormatAllowedFastMsg(index int) *Message {
+	return AllowedFast{Index: index}.Marshal()
+}
+
+// FormatPortMsg tells a peer the udp port of our dht node.
+func FormatPortMsg(port int) *Message {
+	return Port{Port: port}.Marshal()
+}
+
+// ParsePortMsg parses the dht node port of a port message: <port>
+func ParsePortMsg(msg *Message) (int, error) {
+	var m Port
+	err := m.Unmarshal(msg)
+	return m.Port, err
 }
 
+// ParseHaveMsg parses have, suggest piece and allowed fast messages as they
+// share the same payload: <index>
 func ParseHaveMsg(msg *Message) (int, error) {
-	if msg.ID != MsgHave {
-		log.WithFields(log.Fields{"got": msg.ID, "expected": MsgHave}).Debug(InvalidMessageId.Error())
-		return 0, InvalidMessageId
+	switch msg.ID {
+	case MsgSuggestPiece, MsgAllowedFast:
+		return unmarshalIndex(msg, msg.ID)
 	}
+	return unmarshalIndex(msg, MsgHave)
+}
 
-	if len(msg.Payload) != 4 {
-		log.WithFields(log.Fields{"got": len(msg.Payload), "expected": 4}).Debug(InvalidPayloadLength.Error())
-		return 0, InvalidPayloadLength
+// ParseRequestMsg parses request, cancel and reject request messages as they
+// share the same payload: <index><begin><length>
+func ParseRequestMsg(msg *Message) (index, begin, length int, err error) {
+	switch msg.ID {
+	case MsgCancel, MsgRejectRequest:
+		return unmarshalBlock(msg, msg.ID)
 	}
-
-	index := int(binary.BigEndian.Uint32(msg.Payload))
-	return index, nil
+	return unmarshalBlock(msg, MsgRequest)
 }
 
+// ParsePieceMsg copies the block of a piece message for the piece with
+// index into buf, returning the length of the block.
 func ParsePieceMsg(index int, buf []byte, msg *Message) (int, error) {
-	if msg.ID != MsgPiece {
-		log.WithFields(log.Fields{"got": msg.ID, "expected": MsgPiece}).Debug(InvalidMessageId.Error())
-		return 0, InvalidMessageId
-	}
-
-	if len(msg.Payload) < 8 {
-		log.WithFields(log.Fields{"got": len(msg.Payload), "expected": 8}).Debug(InvalidPayloadLength.Error())
-		return 0, InvalidPayloadLength
+	var m Piece
+	err := m.Unmarshal(msg)
+	if err != nil {
+		return 0, err
 	}
 
-	parsedIndex := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
-	if parsedIndex != index {
-		log.WithFields(log.Fields{"got": parsedIndex, "expected": index}).Debug(InvalidMessageIndex.Error())
+	if m.Index != index {
+		log.WithFields(log.Fields{"got": m.Index, "expected": index}).Debug(InvalidMessageIndex.Error())
 		return 0, InvalidMessageIndex
 	}
 
-	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
-	if begin >= len(buf) {
-		log.WithFields(log.Fields{"got": begin, "expected-over": len(buf)}).Debug(InvalidBufferLength.Error())
+	if m.Begin >= len(buf) {
+		log.WithFields(log.Fields{"got": m.Begin, "expected-over": len(buf)}).Debug(InvalidBufferLength.Error())
 		return 0, InvalidBufferLength
 	}
 
-	data := msg.Payload[8:]
-	if begin+len(data) > len(buf) {
-		log.WithFields(log.Fields{"got": begin + len(data), "expected-over": len(buf)}).Debug(InvalidDataLength.Error())
+	if m.Begin+len(m.Block) > len(buf) {
+		log.WithFields(log.Fields{"got": m.Begin + len(m.Block), "expected-over": len(buf)}).Debug(InvalidDataLength.Error())
 		return 0, InvalidDataLength
 	}
 
-	copy(buf[begin:], data)
-	return len(data), nil
+	copy(buf[m.Begin:], m.Block)
+	return len(m.Block), nil
 }
 
+// ParseBlockMsg parses a piece message for a block of any piece, the
+// returned block shares the payload of the message.
+func ParseBlockMsg(msg *Message) (index, begin int, block []byte, err error) {
+	var m Piece
+	err = m.Unmarshal(msg)
+	return m.Index, m.Begin, m.Block, err
+}
+
+// Serialize returns the frame of the message, a nil message is a keep-alive
+// frame of length zero.
 func (m *Message) Serialize() []byte {
 	if m == nil {
 		return make([]byte, 4)
@@ -118,6 +165,8 @@ func (m *Message) Serialize() []byte {
 	return buf
 }
 
+// ReadMessage reads the next message, keep-alive frames are returned as a
+// nil message.
 func ReadMessage(r io.Reader) (*Message, error) {
 	lengthBuf := make([]byte, 4)
 
@@ -128,10 +177,11 @@ func ReadMessage(r io.Reader) (*Message, error) {
 
 	length := binary.BigEndian.Uint32(lengthBuf)
 	if length == 0 {
-		return &Message{
-			ID:      MsgKeepAlive,
-			Payload: nil,
-		}, nil
+		return nil, nil
+	}
+	if length > MaxMessageLength {
+		log.WithFields(log.Fields{"got": length, "expected-max": MaxMessageLength}).Debug(InvalidPayloadLength.Error())
+		return nil, InvalidPayloadLength
 	}
 
 	msgBuf := make([]byte, length)
@@ -147,7 +197,7 @@ func ReadMessage(r io.Reader) (*Message, error) {
 }
 
 func (m *Message) name() string {
-	if m.Payload == nil {
+	if m == nil {
 		return "KeepAlive"
 	}
 	switch m.ID {
@@ -169,6 +219,20 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgPort:
+		return "Port"
+	case MsgSuggestPiece:
+		return "SuggestPiece"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgRejectRequest:
+		return "RejectRequest"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("!%d", m.ID)
 	}
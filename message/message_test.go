@@ -20,6 +20,84 @@ func TestFormatRequestMsg(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestFormatCancelMsg(t *testing.T) {
+	msg := FormatCancelMsg(4, 567, 4321)
+	expected := &Message{
+		ID: MsgCancel,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04,
+			0x00, 0x00, 0x02, 0x37,
+			0x00, 0x00, 0x10, 0xe1,
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestFormatPieceMsg(t *testing.T) {
+	msg := FormatPieceMsg(4, 567, []byte{0xaa, 0xbb, 0xcc})
+	expected := &Message{
+		ID: MsgPiece,
+		Payload: []byte{
+			0x00, 0x00, 0x00, 0x04,
+			0x00, 0x00, 0x02, 0x37,
+			0xaa, 0xbb, 0xcc,
+		},
+	}
+	assert.Equal(t, expected, msg)
+}
+
+func TestParseRequestMsg(t *testing.T) {
+	tests := map[string]struct {
+		input  *Message
+		index  int
+		begin  int
+		length int
+		fails  bool
+	}{
+		"correct input: request": {
+			input:  FormatRequestMsg(4, 567, 4321),
+			index:  4,
+			begin:  567,
+			length: 4321,
+			fails:  false,
+		},
+		"correct input: cancel": {
+			input:  FormatCancelMsg(1, 16384, 16384),
+			index:  1,
+			begin:  16384,
+			length: 16384,
+			fails:  false,
+		},
+		"correct input: reject": {
+			input:  FormatRejectMsg(2, 0, 16384),
+			index:  2,
+			begin:  0,
+			length: 16384,
+			fails:  false,
+		},
+		"invalid message type": {
+			input: &Message{ID: MsgHave, Payload: make([]byte, 12)},
+			fails: true,
+		},
+		"invalid payload length": {
+			input: &Message{ID: MsgRequest, Payload: make([]byte, 11)},
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		index, begin, length, err := ParseRequestMsg(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.index, index, name)
+		assert.Equal(t, test.begin, begin, name)
+		assert.Equal(t, test.length, length, name)
+	}
+}
+
 func TestFormatHaveMsg(t *testing.T) {
 	msg := FormatHaveMsg(1)
 	expected := &Message{
@@ -40,6 +118,16 @@ func TestParseHaveMsg(t *testing.T) {
 			output: 1,
 			fails:  false,
 		},
+		"correct input: suggest piece": {
+			input:  FormatSuggestMsg(7),
+			output: 7,
+			fails:  false,
+		},
+		"correct input: allowed fast": {
+			input:  FormatAllowedFastMsg(258),
+			output: 258,
+			fails:  false,
+		},
 		"invalid message type": {
 			input:  &Message{ID: MsgPiece, Payload: []byte{0x00, 0x00, 0x00, 0x01}},
 			output: 0,
@@ -68,6 +156,40 @@ func TestParseHaveMsg(t *testing.T) {
 	}
 }
 
+func TestParsePortMsg(t *testing.T) {
+	tests := map[string]struct {
+		input  *Message
+		output int
+		fails  bool
+	}{
+		"correct input": {
+			input:  FormatPortMsg(6881),
+			output: 6881,
+			fails:  false,
+		},
+		"invalid message type": {
+			input:  &Message{ID: MsgHave, Payload: []byte{0x1A, 0xE1}}, // <- fails here
+			output: 0,
+			fails:  true,
+		},
+		"invalid payload length": {
+			input:  &Message{ID: MsgPort, Payload: []byte{0x00, 0x1A, 0xE1}}, // <- fails here
+			output: 0,
+			fails:  true,
+		},
+	}
+
+	for name, test := range tests {
+		port, err := ParsePortMsg(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, port, name)
+	}
+}
+
 func TestParsePieceMsg(t *testing.T) {
 	tests := map[string]struct {
 		inputIndex int
@@ -189,7 +311,12 @@ func TestReadMessage(t *testing.T) {
 		},
 		"keep-alive message": {
 			input:  []byte{0, 0, 0, 0},
-			output: &Message{ID: MsgKeepAlive, Payload: nil},
+			output: nil,
+			fails:  false,
+		},
+		"port message": {
+			input:  []byte{0, 0, 0, 3, 9, 0x1A, 0xE1},
+			output: &Message{ID: MsgPort, Payload: []byte{0x1A, 0xE1}},
 			fails:  false,
 		},
 		"invalid length: too short": {
@@ -202,6 +329,11 @@ func TestReadMessage(t *testing.T) {
 			output: nil,
 			fails:  true,
 		},
+		"invalid length: above maximum": {
+			input:  []byte{0xFF, 0xFF, 0xFF, 0xFF, 4}, // <- fails here
+			output: nil,
+			fails:  true,
+		},
 	}
 
 	for _, test := range tests {
@@ -214,6 +346,10 @@ func TestReadMessage(t *testing.T) {
 		}
 		assert.Equal(t, test.output, m)
 	}
+
+	// the length prefix is checked before the frame is allocated
+	_, err := ReadMessage(bytes.NewReader([]byte{0xFF, 0xFF, 0xFF, 0xFF}))
+	assert.Equal(t, InvalidPayloadLength, err)
 }
 
 func TestString(t *testing.T) {
@@ -230,6 +366,14 @@ func TestString(t *testing.T) {
 		{&Message{MsgRequest, []byte{1, 2, 3}}, "Request: 3"},
 		{&Message{MsgPiece, []byte{1, 2, 3}}, "Piece: 3"},
 		{&Message{MsgCancel, []byte{1, 2, 3}}, "Cancel: 3"},
+		{&Message{MsgSuggestPiece, []byte{1, 2, 3}}, "SuggestPiece: 3"},
+		{&Message{MsgHaveAll, []byte{}}, "HaveAll: 0"},
+		{&Message{MsgHaveNone, nil}, "HaveNone: 0"},
+		{&Message{MsgPort, []byte{1, 2}}, "Port: 2"},
+		{nil, "KeepAlive"},
+		{&Message{MsgRejectRequest, []byte{1, 2, 3}}, "RejectRequest: 3"},
+		{&Message{MsgAllowedFast, []byte{1, 2, 3}}, "AllowedFast: 3"},
+		{&Message{MsgExtended, []byte{1, 2, 3}}, "Extended: 3"},
 		{&Message{10, []byte{1, 2, 3}}, "!10: 3"},
 	}
 
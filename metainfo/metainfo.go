@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"errors"
+	"net"
 	"os"
+	"strconv"
 
 	bencode "github.com/jackpal/bencode-go"
 	"github.com/mitander/bitrush/storage"
@@ -12,18 +14,23 @@ import (
 )
 
 type MetaInfo struct {
-	Announce    []string
+	// Announce holds the tracker tiers, tried in order
+	// [https://www.bittorrent.org/beps/bep_0012.html]
+	Announce    [][]string
 	InfoHash    [20]byte
 	PieceHashes [][20]byte
 	PieceLength int
 	Length      int
 	Name        string
 	Files       []storage.File
+	// Nodes are DHT nodes given by trackerless torrents, as host:port
+	// [https://www.bittorrent.org/beps/bep_0005.html#torrent-file-extensions]
+	Nodes []string
 }
 
 type bencodeTorrent struct {
 	Announce     string      `bencode:"announce"`
-	AnnounceList []string    `bencode:"announce-list"`
+	AnnounceList [][]string  `bencode:"announce-list"`
 	Info         bencodeInfo `bencode:"info"`
 }
 
@@ -41,21 +48,75 @@ type bencodeInfo struct {
 }
 
 func NewMetaInfo(path string) (*MetaInfo, error) {
-	file, err := os.Open(path)
+	b, err := os.ReadFile(path)
 	if err != nil {
 		log.WithFields(log.Fields{"reason": err.Error(), "path": path}).Error("failed to open file")
 		return nil, err
 
 	}
-	defer file.Close()
 
 	bt := bencodeTorrent{}
-	err = bencode.Unmarshal(file, &bt)
+	err = bencode.Unmarshal(bytes.NewReader(b), &bt)
 	if err != nil {
 		log.WithFields(log.Fields{"reason": err.Error(), "path": path}).Error("failed to unmarshal bencode from file")
 		return nil, err
 	}
-	return bt.toMetaInfo()
+
+	m, err := bt.toMetaInfo()
+	if err != nil {
+		return nil, err
+	}
+	m.Nodes = nodes(b)
+	return m, nil
+}
+
+// nodes returns the nodes key of a torrent file, its entries are lists of
+// host and port which only decode generically.
+func nodes(torrent []byte) []string {
+	v, err := bencode.Decode(bytes.NewReader(torrent))
+	if err != nil {
+		return nil
+	}
+	d, _ := v.(map[string]interface{})
+	list, _ := d["nodes"].([]interface{})
+
+	var nodes []string
+	for _, n := range list {
+		hp, ok := n.([]interface{})
+		if !ok || len(hp) != 2 {
+			continue
+		}
+		host, ok := hp[0].(string)
+		port, ok2 := hp[1].(int64)
+		if !ok || !ok2 || host == "" {
+			continue
+		}
+		nodes = append(nodes, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+	return nodes
+}
+
+// NewMetaInfoFromInfo creates meta info from a raw bencoded info dictionary,
+// as received from peers when starting from a magnet link.
+func NewMetaInfoFromInfo(info []byte, announce [][]string) (*MetaInfo, error) {
+	bi := bencodeInfo{}
+	err := bencode.Unmarshal(bytes.NewReader(info), &bi)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to unmarshal bencode info")
+		return nil, err
+	}
+
+	bt := bencodeTorrent{Info: bi}
+	m, err := bt.toMetaInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	// the info hash is the hash of the exact bytes, re-encoding the
+	// decoded info would drop keys we do not know about
+	m.InfoHash = sha1.Sum(info)
+	m.Announce = announce
+	return m, nil
 }
 
 func (bt *bencodeTorrent) toMetaInfo() (*MetaInfo, error) {
@@ -64,12 +125,7 @@ func (bt *bencodeTorrent) toMetaInfo() (*MetaInfo, error) {
 		return nil, err
 	}
 
-	var announce []string
-	if len(bt.AnnounceList) != 0 {
-		announce = append(announce, bt.AnnounceList...)
-	} else {
-		announce = append(bt.AnnounceList, bt.Announce)
-	}
+	announce := bt.tiers()
 
 	var length int
 	var files []storage.File
@@ -99,6 +155,33 @@ func (bt *bencodeTorrent) toMetaInfo() (*MetaInfo, error) {
 	return m, nil
 }
 
+// tiers returns the announce-list tiers without empty entries, the single
+// announce url is kept as a last tier if it is not part of any tier.
+func (bt *bencodeTorrent) tiers() [][]string {
+	var tiers [][]string
+	listed := false
+	for _, t := range bt.AnnounceList {
+		var tier []string
+		for _, announce := range t {
+			if announce == "" {
+				continue
+			}
+			if announce == bt.Announce {
+				listed = true
+			}
+			tier = append(tier, announce)
+		}
+		if len(tier) != 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+
+	if bt.Announce != "" && !listed {
+		tiers = append(tiers, []string{bt.Announce})
+	}
+	return tiers
+}
+
 func (bi *bencodeInfo) hash() ([20]byte, [][20]byte, error) {
 	pieces := []byte(bi.Pieces)
 	hashLen := 20
@@ -1,6 +1,7 @@
 package metainfo
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"os"
 	"testing"
@@ -51,7 +52,7 @@ func TestToMetaInfo(t *testing.T) {
 				},
 			},
 			output: &MetaInfo{
-				Announce: []string{"http://test.tracker.org:6969/announce"},
+				Announce: [][]string{{"http://test.tracker.org:6969/announce"}},
 				InfoHash: [20]byte{148, 102, 213, 85, 174, 246, 146, 126, 127, 246, 85, 15, 22, 6, 186, 128, 220, 105, 12, 15},
 				PieceHashes: [][20]byte{
 					{84, 48, 101, 49, 83, 50, 116, 51, 80, 52, 105, 53, 69, 54, 99, 55, 69, 56, 115, 57},
@@ -66,7 +67,7 @@ func TestToMetaInfo(t *testing.T) {
 		},
 		"correct input: announce-list": {
 			input: &bencodeTorrent{
-				AnnounceList: []string{"http://first.tracker.org:6969/announce", "http://second.tracker.org:6969/announce"},
+				AnnounceList: [][]string{{"http://first.tracker.org:6969/announce", "http://second.tracker.org:6969/announce"}, {"udp://backup.tracker.org:1337"}},
 				Info: bencodeInfo{
 					Pieces:      "T0e1S2t3P4i5E6c7E8s9T0e1S2t3P4i5E6c7E8s9",
 					PieceLength: 262144,
@@ -76,7 +77,33 @@ func TestToMetaInfo(t *testing.T) {
 				},
 			},
 			output: &MetaInfo{
-				Announce: []string{"http://first.tracker.org:6969/announce", "http://second.tracker.org:6969/announce"},
+				Announce: [][]string{{"http://first.tracker.org:6969/announce", "http://second.tracker.org:6969/announce"}, {"udp://backup.tracker.org:1337"}},
+				InfoHash: [20]byte{148, 102, 213, 85, 174, 246, 146, 126, 127, 246, 85, 15, 22, 6, 186, 128, 220, 105, 12, 15},
+				PieceHashes: [][20]byte{
+					{84, 48, 101, 49, 83, 50, 116, 51, 80, 52, 105, 53, 69, 54, 99, 55, 69, 56, 115, 57},
+					{84, 48, 101, 49, 83, 50, 116, 51, 80, 52, 105, 53, 69, 54, 99, 55, 69, 56, 115, 57},
+				},
+				PieceLength: 262144,
+				Length:      351272960,
+				Name:        "test.iso",
+				Files:       []storage.File{{Path: "test.iso", Length: 351272960}},
+			},
+			fails: false,
+		},
+		"correct input: announce and announce-list": {
+			input: &bencodeTorrent{
+				Announce:     "http://test.tracker.org:6969/announce",
+				AnnounceList: [][]string{{"http://first.tracker.org:6969/announce", ""}, {}},
+				Info: bencodeInfo{
+					Pieces:      "T0e1S2t3P4i5E6c7E8s9T0e1S2t3P4i5E6c7E8s9",
+					PieceLength: 262144,
+					Length:      351272960,
+					Name:        "test.iso",
+					Files:       []bencodeFile{},
+				},
+			},
+			output: &MetaInfo{
+				Announce: [][]string{{"http://first.tracker.org:6969/announce"}, {"http://test.tracker.org:6969/announce"}},
 				InfoHash: [20]byte{148, 102, 213, 85, 174, 246, 146, 126, 127, 246, 85, 15, 22, 6, 186, 128, 220, 105, 12, 15},
 				PieceHashes: [][20]byte{
 					{84, 48, 101, 49, 83, 50, 116, 51, 80, 52, 105, 53, 69, 54, 99, 55, 69, 56, 115, 57},
@@ -101,7 +128,7 @@ func TestToMetaInfo(t *testing.T) {
 				},
 			},
 			output: &MetaInfo{
-				Announce: []string{"http://test.tracker.org:6969/announce"},
+				Announce: [][]string{{"http://test.tracker.org:6969/announce"}},
 				InfoHash: [20]byte{181, 195, 58, 171, 46, 218, 137, 221, 88, 101, 209, 27, 104, 249, 234, 211, 106, 49, 4, 92},
 				PieceHashes: [][20]byte{
 					{84, 48, 101, 49, 83, 50, 116, 51, 80, 52, 105, 53, 69, 54, 99, 55, 69, 56, 115, 57},
@@ -140,3 +167,43 @@ func TestToMetaInfo(t *testing.T) {
 		assert.Equal(t, test.output, tf, name)
 	}
 }
+
+func TestNewMetaInfoFromInfo(t *testing.T) {
+	info := "d6:lengthi351272960e4:name8:test.iso12:piece lengthi262144e6:pieces40:T0e1S2t3P4i5E6c7E8s9T0e1S2t3P4i5E6c7E8s97:privatei0ee"
+	announce := [][]string{{"http://test.tracker.org:6969/announce"}}
+
+	m, err := NewMetaInfoFromInfo([]byte(info), announce)
+	require.Nil(t, err)
+	assert.Equal(t, sha1.Sum([]byte(info)), m.InfoHash)
+	assert.Equal(t, announce, m.Announce)
+	assert.Equal(t, 2, len(m.PieceHashes))
+	assert.Equal(t, 351272960, m.Length)
+	assert.Equal(t, []storage.File{{Path: "test.iso", Length: 351272960}}, m.Files)
+
+	_, err = NewMetaInfoFromInfo([]byte("d4:name"), announce)
+	assert.NotNil(t, err)
+}
+
+func TestNodes(t *testing.T) {
+	tests := map[string]struct {
+		input  string
+		output []string
+	}{
+		"nodes": {
+			input:  "d5:nodesll9:127.0.0.1i6881eel11:example.orgi1337eee4:infod4:name1:aee",
+			output: []string{"127.0.0.1:6881", "example.org:1337"},
+		},
+		"invalid entries": {
+			input:  "d5:nodesll9:127.0.0.1el0:i1el4:host3:porteee",
+			output: nil,
+		},
+		"no nodes": {
+			input:  "d8:announce4:test4:infod4:name1:aee",
+			output: nil,
+		},
+	}
+
+	for name, test := range tests {
+		assert.Equal(t, test.output, nodes([]byte(test.input)), name)
+	}
+}
@@ -0,0 +1,419 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Message Stream Encryption, also known as Protocol Encryption
+// [https://wiki.vuze.com/w/Message_Stream_Encryption]
+const (
+	// crypto_provide and crypto_select bits
+	methodPlaintext uint32 = 0x01
+	methodRC4       uint32 = 0x02
+
+	// Diffie-Hellman public keys are 768 bits
+	keyLen = 96
+	// padding sent after the public keys and in the crypto negotiation
+	maxPadLen = 512
+	// the first bytes of the RC4 keystream are discarded
+	rc4Discard = 1024
+	// time given to the whole handshake
+	handshakeTimeout = 5 * time.Second
+)
+
+var (
+	ErrPlaintext        error = errors.New("plaintext connection refused")
+	ErrEncrypted        error = errors.New("encrypted connection refused")
+	ErrNoCommonMethod   error = errors.New("no common crypto method")
+	ErrUnknownInfoHash  error = errors.New("unknown info hash")
+	errSyncNotFound     error = errors.New("mse sync pattern not found")
+	errInvalidPublicKey error = errors.New("invalid mse public key")
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	// verification constant
+	vc = make([]byte, 8)
+	// start of a plaintext handshake: <pstrlen><pstr>
+	plaintextHeader = []byte("\x13BitTorrent protocol")
+)
+
+// Policy decides which connections are encrypted.
+type Policy int
+
+const (
+	// Plaintext never encrypts and refuses encrypted connections
+	Plaintext Policy = iota
+	// PreferEncrypted encrypts when the peer supports it
+	PreferEncrypted
+	// RequireEncrypted refuses plaintext connections
+	RequireEncrypted
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Plaintext:
+		return "plaintext"
+	case PreferEncrypted:
+		return "prefer"
+	case RequireEncrypted:
+		return "require"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// ParsePolicy parses the name of a policy as returned by String.
+func ParsePolicy(s string) (Policy, error) {
+	for _, p := range []Policy{Plaintext, PreferEncrypted, RequireEncrypted} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return Plaintext, fmt.Errorf("unknown encryption policy %q", s)
+}
+
+// Conn is a connection after the encryption handshake, the data is
+// encrypted unless both sides selected plaintext.
+type Conn struct {
+	net.Conn
+	// Encrypted is set when the payload is RC4 encrypted
+	Encrypted bool
+	r         io.Reader
+	enc       cipher.Stream
+	mu        sync.Mutex
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+
+	// the keystream has to follow the order of the bytes on the wire
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+func newConn(conn net.Conn, r io.Reader, method uint32, enc, dec cipher.Stream) *Conn {
+	c := &Conn{Conn: conn, r: r}
+	if method == methodRC4 {
+		c.Encrypted = true
+		c.enc = enc
+		c.r = cipher.StreamReader{S: dec, R: r}
+	}
+	return c
+}
+
+// Initiate runs the handshake of an outbound connection for the torrent
+// with info hash skey. Plaintext is offered besides RC4 if the policy
+// prefers encryption, Initiate fails for the Plaintext policy.
+func Initiate(conn net.Conn, skey [20]byte, policy Policy) (*Conn, error) {
+	provide := methodRC4
+	switch policy {
+	case Plaintext:
+		return nil, ErrEncrypted
+	case PreferEncrypted:
+		provide |= methodPlaintext
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	r := bufio.NewReader(conn)
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	x, y, err := keyPair()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(y, pad()...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	yb := make([]byte, keyLen)
+	_, err = io.ReadFull(r, yb)
+	if err != nil {
+		return nil, err
+	}
+	s, err := secret(yb, x)
+	if err != nil {
+		return nil, err
+	}
+	enc := newCipher("keyA", s, skey[:])
+	dec := newCipher("keyB", s, skey[:])
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	buf := hash([]byte("req1"), s)
+	buf = append(buf, xor(hash([]byte("req2"), skey[:]), hash([]byte("req3"), s))...)
+	payload := append([]byte(nil), vc...)
+	payload = binary.BigEndian.AppendUint32(payload, provide)
+	// no padding and no initial payload
+	payload = binary.BigEndian.AppendUint16(payload, 0)
+	payload = binary.BigEndian.AppendUint16(payload, 0)
+	enc.XORKeyStream(payload, payload)
+	_, err = conn.Write(append(buf, payload...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD), the encrypted VC
+	// marks the end of PadB
+	encVC := make([]byte, len(vc))
+	newCipher("keyB", s, skey[:]).XORKeyStream(encVC, vc)
+	err = synchronize(r, encVC, maxPadLen+len(encVC))
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(encVC, encVC)
+
+	header := make([]byte, 6)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	method := binary.BigEndian.Uint32(header[:4])
+	padLen := int(binary.BigEndian.Uint16(header[4:]))
+	if padLen > maxPadLen {
+		return nil, errors.New("invalid mse padding length")
+	}
+	padD := make([]byte, padLen)
+	_, err = io.ReadFull(r, padD)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padD, padD)
+
+	if method&provide == 0 || (method != methodRC4 && method != methodPlaintext) {
+		log.WithFields(log.Fields{"provide": provide, "select": method}).Debug(ErrNoCommonMethod.Error())
+		return nil, ErrNoCommonMethod
+	}
+	return newConn(conn, r, method, enc, dec), nil
+}
+
+// Accept runs the handshake of an inbound connection for one of the
+// torrents with info hash in skeys. Plaintext connections are passed
+// through unless the policy requires encryption, the returned connection
+// starts with the BitTorrent handshake either way.
+func Accept(conn net.Conn, skeys [][20]byte, policy Policy) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	r := bufio.NewReader(conn)
+
+	head, err := r.Peek(len(plaintextHeader))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(head, plaintextHeader) {
+		if policy == RequireEncrypted {
+			return nil, ErrPlaintext
+		}
+		return newConn(conn, r, methodPlaintext, nil, nil), nil
+	}
+	if policy == Plaintext {
+		return nil, ErrEncrypted
+	}
+
+	// 1 A->B: Diffie Hellman Ya, PadA
+	ya := make([]byte, keyLen)
+	_, err = io.ReadFull(r, ya)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Diffie Hellman Yb, PadB
+	x, y, err := keyPair()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(y, pad()...))
+	if err != nil {
+		return nil, err
+	}
+	s, err := secret(ya, x)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3 A->B: HASH('req1', S) marks the end of PadA, followed by
+	// HASH('req2', SKEY) xor HASH('req3', S) identifying the torrent
+	err = synchronize(r, hash([]byte("req1"), s), maxPadLen+sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+	obfuscated := make([]byte, sha1.Size)
+	_, err = io.ReadFull(r, obfuscated)
+	if err != nil {
+		return nil, err
+	}
+	skey, ok := findSKey(xor(obfuscated, hash([]byte("req3"), s)), skeys)
+	if !ok {
+		return nil, ErrUnknownInfoHash
+	}
+	enc := newCipher("keyB", s, skey[:])
+	dec := newCipher("keyA", s, skey[:])
+
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	header := make([]byte, 14)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(header, header)
+	if !bytes.Equal(header[:8], vc) {
+		return nil, errors.New("invalid mse verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padLen := int(binary.BigEndian.Uint16(header[12:]))
+	if padLen > maxPadLen {
+		return nil, errors.New("invalid mse padding length")
+	}
+	padC := make([]byte, padLen+2)
+	_, err = io.ReadFull(r, padC)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padC, padC)
+	ia := make([]byte, binary.BigEndian.Uint16(padC[padLen:]))
+	_, err = io.ReadFull(r, ia)
+	if err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var method uint32
+	switch {
+	case provide&methodRC4 != 0:
+		method = methodRC4
+	case provide&methodPlaintext != 0 && policy != RequireEncrypted:
+		method = methodPlaintext
+	default:
+		log.WithFields(log.Fields{"provide": provide, "policy": policy}).Debug(ErrNoCommonMethod.Error())
+		return nil, ErrNoCommonMethod
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	payload := append([]byte(nil), vc...)
+	payload = binary.BigEndian.AppendUint32(payload, method)
+	payload = binary.BigEndian.AppendUint16(payload, 0)
+	enc.XORKeyStream(payload, payload)
+	_, err = conn.Write(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConn(conn, r, method, enc, dec)
+	// the initial payload is the start of the stream
+	c.r = io.MultiReader(bytes.NewReader(ia), c.r)
+	return c, nil
+}
+
+// keyPair returns a private key and the public key sent to the peer.
+func keyPair() (*big.Int, []byte, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(b)
+	y := new(big.Int).Exp(generator, x, prime)
+	return x, y.FillBytes(make([]byte, keyLen)), nil
+}
+
+// secret returns the shared secret S of the public key of the peer and our
+// private key.
+func secret(y []byte, x *big.Int) ([]byte, error) {
+	yi := new(big.Int).SetBytes(y)
+	pm1 := new(big.Int).Sub(prime, big.NewInt(1))
+	if yi.Cmp(big.NewInt(1)) <= 0 || yi.Cmp(pm1) >= 0 {
+		return nil, errInvalidPublicKey
+	}
+	s := new(big.Int).Exp(yi, x, prime)
+	return s.FillBytes(make([]byte, keyLen)), nil
+}
+
+// pad returns up to maxPadLen random bytes.
+func pad() []byte {
+	b := make([]byte, mrand.Intn(maxPadLen+1))
+	rand.Read(b)
+	return b
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	res := make([]byte, len(a))
+	for i := range a {
+		res[i] = a[i] ^ b[i]
+	}
+	return res
+}
+
+// newCipher returns the RC4 cipher of one direction, its key is
+// HASH(name, S, SKEY).
+func newCipher(name string, s, skey []byte) cipher.Stream {
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey))
+	discard := make([]byte, rc4Discard)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// synchronize reads from r until pattern was read, failing after limit
+// bytes.
+func synchronize(r io.ByteReader, pattern []byte, limit int) error {
+	var window []byte
+	for i := 0; i < limit; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if len(window) > len(pattern) {
+			window = window[1:]
+		}
+		if bytes.Equal(window, pattern) {
+			return nil
+		}
+	}
+	return errSyncNotFound
+}
+
+func findSKey(req2 []byte, skeys [][20]byte) ([20]byte, bool) {
+	for _, skey := range skeys {
+		if bytes.Equal(hash([]byte("req2"), skey[:]), req2) {
+			return skey, true
+		}
+	}
+	return [20]byte{}, false
+}
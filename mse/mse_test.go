@@ -0,0 +1,158 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tap records the bytes written to a connection.
+type tap struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (t *tap) Write(b []byte) (int, error) {
+	t.written.Write(b)
+	return t.Conn.Write(b)
+}
+
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	b, err := l.Accept()
+	require.Nil(t, err)
+	return a, b
+}
+
+func TestHandshake(t *testing.T) {
+	skey := [20]byte{0xAB}
+	tests := map[string]struct {
+		initiate Policy
+		accept   Policy
+		skeys    [][20]byte
+		fails    bool
+	}{
+		"prefer encrypted": {
+			initiate: PreferEncrypted,
+			accept:   PreferEncrypted,
+			skeys:    [][20]byte{{1}, skey},
+			fails:    false,
+		},
+		"require encrypted": {
+			initiate: RequireEncrypted,
+			accept:   PreferEncrypted,
+			skeys:    [][20]byte{skey},
+			fails:    false,
+		},
+		"accept requires encryption": {
+			initiate: PreferEncrypted,
+			accept:   RequireEncrypted,
+			skeys:    [][20]byte{skey},
+			fails:    false,
+		},
+		"accept refuses encryption": {
+			initiate: PreferEncrypted,
+			accept:   Plaintext, // <- fails here
+			skeys:    [][20]byte{skey},
+			fails:    true,
+		},
+		"unknown info hash": {
+			initiate: PreferEncrypted,
+			accept:   PreferEncrypted,
+			skeys:    [][20]byte{{1}}, // <- fails here
+			fails:    true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, b := connPair(t)
+			defer a.Close()
+			defer b.Close()
+			wa := &tap{Conn: a}
+
+			type result struct {
+				c   *Conn
+				err error
+			}
+			resC := make(chan result)
+			go func() {
+				c, err := Accept(b, test.skeys, test.accept)
+				if err != nil {
+					b.Close()
+				}
+				resC <- result{c, err}
+			}()
+
+			ca, err := Initiate(wa, skey, test.initiate)
+			res := <-resC
+			if test.fails {
+				assert.NotNil(t, res.err)
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			require.Nil(t, res.err)
+			// RC4 is selected whenever it is provided
+			assert.True(t, ca.Encrypted)
+			assert.True(t, res.c.Encrypted)
+
+			msg := []byte("\x13BitTorrent protocol")
+			_, err = ca.Write(msg)
+			require.Nil(t, err)
+			got := make([]byte, len(msg))
+			_, err = io.ReadFull(res.c, got)
+			require.Nil(t, err)
+			assert.Equal(t, msg, got)
+			assert.NotContains(t, wa.written.String(), string(msg))
+
+			_, err = res.c.Write([]byte("reply"))
+			require.Nil(t, err)
+			got = make([]byte, 5)
+			_, err = io.ReadFull(ca, got)
+			require.Nil(t, err)
+			assert.Equal(t, "reply", string(got))
+		})
+	}
+}
+
+func TestAcceptPlaintext(t *testing.T) {
+	handshake := append([]byte("\x13BitTorrent protocol"), make([]byte, 48)...)
+	for _, policy := range []Policy{Plaintext, PreferEncrypted, RequireEncrypted} {
+		a, b := connPair(t)
+		go a.Write(handshake)
+
+		c, err := Accept(b, nil, policy)
+		if policy == RequireEncrypted {
+			assert.Equal(t, ErrPlaintext, err)
+		} else {
+			require.Nil(t, err)
+			assert.False(t, c.Encrypted)
+			// the peeked bytes are still read
+			got := make([]byte, len(handshake))
+			_, err = io.ReadFull(c, got)
+			require.Nil(t, err)
+			assert.Equal(t, handshake, got)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{Plaintext, PreferEncrypted, RequireEncrypted} {
+		got, err := ParsePolicy(p.String())
+		assert.Nil(t, err)
+		assert.Equal(t, p, got)
+	}
+	_, err := ParsePolicy("rc4")
+	assert.NotNil(t, err)
+}
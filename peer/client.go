@@ -1,55 +1,291 @@
 package peer
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"net"
 	"time"
 
 	"github.com/mitander/bitrush/bitfield"
+	"github.com/mitander/bitrush/extension"
 	"github.com/mitander/bitrush/handshake"
 	"github.com/mitander/bitrush/message"
 	log "github.com/sirupsen/logrus"
 )
 
-const MaxBlockSize = 16384
-const MaxBacklog = 5
+// ClientVersion is sent as v in the extension handshake.
+const ClientVersion = "BitRush 0.0.1"
+
+// RequestQueueSize is the number of requests of a peer we queue, it is
+// advertised as reqq in the extension handshake.
+const RequestQueueSize = 250
+
+// MaxRequestLength is the largest block we serve in a single piece
+// message, requests for larger blocks are dropped.
+const MaxRequestLength = 131072
+
+// KeepAliveInterval is the idle time after which a keep-alive is sent,
+// peers drop connections silent for two minutes.
+const KeepAliveInterval = time.Minute
+
+// allowed fast and suggested pieces kept per peer
+const maxFastPieces = 32
+
+// BlockReader provides the data served to peers in piece messages.
+type BlockReader interface {
+	ReadBlock(index, begin, length int) ([]byte, error)
+}
+
+type request struct {
+	index  int
+	begin  int
+	length int
+}
 
 type Client struct {
-	Conn     net.Conn
-	Choked   bool
-	Bitfield bitfield.Bitfield
-	peer     Peer
-	infoHash [20]byte
-	peerID   [20]byte
+	Conn net.Conn
+	// ID is the peer id the remote peer sent in its handshake
+	ID      [20]byte
+	Choked  bool
+	Choking bool
+	// Interested is set while the peer wants to download from us
+	Interested bool
+	Bitfield   bitfield.Bitfield
+	Blocks     BlockReader
+	Uploaded   int
+	// OnHave is called when the peer announces a piece it did not have
+	OnHave func(index int)
+	// OnPort is called with the udp port of the dht node of the peer
+	OnPort func(port int)
+	// MaxRequests is the number of outstanding requests the peer accepts
+	// as advertised in its extension handshake, zero if unknown
+	MaxRequests int
+	// Fast is set when both sides support the fast extension
+	Fast bool
+	// AllowedFast are the pieces the peer lets us request while choked,
+	// Suggested are the pieces it suggests we download
+	AllowedFast []int
+	Suggested   []int
+	// Extensions is the extension protocol state, nil when the peer does
+	// not support the extension protocol
+	Extensions *extension.Session
+	pieces     int
+	peer       Peer
+	infoHash   [20]byte
+	peerID     [20]byte
+	requests   []request
+	lastSent   time.Time
+	err        error
 }
 
-func NewClient(peer Peer, peerID, infoHash [20]byte) (*Client, error) {
-	// should not take more than 3 seconds to establish connection
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+// NewClient connects to a peer of a torrent with the number of pieces, sends
+// the pieces in bf and waits for the pieces the peer has. The extensions of ext are offered when
+// the peer supports the extension protocol, ext may be nil. The connection
+// is made by the dialer.
+func NewClient(peer Peer, peerID, infoHash [20]byte, bf bitfield.Bitfield, pieces int, ext *extension.Registry, d *Dialer) (*Client, error) {
+	conn, err := d.Dial(peer, infoHash)
 	if err != nil {
 		return nil, err
 	}
 
 	hs := handshake.NewHandshake(infoHash, peerID)
-	_, err = hs.Send(conn)
+	hs.EnableExtensions()
+	hs.EnableFast()
+	res, err := hs.Send(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if peer.ID != [20]byte{} && res.PeerID != peer.ID {
+		conn.Close()
+		err := errors.New("peer id does not match tracker")
+		log.WithFields(log.Fields{"got": res.PeerID, "expected": peer.ID}).Error(err.Error())
+		return nil, err
+	}
+
+	c := &Client{
+		Conn:     conn,
+		Choked:   true,
+		Choking:  true,
+		ID:       res.PeerID,
+		Fast:     res.SupportsFast(),
+		pieces:   pieces,
+		peer:     peer,
+		infoHash: infoHash,
+		peerID:   peerID,
+	}
+
+	// the bitfield comes first, the extension handshake after it
+	err = c.SendBitfield(bf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if res.SupportsExtensions() {
+		err = c.sendExtensionHandshake(ext)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	c.Bitfield, err = c.recvBitfield()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// AcceptClient completes an inbound connection whose handshake has already
+// been read into remote. It replies with our handshake and bitfield of the
+// torrent with the number of pieces and then waits for the pieces the remote
+// peer has. The extensions of ext are offered as in NewClient.
+func AcceptClient(conn net.Conn, remote *handshake.Handshake, peerID, infoHash [20]byte, bf bitfield.Bitfield, pieces int, ext *extension.Registry) (*Client, error) {
+	peer, err := FromAddr(conn.RemoteAddr())
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	bf, err := bitfield.RecvBitfield(conn)
+	hs := handshake.NewHandshake(infoHash, peerID)
+	hs.EnableExtensions()
+	hs.EnableFast()
+	err = hs.Reply(conn)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
-	return &Client{
+	c := &Client{
 		Conn:     conn,
 		Choked:   true,
-		Bitfield: bf,
+		Choking:  true,
+		ID:       remote.PeerID,
+		Fast:     remote.SupportsFast(),
+		pieces:   pieces,
 		peer:     peer,
 		infoHash: infoHash,
 		peerID:   peerID,
-	}, nil
+	}
+
+	err = c.SendBitfield(bf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if remote.SupportsExtensions() {
+		err = c.sendExtensionHandshake(ext)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	c.Bitfield, err = c.recvBitfield()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// countReader counts the bytes read through it.
+type countReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
+
+// sendExtensionHandshake starts the extension protocol session of the
+// connection with our extension handshake.
+func (c *Client) sendExtensionHandshake(ext *extension.Registry) error {
+	if ext == nil {
+		ext = extension.NewRegistry()
+	}
+	c.Extensions = ext.NewSession(c.peer.String(), c.send)
+	return c.Extensions.SendHandshake(extension.Handshake{
+		V:      ClientVersion,
+		Reqq:   RequestQueueSize,
+		YourIP: extension.CompactIP(c.peer.IP),
+	})
+}
+
+// recvBitfield waits for the pieces the peer has, some clients send their
+// extension handshake first. Without the fast extension peers with no pieces
+// may send no bitfield at all, with it they send have all or have none.
+func (c *Client) recvBitfield() (bitfield.Bitfield, error) {
+	// set deadline to fail instead of blocking after 5 seconds
+	c.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	for {
+		r := &countReader{r: c.Conn}
+		msg, err := message.ReadMessage(r)
+		if err != nil {
+			// a frame cut off by the deadline leaves the stream unusable
+			var netErr net.Error
+			if !c.Fast && r.n == 0 && errors.As(err, &netErr) && netErr.Timeout() {
+				return bitfield.New(c.pieces), nil
+			}
+			return nil, err
+		}
+
+		m, err := message.Parse(msg)
+		if err != nil && !errors.Is(err, message.UnknownMessageId) {
+			return nil, err
+		}
+
+		switch m := m.(type) {
+		case *message.Extended:
+			err = c.HandleMessage(msg)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case *message.Bitfield:
+			// [https://www.bittorrent.org/beps/bep_0003.html#peer-messages]
+			bf := bitfield.Bitfield(m.Bitfield)
+			if !bf.Valid(c.pieces) {
+				return nil, errors.New("invalid bitfield received: wrong length or spare bits set")
+			}
+			return bf, nil
+		case *message.HaveAll:
+			if c.Fast {
+				return bitfield.Full(c.pieces), nil
+			}
+		case *message.HaveNone:
+			if c.Fast {
+				return bitfield.New(c.pieces), nil
+			}
+		}
+		if c.Fast {
+			return nil, errors.New("invalid bitfield received: wrong id")
+		}
+
+		// no bitfield, the message is part of the regular exchange
+		c.Bitfield = bitfield.New(c.pieces)
+		err = c.HandleMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		return c.Bitfield, nil
+	}
+}
+
+// Peer returns the remote peer of the connection.
+func (c *Client) Peer() Peer {
+	return c.peer
 }
 
 func (c *Client) SendRequest(index, begin, length int) error {
@@ -60,16 +296,77 @@ func (c *Client) SendHave(index int) error {
 	return c.send(message.FormatHaveMsg(index))
 }
 
+// SendBitfield sends the pieces we have, as have all or have none when
+// possible with the fast extension.
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	if c.Fast {
+		switch {
+		case bytes.Equal(bf, bitfield.Full(c.pieces)):
+			return c.send(message.HaveAll{}.Marshal())
+		case bytes.Equal(bf, bitfield.New(c.pieces)):
+			return c.send(message.HaveNone{}.Marshal())
+		}
+	}
+	return c.send(message.Bitfield{Bitfield: bf}.Marshal())
+}
+
 func (c *Client) SendInterested() error {
-	return c.send(&message.Message{ID: message.MsgInterested})
+	return c.send(message.Interested{}.Marshal())
 }
 
 func (c *Client) SendNotInterested() error {
-	return c.send(&message.Message{ID: message.MsgNotInterested})
+	return c.send(message.NotInterested{}.Marshal())
 }
 
 func (c *Client) SendUnchoke() error {
-	return c.send(&(message.Message{ID: message.MsgUnchoke}))
+	c.Choking = false
+	return c.send(message.Unchoke{}.Marshal())
+}
+
+func (c *Client) SendChoke() error {
+	c.Choking = true
+	err := c.send(message.Choke{}.Marshal())
+	if err != nil {
+		return err
+	}
+
+	// choking discards all pending requests from the peer, with the fast
+	// extension each of them is rejected
+	requests := c.requests
+	c.requests = nil
+	for _, r := range requests {
+		err = c.reject(r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) SendCancel(index, begin, length int) error {
+	return c.send(message.FormatCancelMsg(index, begin, length))
+}
+
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	return c.send(message.FormatPieceMsg(index, begin, block))
+}
+
+// reject tells a peer with the fast extension that its request is dropped,
+// without it dropped requests are not answered.
+func (c *Client) reject(r request) error {
+	if !c.Fast {
+		return nil
+	}
+	return c.send(message.FormatRejectMsg(r.index, r.begin, r.length))
+}
+
+// KeepAlive sends a keep-alive when nothing was sent to the peer for
+// KeepAliveInterval.
+func (c *Client) KeepAlive() error {
+	if time.Since(c.lastSent) < KeepAliveInterval {
+		return nil
+	}
+	return c.send(nil)
 }
 
 func (c *Client) send(msg *message.Message) error {
@@ -78,79 +375,171 @@ func (c *Client) send(msg *message.Message) error {
 		log.WithFields(log.Fields{"reason": err.Error(), "message": msg.String()}).Error("failed to send message")
 		return err
 	}
+	c.lastSent = time.Now()
 	return nil
 }
 
-func (c *Client) DownloadPiece(index int, length int) ([]byte, error) {
-	// 30 seconds deadline to download piece (262kb)
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{})
+// Recv starts reading messages from the peer in the background until ctx is
+// done. The channel is closed when reading fails, the reason is returned by
+// Err afterwards. Closing the connection stops a blocked read.
+func (c *Client) Recv(ctx context.Context) <-chan *message.Message {
+	msgC := make(chan *message.Message)
+	go func() {
+		defer close(msgC)
+		for {
+			msg, err := message.ReadMessage(c.Conn)
+			if err != nil {
+				c.err = err
+				return
+			}
+			select {
+			case msgC <- msg:
+			case <-ctx.Done():
+				c.err = ctx.Err()
+				return
+			}
+		}
+	}()
+	return msgC
+}
 
-	state := pieceState{
-		index:  index,
-		client: c,
-		buf:    make([]byte, length),
-	}
-
-	for state.downloaded < length {
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < length {
-				blockSize := MaxBlockSize
-				if length-state.requested < blockSize {
-					blockSize = length - state.requested
-				}
-
-				err := c.SendRequest(index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
+// Err returns why the channel returned by Recv was closed.
+func (c *Client) Err() error {
+	return c.err
+}
+
+// HandleMessage updates the connection state from a message of the peer and
+// queues its requests, piece and reject request messages are left to the
+// caller.
+func (c *Client) HandleMessage(msg *message.Message) error {
+	m, err := message.Parse(msg)
+	if errors.Is(err, message.UnknownMessageId) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch m := m.(type) {
+	case nil:
+		// keep alive
+	case *message.Unchoke:
+		c.Choked = false
+	case *message.Choke:
+		c.Choked = true
+	case *message.Interested:
+		c.Interested = true
+	case *message.NotInterested:
+		c.Interested = false
+	case *message.Have:
+		// spare bits of the bitfield are no pieces
+		if m.Index < 0 || m.Index >= c.pieces {
+			return message.InvalidMessageIndex
+		}
+		if c.Bitfield.HasPiece(m.Index) {
+			return nil
+		}
+		c.Bitfield.SetPiece(m.Index)
+		if c.OnHave != nil && c.Bitfield.HasPiece(m.Index) {
+			c.OnHave(m.Index)
+		}
+	case *message.Request:
+		r := request{m.Index, m.Begin, m.Length}
+		if c.Choking || c.Blocks == nil {
+			log.WithFields(log.Fields{"peer": c.peer.String(), "index": m.Index}).Debug("dropping request: peer is choked")
+			return c.reject(r)
+		}
+		if m.Length > MaxRequestLength {
+			log.WithFields(log.Fields{"peer": c.peer.String(), "length": m.Length}).Debug("dropping request: block too large")
+			return c.reject(r)
+		}
+		if len(c.requests) >= RequestQueueSize {
+			log.WithFields(log.Fields{"peer": c.peer.String(), "index": m.Index}).Debug("dropping request: queue is full")
+			return c.reject(r)
+		}
+		c.requests = append(c.requests, r)
+	case *message.Cancel:
+		for i, r := range c.requests {
+			if r == (request{m.Index, m.Begin, m.Length}) {
+				c.requests = append(c.requests[:i], c.requests[i+1:]...)
+				break
 			}
 		}
-		err := state.readMessage()
-		if err != nil {
-			return nil, err
+	case *message.SuggestPiece:
+		if c.Fast && m.Index >= 0 && m.Index < c.pieces {
+			c.Suggested = addPiece(c.Suggested, m.Index)
+		}
+	case *message.AllowedFast:
+		if c.Fast && m.Index >= 0 && m.Index < c.pieces {
+			c.AllowedFast = addPiece(c.AllowedFast, m.Index)
+		}
+	case *message.Port:
+		if c.OnPort != nil && m.Port != 0 {
+			c.OnPort(m.Port)
 		}
+	case *message.Extended:
+		c.handleExtended(msg)
 	}
-	return state.buf, nil
+	return nil
 }
 
-type pieceState struct {
-	index      int
-	client     *Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+// addPiece adds a piece to a list of at most maxFastPieces, dropping the
+// oldest piece when full.
+func addPiece(pieces []int, index int) []int {
+	for _, p := range pieces {
+		if p == index {
+			return pieces
+		}
+	}
+	if len(pieces) == maxFastPieces {
+		pieces = pieces[1:]
+	}
+	return append(pieces, index)
 }
 
-func (s *pieceState) readMessage() error {
-	msg, err := message.ReadMessage(s.client.Conn)
+// handleExtended passes an extended message to the extension session and
+// records the request queue size from the extension handshake of the peer.
+func (c *Client) handleExtended(msg *message.Message) {
+	if c.Extensions == nil {
+		return
+	}
+
+	err := c.Extensions.Handle(msg)
 	if err != nil {
-		return err
+		log.WithFields(log.Fields{"reason": err.Error(), "peer": c.peer.String()}).Debug("failed to handle extended message")
+		return
+	}
+
+	id, _, _ := extension.ParseMsg(msg)
+	if id != extension.HandshakeID {
+		return
 	}
+	if h := c.Extensions.Remote(); h != nil && h.Reqq > 0 {
+		c.MaxRequests = h.Reqq
+	}
+}
 
-	switch msg.ID {
-	case message.MsgKeepAlive:
-		break
-	case message.MsgUnchoke:
-		s.client.Choked = false
-	case message.MsgChoke:
-		s.client.Choked = true
-	case message.MsgHave:
-		i, err := message.ParseHaveMsg(msg)
+// ServeRequests answers the queued requests of the peer.
+func (c *Client) ServeRequests() error {
+	for len(c.requests) > 0 {
+		r := c.requests[0]
+		c.requests = c.requests[1:]
+
+		block, err := c.Blocks.ReadBlock(r.index, r.begin, r.length)
 		if err != nil {
-			return err
+			log.WithFields(log.Fields{"reason": err.Error(), "peer": c.peer.String(), "index": r.index}).Debug("failed to serve request")
+			err = c.reject(r)
+			if err != nil {
+				return err
+			}
+			continue
 		}
-		s.client.Bitfield.SetPiece(i)
-	case message.MsgPiece:
-		n, err := message.ParsePieceMsg(s.index, s.buf, msg)
+
+		err = c.SendPiece(r.index, r.begin, block)
 		if err != nil {
 			return err
 		}
-		s.downloaded += n
-		s.backlog--
+		c.Uploaded += len(block)
 	}
 	return nil
 }
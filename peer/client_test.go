@@ -1,14 +1,19 @@
 package peer
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"net"
 	"sync"
 	"testing"
 
 	"github.com/mitander/bitrush/bitfield"
+	"github.com/mitander/bitrush/extension"
+	"github.com/mitander/bitrush/handshake"
 	"github.com/mitander/bitrush/message"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewClient(t *testing.T) {
@@ -16,12 +21,14 @@ func TestNewClient(t *testing.T) {
 		peer   Peer
 		id     message.MessageID
 		msgLen int
+		output bitfield.Bitfield
 		fails  bool
 	}{
 		"correct input": {
 			peer:   Peer{IP: net.IP{127, 0, 0, 1}, Port: 1442},
 			id:     message.MsgBitfield, // <- when creating client first msg should be bitfield
 			msgLen: 3,
+			output: bitfield.Bitfield{0b11111111, 0b11111111},
 			fails:  false,
 		},
 		"invalid message id": {
@@ -30,10 +37,17 @@ func TestNewClient(t *testing.T) {
 			msgLen: 3,
 			fails:  true,
 		},
-		"invalid message length": {
+		"no bitfield": {
 			peer:   Peer{IP: net.IP{127, 0, 0, 1}, Port: 1442},
 			id:     message.MsgBitfield,
-			msgLen: 0, // <- fails here, len 0 is keep alive
+			msgLen: 0, // <- len 0 is keep alive, peer has no pieces
+			output: bitfield.Bitfield{0b00000000, 0b00000000},
+			fails:  false,
+		},
+		"peer id mismatch": {
+			peer:   Peer{IP: net.IP{127, 0, 0, 1}, Port: 1442, ID: [20]byte{1}}, // <- fails here, handshake peer id is zero
+			id:     message.MsgBitfield,
+			msgLen: 3,
 			fails:  true,
 		},
 	}
@@ -43,25 +57,26 @@ func TestNewClient(t *testing.T) {
 		id := make([]byte, 20)
 		bitfield := bitfield.Bitfield{0b11111111, 0b11111111}
 
+		// listen before the client dials
+		l, err := net.Listen("tcp4", test.peer.String())
+		assert.Nil(t, err, name)
+
 		// sync test with listener
 		var wg sync.WaitGroup
 		wg.Add(1)
 
 		go func() {
-			client, err := NewClient(test.peer, [20]byte(hash), [20]byte(id))
+			client, err := NewClient(test.peer, [20]byte(hash), [20]byte(id), make([]byte, 2), 16, nil, &Dialer{})
 			if test.fails {
 				assert.Error(t, err, name)
 
 			} else {
 				assert.Nil(t, err, name)
-				assert.Equal(t, bitfield, client.Bitfield)
+				assert.Equal(t, test.output, client.Bitfield, name)
 			}
 			wg.Done()
 		}()
 
-		// listen to connection
-		l, err := net.Listen("tcp4", test.peer.String())
-		assert.Nil(t, err, name)
 		c, err := l.Accept()
 		assert.Nil(t, err, name)
 
@@ -90,3 +105,276 @@ func TestNewClient(t *testing.T) {
 		l.Close()
 	}
 }
+
+func TestAcceptClientOrder(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	remote, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	defer remote.Close()
+	local, err := l.Accept()
+	require.Nil(t, err)
+	hs := handshake.NewHandshake([20]byte{1}, [20]byte{2})
+	hs.EnableExtensions()
+	hs.EnableFast()
+
+	done := make(chan error)
+	go func() {
+		_, err := AcceptClient(local, hs, [20]byte{3}, [20]byte{1}, bitfield.Full(3), 3, extension.NewRegistry())
+		done <- err
+	}()
+
+	_, err = handshake.ReadHandshake(remote)
+	require.Nil(t, err)
+
+	// the bitfield class message comes before the extension handshake
+	msg, err := message.ReadMessage(remote)
+	require.Nil(t, err)
+	assert.Equal(t, message.MsgHaveAll, msg.ID)
+	msg, err = message.ReadMessage(remote)
+	require.Nil(t, err)
+	assert.Equal(t, message.MsgExtended, msg.ID)
+
+	remote.Write(message.HaveNone{}.Marshal().Serialize())
+	assert.Nil(t, <-done)
+}
+
+type testBlocks []byte
+
+func (b testBlocks) ReadBlock(index, begin, length int) ([]byte, error) {
+	return b[begin : begin+length], nil
+}
+
+func TestServeRequests(t *testing.T) {
+	local, remote := net.Pipe()
+	blocks := testBlocks{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	c := &Client{Conn: local, Choking: false, Blocks: blocks}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		for msg := range c.Recv(ctx) {
+			err := c.HandleMessage(msg)
+			if err == nil {
+				err = c.ServeRequests()
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- c.Err()
+	}()
+
+	// oversized request is dropped, next request is served
+	remote.Write(message.FormatRequestMsg(0, 0, MaxRequestLength+1).Serialize())
+	remote.Write(message.FormatRequestMsg(0, 2, 3).Serialize())
+
+	msg, err := message.ReadMessage(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, message.FormatPieceMsg(0, 2, []byte{0xcc, 0xdd, 0xee}), msg)
+
+	remote.Close()
+	assert.Error(t, <-done)
+	assert.Equal(t, 3, c.Uploaded)
+}
+
+func TestRecv(t *testing.T) {
+	local, remote := net.Pipe()
+
+	var have, ports []int
+	c := &Client{Conn: local, Bitfield: bitfield.Bitfield{0b10000000}, pieces: 3, OnHave: func(index int) {
+		have = append(have, index)
+	}, OnPort: func(port int) {
+		ports = append(ports, port)
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgC := c.Recv(ctx)
+
+	// new piece is reported, known piece is not
+	go func() {
+		remote.Write(message.FormatHaveMsg(2).Serialize())
+		remote.Write(message.FormatHaveMsg(0).Serialize())
+		// keep-alive is not mistaken for a port message
+		remote.Write((*message.Message)(nil).Serialize())
+		remote.Write(message.FormatPortMsg(6881).Serialize())
+		remote.Write(message.FormatPieceMsg(2, 0, []byte{1, 2}).Serialize())
+		remote.Close()
+	}()
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, c.HandleMessage(<-msgC))
+	}
+	assert.Equal(t, []int{2}, have)
+	assert.True(t, c.Bitfield.HasPiece(2))
+	assert.Equal(t, []int{6881}, ports)
+
+	// piece messages are left to the caller
+	msg := <-msgC
+	assert.Equal(t, message.MsgPiece, msg.ID)
+
+	_, ok := <-msgC
+	assert.False(t, ok)
+	assert.Error(t, c.Err())
+
+	// have for a spare bit of the bitfield fails the connection
+	assert.ErrorIs(t, c.HandleMessage(message.FormatHaveMsg(3)), message.InvalidMessageIndex)
+	assert.Equal(t, bitfield.Bitfield{0b10100000}, c.Bitfield)
+	assert.Equal(t, []int{2}, have)
+}
+
+func TestKeepAlive(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	c := &Client{Conn: local}
+
+	// idle since the connection was made
+	done := make(chan struct{})
+	go func() {
+		assert.Nil(t, c.KeepAlive())
+		assert.Nil(t, c.SendInterested())
+		close(done)
+	}()
+	msg, err := message.ReadMessage(remote)
+	assert.Nil(t, err)
+	assert.Nil(t, msg)
+	msg, err = message.ReadMessage(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, message.MsgInterested, msg.ID)
+	<-done
+
+	// nothing is sent right after a message
+	assert.Nil(t, c.KeepAlive())
+}
+
+func TestRecvBitfield(t *testing.T) {
+	ext, _ := extension.FormatHandshakeMsg(&extension.Handshake{M: map[string]int{}, Reqq: 500})
+	tests := map[string]struct {
+		fast   bool
+		msgs   []*message.Message
+		output bitfield.Bitfield
+		reqq   int
+		fails  bool
+	}{
+		"extension handshake first": {
+			msgs:   []*message.Message{ext, {ID: message.MsgBitfield, Payload: []byte{0b10100000}}},
+			output: bitfield.Bitfield{0b10100000},
+			reqq:   500,
+		},
+		"short bitfield": {
+			msgs:  []*message.Message{{ID: message.MsgBitfield, Payload: []byte{}}}, // <- fails here
+			fails: true,
+		},
+		"padded bitfield": {
+			msgs:  []*message.Message{{ID: message.MsgBitfield, Payload: []byte{0b10100000, 0}}}, // <- fails here
+			fails: true,
+		},
+		"spare bits set": {
+			msgs:  []*message.Message{{ID: message.MsgBitfield, Payload: []byte{0b10100001}}}, // <- fails here
+			fails: true,
+		},
+		"have all": {
+			fast:   true,
+			msgs:   []*message.Message{{ID: message.MsgHaveAll}},
+			output: bitfield.Bitfield{0b11100000}, // <- spare bits stay cleared
+		},
+		"have none": {
+			fast:   true,
+			msgs:   []*message.Message{{ID: message.MsgHaveNone}},
+			output: bitfield.Bitfield{0b00000000},
+		},
+		"have all without fast extension": {
+			msgs:   []*message.Message{{ID: message.MsgHaveAll}}, // <- ignored, peer has no pieces
+			output: bitfield.Bitfield{0b00000000},
+		},
+		"no bitfield": {
+			msgs:   []*message.Message{{ID: message.MsgUnchoke, Payload: []byte{}}},
+			output: bitfield.Bitfield{0b00000000},
+		},
+		"no bitfield with fast extension": {
+			fast:  true,
+			msgs:  []*message.Message{{ID: message.MsgUnchoke, Payload: []byte{}}}, // <- fails here
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		local, remote := net.Pipe()
+		c := &Client{Conn: local, Fast: test.fast, pieces: 3}
+		c.Extensions = extension.NewRegistry().NewSession("", c.send)
+
+		go func() {
+			for _, msg := range test.msgs {
+				remote.Write(msg.Serialize())
+			}
+		}()
+
+		bf, err := c.recvBitfield()
+		if test.fails {
+			assert.Error(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.output, bf, name)
+			assert.Equal(t, test.reqq, c.MaxRequests, name)
+		}
+		remote.Close()
+	}
+}
+
+func TestRecvBitfieldPartialFrame(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	c := &Client{Conn: local, pieces: 3}
+
+	// deadline passes in the middle of the bitfield frame
+	go remote.Write([]byte{0, 0, 0, 2, byte(message.MsgBitfield)})
+
+	_, err := c.recvBitfield() // <- fails here
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr))
+	assert.True(t, netErr.Timeout())
+}
+
+func TestFast(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	blocks := testBlocks{0xaa, 0xbb, 0xcc, 0xdd}
+	c := &Client{Conn: local, Fast: true, Choking: true, Blocks: blocks, Bitfield: bitfield.Bitfield{0b00000000}, pieces: 6}
+
+	go func() {
+		// requests while choked are rejected
+		c.HandleMessage(message.FormatRequestMsg(0, 0, 2))
+		c.SendUnchoke()
+		c.HandleMessage(message.FormatRequestMsg(0, 2, 2))
+		// choking rejects the queued request
+		c.SendChoke()
+	}()
+
+	expected := []*message.Message{
+		message.FormatRejectMsg(0, 0, 2),
+		{ID: message.MsgUnchoke, Payload: []byte{}},
+		{ID: message.MsgChoke, Payload: []byte{}},
+		message.FormatRejectMsg(0, 2, 2),
+	}
+	for _, e := range expected {
+		msg, err := message.ReadMessage(remote)
+		assert.Nil(t, err)
+		assert.Equal(t, e, msg)
+	}
+
+	// suggested and allowed fast pieces are recorded once
+	for _, msg := range []*message.Message{
+		message.FormatSuggestMsg(3),
+		message.FormatSuggestMsg(3),
+		message.FormatAllowedFastMsg(5),
+		message.FormatAllowedFastMsg(6), // <- spare bit of the bitfield
+		message.FormatAllowedFastMsg(8), // <- out of range
+	} {
+		assert.Nil(t, c.HandleMessage(msg))
+	}
+	assert.Equal(t, []int{3}, c.Suggested)
+	assert.Equal(t, []int{5}, c.AllowedFast)
+}
@@ -0,0 +1,64 @@
+package peer
+
+import (
+	"net"
+	"time"
+
+	"github.com/mitander/bitrush/mse"
+	"github.com/mitander/bitrush/utp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// should not take more than 3 seconds to establish connection
+	dialTimeout = 3 * time.Second
+	// peers without uTP do not answer, fall back to TCP quickly
+	utpDialTimeout = 2 * time.Second
+)
+
+// Dialer connects to peers. With a uTP socket peers are dialed over uTP
+// first and over TCP if they do not answer.
+type Dialer struct {
+	// Encryption is the policy of outbound connections
+	Encryption mse.Policy
+	// UTP is the socket uTP connections are made from, nil disables uTP
+	UTP *utp.Socket
+}
+
+// Dial connects to the peer for the torrent with infoHash, encrypting the
+// connection as the policy asks. A peer failing the encryption handshake
+// is dialed again in plaintext unless the policy requires encryption.
+func (d *Dialer) Dial(p Peer, infoHash [20]byte) (net.Conn, error) {
+	conn, err := d.dial(p)
+	if err != nil || d.Encryption == mse.Plaintext {
+		return conn, err
+	}
+
+	ec, err := mse.Initiate(conn, infoHash, d.Encryption)
+	if err == nil {
+		return ec, nil
+	}
+	conn.Close()
+	if d.Encryption == mse.RequireEncrypted {
+		log.WithFields(log.Fields{"reason": err.Error(), "peer": p.String()}).Debug("encryption handshake failed")
+		return nil, err
+	}
+
+	// the peer is known to answer on the transport that just worked
+	log.WithFields(log.Fields{"reason": err.Error(), "peer": p.String()}).Debug("encryption handshake failed, retrying in plaintext")
+	if conn.RemoteAddr().Network() == "udp" {
+		return d.UTP.DialTimeout(p.String(), utpDialTimeout)
+	}
+	return net.DialTimeout("tcp", p.String(), dialTimeout)
+}
+
+func (d *Dialer) dial(p Peer) (net.Conn, error) {
+	if d.UTP != nil {
+		conn, err := d.UTP.DialTimeout(p.String(), utpDialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+		log.WithFields(log.Fields{"reason": err.Error(), "peer": p.String()}).Debug("utp dial failed, falling back to tcp")
+	}
+	return net.DialTimeout("tcp", p.String(), dialTimeout)
+}
@@ -0,0 +1,165 @@
+package peer
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/mitander/bitrush/mse"
+	"github.com/mitander/bitrush/utp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// servePlaintext stands in for a peer without encryption support, it
+// drops connections not starting with a handshake and echoes the others.
+func servePlaintext(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			b := make([]byte, 1)
+			if _, err := io.ReadFull(conn, b); err != nil || b[0] != 19 {
+				return
+			}
+			conn.Write(b)
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// serveEncrypted stands in for a peer requiring encryption, it echoes
+// what it reads.
+func serveEncrypted(l net.Listener, infoHash [20]byte) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			ec, err := mse.Accept(conn, [][20]byte{infoHash}, mse.RequireEncrypted)
+			if err != nil {
+				return
+			}
+			io.Copy(ec, ec)
+		}()
+	}
+}
+
+func TestDial(t *testing.T) {
+	infoHash := [20]byte{0xAB}
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer plain.Close()
+	go servePlaintext(plain)
+	encrypted, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer encrypted.Close()
+	go serveEncrypted(encrypted, infoHash)
+	s, err := utp.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer s.Close()
+	go serveEncrypted(s, infoHash)
+	plainUTP, err := utp.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer plainUTP.Close()
+	go servePlaintext(plainUTP)
+	local, err := utp.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer local.Close()
+
+	tests := map[string]struct {
+		addr      net.Addr
+		policy    mse.Policy
+		utp       bool
+		encrypted bool
+		network   string
+		fails     bool
+	}{
+		"plaintext": {
+			addr:      plain.Addr(),
+			policy:    mse.Plaintext,
+			encrypted: false,
+			network:   "tcp",
+			fails:     false,
+		},
+		"prefer encrypted falls back": {
+			addr:      plain.Addr(),
+			policy:    mse.PreferEncrypted,
+			encrypted: false,
+			network:   "tcp",
+			fails:     false,
+		},
+		"require encrypted": {
+			addr:      plain.Addr(),
+			policy:    mse.RequireEncrypted, // <- fails here
+			encrypted: false,
+			network:   "tcp",
+			fails:     true,
+		},
+		"prefer encrypted": {
+			addr:      encrypted.Addr(),
+			policy:    mse.PreferEncrypted,
+			encrypted: true,
+			network:   "tcp",
+			fails:     false,
+		},
+		"utp": {
+			addr:      s.Addr(),
+			policy:    mse.RequireEncrypted,
+			utp:       true,
+			encrypted: true,
+			network:   "udp",
+			fails:     false,
+		},
+		"utp prefer encrypted falls back": {
+			addr:      plainUTP.Addr(),
+			policy:    mse.PreferEncrypted,
+			utp:       true,
+			encrypted: false,
+			network:   "udp",
+			fails:     false,
+		},
+		"utp falls back to tcp": {
+			addr:      encrypted.Addr(),
+			policy:    mse.RequireEncrypted,
+			utp:       true,
+			encrypted: true,
+			network:   "tcp",
+			fails:     false,
+		},
+	}
+
+	for name, test := range tests {
+		p, err := FromAddr(test.addr)
+		require.Nil(t, err, name)
+
+		d := &Dialer{Encryption: test.policy}
+		if test.utp {
+			d.UTP = local
+		}
+		conn, err := d.Dial(p, infoHash)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		require.Nil(t, err, name)
+
+		ec, ok := conn.(*mse.Conn)
+		assert.Equal(t, test.encrypted, ok && ec.Encrypted, name)
+		assert.Equal(t, test.network, conn.RemoteAddr().Network(), name)
+
+		msg := []byte("\x13BitTorrent protocol")
+		_, err = conn.Write(msg)
+		require.Nil(t, err, name)
+		got := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, got)
+		require.Nil(t, err, name)
+		assert.Equal(t, msg, got, name)
+		conn.Close()
+	}
+}
@@ -12,31 +12,101 @@ import (
 type Peer struct {
 	IP   net.IP
 	Port uint16
+	// peer id advertised by the tracker, zero when unknown
+	ID [20]byte
 }
 
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
 
+// FromAddr creates a peer from the remote address of a connection.
+func FromAddr(addr net.Addr) (Peer, error) {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		// uTP connections
+		ip, port = a.IP, a.Port
+	default:
+		err := errors.New("invalid peer address")
+		log.WithFields(log.Fields{"addr": addr.String()}).Error(err.Error())
+		return Peer{}, err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return Peer{IP: ip, Port: uint16(port)}, nil
+}
+
+// Unmarshal parses a compact IPv4 peer list.
 func Unmarshal(b []byte) ([]Peer, error) {
 	// 4 bytes ip, 2 bytes port
-	const size = 6
+	return unmarshal(b, net.IPv4len)
+}
+
+// Unmarshal6 parses a compact IPv6 peer list.
+// [https://www.bittorrent.org/beps/bep_0007.html]
+func Unmarshal6(b []byte) ([]Peer, error) {
+	// 16 bytes ip, 2 bytes port
+	return unmarshal(b, net.IPv6len)
+}
+
+// Marshal returns the compact IPv4 peer list of peers, other peers are
+// left out.
+func Marshal(peers []Peer) []byte {
+	return marshal(peers, net.IPv4len)
+}
+
+// Marshal6 returns the compact IPv6 peer list of peers, IPv4 peers are
+// left out.
+func Marshal6(peers []Peer) []byte {
+	return marshal(peers, net.IPv6len)
+}
+
+func marshal(peers []Peer, ipLen int) []byte {
+	var b []byte
+	for _, p := range peers {
+		ip := p.IP.To4()
+		if ipLen == net.IPv6len {
+			if ip != nil {
+				continue
+			}
+			ip = p.IP.To16()
+		}
+		if len(ip) != ipLen {
+			continue
+		}
+		b = append(b, ip...)
+		b = binary.BigEndian.AppendUint16(b, p.Port)
+	}
+	return b
+}
+
+func unmarshal(b []byte, ipLen int) ([]Peer, error) {
+	size := ipLen + 2
 	count := len(b) / size
 	if len(b)%size != 0 {
 		err := errors.New("invalid compact peer list length")
-		log.Error(err.Error())
+		log.WithFields(log.Fields{"length": len(b), "entry": size}).Error(err.Error())
 		return nil, err
 	}
 
 	peers := make([]Peer, count)
 	for i := 0; i < count; i++ {
 		offset := i * size
-		ip := offset + 4
-		port := offset + 6
+		ip := offset + ipLen
+		port := offset + size
 
 		// IP: b[offset:ip] Port: b[ip:port]
 		peers[i].IP = net.IP(b[offset:ip])
-		peers[i].Port = binary.BigEndian.Uint16([]byte(b[ip:port]))
+		if ip4 := peers[i].IP.To4(); ip4 != nil {
+			// ipv4-mapped ipv6 address
+			peers[i].IP = ip4
+		}
+		peers[i].Port = binary.BigEndian.Uint16(b[ip:port])
 	}
 	return peers, nil
 }
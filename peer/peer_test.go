@@ -38,6 +38,93 @@ func TestUnmarshal(t *testing.T) {
 	}
 }
 
+func TestUnmarshal6(t *testing.T) {
+	tests := map[string]struct {
+		input  []byte
+		output []Peer
+		fails  bool
+	}{
+		"correct input": {
+			input: []byte{
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE9,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 127, 0, 0, 1, 0x00, 0x7f,
+			},
+			output: []Peer{
+				{IP: net.ParseIP("2001:db8::1"), Port: 6889},
+				{IP: net.IP{127, 0, 0, 1}, Port: 127}, // <- ipv4-mapped
+			},
+		},
+		"invalid bytes in peers": {
+			input:  []byte{127, 0, 0, 1, 0x00, 0x7f}, // <- fails here: ipv4 entry
+			output: nil,
+			fails:  true,
+		},
+	}
+
+	for name, test := range tests {
+		peers, err := Unmarshal6(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+		} else {
+			assert.Nil(t, err, name)
+		}
+		assert.Equal(t, test.output, peers, name)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	peers := []Peer{
+		{IP: net.IP{127, 0, 0, 1}, Port: 6889},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6889},
+		{IP: net.ParseIP("192.0.2.1"), Port: 127}, // <- 16 byte form of an ipv4 address
+	}
+
+	b := Marshal(peers)
+	assert.Equal(t, []byte{127, 0, 0, 1, 0x1A, 0xE9, 192, 0, 2, 1, 0x00, 0x7f}, b)
+	v4, err := Unmarshal(b)
+	assert.Nil(t, err)
+	assert.Equal(t, []Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6889}, {IP: net.IP{192, 0, 2, 1}, Port: 127}}, v4)
+
+	v6, err := Unmarshal6(Marshal6(peers))
+	assert.Nil(t, err)
+	assert.Equal(t, []Peer{{IP: net.ParseIP("2001:db8::1"), Port: 6889}}, v6)
+}
+
+func TestFromAddr(t *testing.T) {
+	tests := map[string]struct {
+		input  net.Addr
+		output Peer
+		fails  bool
+	}{
+		"ipv4": {
+			input:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6881},
+			output: Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881},
+		},
+		"ipv6": {
+			input:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+			output: Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+		},
+		"utp": {
+			input:  &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 6881},
+			output: Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881},
+		},
+		"not ip": {
+			input: &net.UnixAddr{Name: "/tmp/peer", Net: "unix"}, // <- fails here
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		p, err := FromAddr(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, p, name)
+	}
+}
+
 func TestPeerString(t *testing.T) {
 	tests := []struct {
 		input  Peer
@@ -47,6 +134,10 @@ func TestPeerString(t *testing.T) {
 			input:  Peer{IP: net.IP{127, 0, 0, 1}, Port: 1337},
 			output: "127.0.0.1:1337",
 		},
+		{
+			input:  Peer{IP: net.ParseIP("2001:db8::1"), Port: 1337},
+			output: "[2001:db8::1]:1337",
+		},
 	}
 	for _, test := range tests {
 		s := test.input.String()
@@ -0,0 +1,267 @@
+package pex
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/mitander/bitrush/extension"
+	"github.com/mitander/bitrush/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// [https://www.bittorrent.org/beps/bep_0011.html]
+const (
+	Name = "ut_pex"
+	// Interval is the minimum time between two messages to the same peer
+	Interval = time.Minute
+	// MaxPeers is the most added and the most dropped peers in a message
+	MaxPeers = 50
+	// slack for the timers of the peer
+	minRecvInterval = 45 * time.Second
+)
+
+// Flags describe an added peer.
+type Flags byte
+
+const (
+	FlagEncryption Flags = 0x01
+	FlagSeed       Flags = 0x02
+	FlagUTP        Flags = 0x04
+	FlagHolepunch  Flags = 0x08
+	FlagReachable  Flags = 0x10
+)
+
+// Message is the payload of a ut_pex message.
+type Message struct {
+	Added   []peer.Peer
+	Flags   []Flags
+	Dropped []peer.Peer
+}
+
+type bencodeMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// Marshal encodes the message with the IPv4 and IPv6 peers in separate lists.
+func (m *Message) Marshal() ([]byte, error) {
+	var added, added6 []peer.Peer
+	var flags, flags6 []byte
+	for i, p := range m.Added {
+		var f Flags
+		if i < len(m.Flags) {
+			f = m.Flags[i]
+		}
+		if p.IP.To4() != nil {
+			added = append(added, p)
+			flags = append(flags, byte(f))
+		} else {
+			added6 = append(added6, p)
+			flags6 = append(flags6, byte(f))
+		}
+	}
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, bencodeMessage{
+		Added:    string(peer.Marshal(added)),
+		AddedF:   string(flags),
+		Added6:   string(peer.Marshal6(added6)),
+		Added6F:  string(flags6),
+		Dropped:  string(peer.Marshal(m.Dropped)),
+		Dropped6: string(peer.Marshal6(m.Dropped)),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to marshal pex message")
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a message, missing flags are zero.
+func Unmarshal(payload []byte) (*Message, error) {
+	bm := bencodeMessage{}
+	err := bencode.Unmarshal(bytes.NewReader(payload), &bm)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Debug("failed to unmarshal pex message")
+		return nil, err
+	}
+
+	added, err := peer.Unmarshal([]byte(bm.Added))
+	if err != nil {
+		return nil, err
+	}
+	added6, err := peer.Unmarshal6([]byte(bm.Added6))
+	if err != nil {
+		return nil, err
+	}
+	dropped, err := peer.Unmarshal([]byte(bm.Dropped))
+	if err != nil {
+		return nil, err
+	}
+	dropped6, err := peer.Unmarshal6([]byte(bm.Dropped6))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{
+		Added:   append(added, added6...),
+		Dropped: append(dropped, dropped6...),
+	}
+	m.Flags = append(flags(bm.AddedF, len(added)), flags(bm.Added6F, len(added6))...)
+	return m, nil
+}
+
+func flags(f string, n int) []Flags {
+	res := make([]Flags, n)
+	for i := 0; i < n && i < len(f); i++ {
+		res[i] = Flags(f[i])
+	}
+	return res
+}
+
+// entry is a connected peer and its flags.
+type entry struct {
+	peer  peer.Peer
+	flags Flags
+}
+
+// session is the exchange state with a single peer.
+type session struct {
+	// peers the remote peer learned from us
+	known    map[string]peer.Peer
+	sent     time.Time
+	received time.Time
+}
+
+// PEX exchanges the connected peers of a torrent with its peers.
+type PEX struct {
+	add      func(peers []peer.Peer)
+	peers    map[string]entry
+	sessions map[*extension.Session]*session
+	now      func() time.Time
+	mu       sync.Mutex
+}
+
+func New(add func(peers []peer.Peer)) *PEX {
+	return &PEX{
+		add:      add,
+		peers:    make(map[string]entry),
+		sessions: make(map[*extension.Session]*session),
+		now:      time.Now,
+	}
+}
+
+func (p *PEX) Name() string {
+	return Name
+}
+
+func (p *PEX) Connected(pr peer.Peer, flags Flags) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peers[pr.String()] = entry{pr, flags}
+}
+
+func (p *PEX) Disconnected(pr peer.Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.peers, pr.String())
+}
+
+func (p *PEX) session(s *extension.Session) *session {
+	st, ok := p.sessions[s]
+	if !ok {
+		st = &session{known: make(map[string]peer.Peer)}
+		p.sessions[s] = st
+	}
+	return st
+}
+
+// Handle passes the added peers to the torrent.
+func (p *PEX) Handle(s *extension.Session, payload []byte) error {
+	p.mu.Lock()
+	st := p.session(s)
+	now := p.now()
+	if !st.received.IsZero() && now.Sub(st.received) < minRecvInterval {
+		p.mu.Unlock()
+		log.WithFields(log.Fields{"peer": s.Addr}).Debug("ignoring pex message: sent too often")
+		return nil
+	}
+	st.received = now
+	p.mu.Unlock()
+
+	m, err := Unmarshal(payload)
+	if err != nil {
+		return err
+	}
+	added := m.Added
+	if len(added) > MaxPeers {
+		added = added[:MaxPeers]
+	}
+	if len(added) > 0 && p.add != nil {
+		log.WithFields(log.Fields{"peer": s.Addr, "added": len(added)}).Debug("received pex peers")
+		p.add(added)
+	}
+	return nil
+}
+
+// Update sends the changes since the previous message, at most once per Interval.
+func (p *PEX) Update(s *extension.Session) error {
+	if !s.Supports(Name) {
+		return nil
+	}
+
+	p.mu.Lock()
+	st := p.session(s)
+	now := p.now()
+	if !st.sent.IsZero() && now.Sub(st.sent) < Interval {
+		p.mu.Unlock()
+		return nil
+	}
+	st.sent = now
+
+	m := &Message{}
+	for addr, e := range p.peers {
+		if len(m.Added) == MaxPeers {
+			break
+		}
+		if _, ok := st.known[addr]; ok || addr == s.Addr {
+			continue
+		}
+		st.known[addr] = e.peer
+		m.Added = append(m.Added, e.peer)
+		m.Flags = append(m.Flags, e.flags)
+	}
+	for addr, pr := range st.known {
+		if len(m.Dropped) == MaxPeers {
+			break
+		}
+		if _, ok := p.peers[addr]; ok {
+			continue
+		}
+		delete(st.known, addr)
+		m.Dropped = append(m.Dropped, pr)
+	}
+	p.mu.Unlock()
+
+	if len(m.Added) == 0 && len(m.Dropped) == 0 {
+		return nil
+	}
+	payload, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.Send(Name, payload)
+}
+
+// Close drops the exchange state of a closed connection.
+func (p *PEX) Close(s *extension.Session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sessions, s)
+}
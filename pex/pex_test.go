@@ -0,0 +1,133 @@
+package pex
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mitander/bitrush/extension"
+	"github.com/mitander/bitrush/message"
+	"github.com/mitander/bitrush/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessage(t *testing.T) {
+	m := &Message{
+		Added: []peer.Peer{
+			{IP: net.IP{127, 0, 0, 1}, Port: 6881},
+			{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+		},
+		Flags:   []Flags{FlagReachable | FlagSeed, FlagUTP},
+		Dropped: []peer.Peer{{IP: net.IP{127, 0, 0, 2}, Port: 6883}},
+	}
+	payload, err := m.Marshal()
+	assert.Nil(t, err)
+	assert.Equal(t, "d5:added6:\x7f\x00\x00\x01\x1a\xe17:added.f1:\x126:added618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe28:added6.f1:\x047:dropped6:\x7f\x00\x00\x02\x1a\xe38:dropped60:e", string(payload))
+
+	res, err := Unmarshal(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, m, res)
+
+	// flags are optional
+	res, err = Unmarshal([]byte("d5:added6:\x7f\x00\x00\x01\x1a\xe1e"))
+	assert.Nil(t, err)
+	assert.Equal(t, []Flags{0}, res.Flags)
+
+	_, err = Unmarshal([]byte("d5:added5:\x7f\x00\x00\x01\x1ae")) // <- fails here, truncated peer
+	assert.NotNil(t, err)
+}
+
+// newSession returns a session of a peer supporting ut_pex with id 1 and
+// the messages sent to it.
+func newSession(t *testing.T, addr string, p *PEX) (*extension.Session, *[]*message.Message) {
+	r := extension.NewRegistry()
+	r.Register(p)
+	var sent []*message.Message
+	s := r.NewSession(addr, func(msg *message.Message) error {
+		sent = append(sent, msg)
+		return nil
+	})
+	msg, _ := extension.FormatHandshakeMsg(&extension.Handshake{M: map[string]int{Name: 1}})
+	assert.Nil(t, s.Handle(msg))
+	return s, &sent
+}
+
+func TestUpdate(t *testing.T) {
+	now := time.Now()
+	p := New(nil)
+	p.now = func() time.Time { return now }
+
+	a := peer.Peer{IP: net.IP{127, 0, 0, 1}, Port: 6881}
+	b := peer.Peer{IP: net.IP{127, 0, 0, 2}, Port: 6881}
+	p.Connected(a, FlagReachable)
+	p.Connected(b, FlagReachable|FlagSeed)
+	s, sent := newSession(t, a.String(), p)
+
+	// the peer is not told about itself
+	assert.Nil(t, p.Update(s))
+	assert.Equal(t, 1, len(*sent))
+	_, payload, _ := extension.ParseMsg((*sent)[0])
+	m, _ := Unmarshal(payload)
+	assert.Equal(t, []peer.Peer{b}, m.Added)
+	assert.Equal(t, []Flags{FlagReachable | FlagSeed}, m.Flags)
+	assert.Empty(t, m.Dropped)
+
+	// at most one message per interval
+	p.Disconnected(b)
+	assert.Nil(t, p.Update(s))
+	assert.Equal(t, 1, len(*sent))
+
+	now = now.Add(Interval)
+	assert.Nil(t, p.Update(s))
+	assert.Equal(t, 2, len(*sent))
+	_, payload, _ = extension.ParseMsg((*sent)[1])
+	m, _ = Unmarshal(payload)
+	assert.Equal(t, []peer.Peer{b}, m.Dropped)
+	assert.Empty(t, m.Added)
+
+	// nothing changed, nothing sent
+	now = now.Add(Interval)
+	assert.Nil(t, p.Update(s))
+	assert.Equal(t, 2, len(*sent))
+}
+
+func TestUpdateMaxPeers(t *testing.T) {
+	p := New(nil)
+	for i := 0; i < MaxPeers+10; i++ {
+		p.Connected(peer.Peer{IP: net.IP{10, 0, 0, byte(i)}, Port: 6881}, 0)
+	}
+	s, sent := newSession(t, "127.0.0.1:6881", p)
+
+	assert.Nil(t, p.Update(s))
+	_, payload, _ := extension.ParseMsg((*sent)[0])
+	m, _ := Unmarshal(payload)
+	assert.Equal(t, MaxPeers, len(m.Added))
+}
+
+func TestHandle(t *testing.T) {
+	now := time.Now()
+	var added []peer.Peer
+	p := New(func(peers []peer.Peer) {
+		added = append(added, peers...)
+	})
+	p.now = func() time.Time { return now }
+	s, _ := newSession(t, "127.0.0.1:6881", p)
+
+	m := &Message{Added: []peer.Peer{{IP: net.IP{127, 0, 0, 2}, Port: 6881}}}
+	payload, _ := m.Marshal()
+	assert.Nil(t, p.Handle(s, payload))
+	assert.Equal(t, m.Added, added)
+
+	// messages sent too often are ignored
+	now = now.Add(10 * time.Second)
+	assert.Nil(t, p.Handle(s, payload))
+	assert.Equal(t, 1, len(added))
+
+	now = now.Add(Interval)
+	assert.Nil(t, p.Handle(s, payload))
+	assert.Equal(t, 2, len(added))
+
+	// state is dropped with the connection
+	p.Close(s)
+	assert.Empty(t, p.sessions)
+}
@@ -0,0 +1,369 @@
+package picker
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/mitander/bitrush/bitfield"
+)
+
+// BlockSize is the size of a block requested from a peer, the last block
+// of a piece may be shorter.
+const BlockSize = 16384
+
+type pieceState int
+
+const (
+	missing pieceState = iota
+	pending
+	done
+)
+
+// Block is the part of a piece fetched with a single request.
+type Block struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// partialPiece is a piece with requested or received blocks, it is kept
+// when peers disconnect so the remaining blocks can come from other peers.
+type partialPiece struct {
+	buf        []byte
+	received   []bool
+	requesters [][]string
+	left       int
+}
+
+// Picker schedules the blocks to request from peers. Pieces in progress are
+// finished first, new pieces are started rarest first among the pieces a peer
+// has, breaking ties at random. Availability is counted from the bitfields and
+// have messages of all connected peers.
+//
+// Once every missing block is requested the picker enters endgame mode and
+// hands requested blocks to further peers, the block with the fewest
+// requesters first. Peers should cancel requests for blocks that were
+// received elsewhere, see Received.
+type Picker struct {
+	availability []int
+	state        []pieceState
+	partial      map[int]*partialPiece
+	pieceLength  int
+	length       int
+	left         int
+	mu           sync.Mutex
+}
+
+// NewPicker creates a picker for a torrent of length bytes, pieces in have
+// are already downloaded and never picked.
+func NewPicker(length, pieceLength int, have bitfield.Bitfield) *Picker {
+	numPieces := (length + pieceLength - 1) / pieceLength
+	p := &Picker{
+		availability: make([]int, numPieces),
+		state:        make([]pieceState, numPieces),
+		partial:      make(map[int]*partialPiece),
+		pieceLength:  pieceLength,
+		length:       length,
+		left:         numPieces,
+	}
+	for i := 0; i < numPieces; i++ {
+		if hasPiece(have, i) {
+			p.state[i] = done
+			p.left--
+		}
+	}
+	return p
+}
+
+// AddPeer counts the pieces of a newly connected peer.
+func (p *Picker) AddPeer(bf bitfield.Bitfield) {
+	p.updatePeer(bf, 1)
+}
+
+// RemovePeer stops counting the pieces of a disconnected peer.
+func (p *Picker) RemovePeer(bf bitfield.Bitfield) {
+	p.updatePeer(bf, -1)
+}
+
+func (p *Picker) updatePeer(bf bitfield.Bitfield, n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.availability {
+		if hasPiece(bf, i) {
+			p.availability[i] += n
+		}
+	}
+}
+
+// Have counts a piece a connected peer announced after its bitfield.
+func (p *Picker) Have(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if index >= 0 && index < len(p.availability) {
+		p.availability[index]++
+	}
+}
+
+// Pick returns up to n blocks to request from the peer identified by key
+// and marks them requested by it. No blocks are returned when the peer has
+// no piece we still need.
+func (p *Picker) Pick(bf bitfield.Bitfield, key string, n int) []Block {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var blocks []Block
+
+	// finish pieces in progress first
+	for index, pp := range p.partial {
+		if len(blocks) == n {
+			return blocks
+		}
+		if hasPiece(bf, index) {
+			blocks = p.pickBlocks(blocks, index, pp, key, n, 0)
+		}
+	}
+
+	for len(blocks) < n {
+		candidates := p.candidates(bf)
+		if len(candidates) == 0 {
+			break
+		}
+		index := candidates[rand.Intn(len(candidates))]
+		blocks = p.pickBlocks(blocks, index, p.start(index), key, n, 0)
+	}
+
+	if len(blocks) == n || !p.endgame() {
+		return blocks
+	}
+
+	// endgame: request blocks other peers are already fetching, the least
+	// requested blocks first
+	for requesters := 1; len(blocks) < n; requesters++ {
+		found := false
+		for index, pp := range p.partial {
+			if !hasPiece(bf, index) {
+				continue
+			}
+			for i := range pp.requesters {
+				if !pp.received[i] && len(pp.requesters[i]) >= requesters {
+					found = true
+				}
+			}
+			blocks = p.pickBlocks(blocks, index, pp, key, n, requesters)
+		}
+		if !found {
+			break
+		}
+	}
+	return blocks
+}
+
+// pickBlocks appends the blocks of a piece that are not received, not
+// requested by key and requested by exactly requesters other peers.
+func (p *Picker) pickBlocks(blocks []Block, index int, pp *partialPiece, key string, n int, requesters int) []Block {
+	for i := range pp.received {
+		if len(blocks) == n {
+			break
+		}
+		if pp.received[i] || len(pp.requesters[i]) != requesters || contains(pp.requesters[i], key) {
+			continue
+		}
+		pp.requesters[i] = append(pp.requesters[i], key)
+		blocks = append(blocks, p.block(index, i))
+	}
+	return blocks
+}
+
+// candidates returns the missing pieces the peer has with the lowest availability.
+func (p *Picker) candidates(bf bitfield.Bitfield) []int {
+	var candidates []int
+	rarest := 0
+	for i, s := range p.state {
+		if s != missing || !hasPiece(bf, i) {
+			continue
+		}
+		a := p.availability[i]
+		switch {
+		case len(candidates) == 0 || a < rarest:
+			rarest = a
+			candidates = append(candidates[:0], i)
+		case a == rarest:
+			candidates = append(candidates, i)
+		}
+	}
+	return candidates
+}
+
+func (p *Picker) start(index int) *partialPiece {
+	length := p.pieceSize(index)
+	blocks := (length + BlockSize - 1) / BlockSize
+	pp := &partialPiece{
+		buf:        make([]byte, length),
+		received:   make([]bool, blocks),
+		requesters: make([][]string, blocks),
+		left:       blocks,
+	}
+	p.state[index] = pending
+	p.partial[index] = pp
+	return pp
+}
+
+// endgame reports whether every block not received is requested.
+func (p *Picker) endgame() bool {
+	for _, s := range p.state {
+		if s == missing {
+			return false
+		}
+	}
+	for _, pp := range p.partial {
+		for i := range pp.received {
+			if !pp.received[i] && len(pp.requesters[i]) == 0 {
+				return false
+			}
+		}
+	}
+	return p.left > 0
+}
+
+// Endgame reports whether the picker hands out requested blocks again.
+func (p *Picker) Endgame() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.endgame()
+}
+
+// Abort releases a block requested by key which will not be received,
+// blocks already received from other peers are kept.
+func (p *Picker) Abort(b Block, key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pp, ok := p.partial[b.Index]
+	if !ok {
+		return
+	}
+	i := b.Begin / BlockSize
+	pp.requesters[i] = remove(pp.requesters[i], key)
+}
+
+// Received reports whether the block is no longer needed because it was
+// received or its piece was verified.
+func (p *Picker) Received(b Block) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state[b.Index] == done {
+		return true
+	}
+	pp, ok := p.partial[b.Index]
+	return ok && pp.received[b.Begin/BlockSize]
+}
+
+// Write stores the data of a received block. Once all blocks of the piece
+// are in, the piece is returned for verification and ok is true. Duplicate
+// blocks are discarded.
+func (p *Picker) Write(b Block, data []byte) (piece []byte, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pp, found := p.partial[b.Index]
+	if !found || b.Begin%BlockSize != 0 || b.Begin+len(data) > len(pp.buf) {
+		return nil, false
+	}
+	i := b.Begin / BlockSize
+	if pp.received[i] || len(data) != p.block(b.Index, i).Length {
+		return nil, false
+	}
+
+	copy(pp.buf[b.Begin:], data)
+	pp.received[i] = true
+	pp.requesters[i] = nil
+	pp.left--
+	if pp.left > 0 {
+		return nil, false
+	}
+	return pp.buf, true
+}
+
+// Verified marks a complete piece as downloaded.
+func (p *Picker) Verified(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.state[index] != pending {
+		return
+	}
+	p.state[index] = done
+	delete(p.partial, index)
+	p.left--
+}
+
+// Failed discards the blocks of a piece that did not match its hash so
+// they are downloaded again.
+func (p *Picker) Failed(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pp, ok := p.partial[index]
+	if !ok {
+		return
+	}
+	for i := range pp.received {
+		pp.received[i] = false
+	}
+	pp.left = len(pp.received)
+}
+
+// Left returns the number of pieces not downloaded yet.
+func (p *Picker) Left() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.left
+}
+
+func (p *Picker) pieceSize(index int) int {
+	begin := index * p.pieceLength
+	end := begin + p.pieceLength
+	if end > p.length {
+		end = p.length
+	}
+	return end - begin
+}
+
+func (p *Picker) block(index, i int) Block {
+	begin := i * BlockSize
+	length := BlockSize
+	if size := p.pieceSize(index); size-begin < length {
+		length = size - begin
+	}
+	return Block{Index: index, Begin: begin, Length: length}
+}
+
+// hasPiece is bitfield.HasPiece without the warning, peers may send
+// bitfields shorter than the piece count.
+func hasPiece(bf bitfield.Bitfield, index int) bool {
+	if index/8 >= len(bf) {
+		return false
+	}
+	return bf.HasPiece(index)
+}
+
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(keys []string, key string) []string {
+	for i, k := range keys {
+		if k == key {
+			return append(keys[:i], keys[i+1:]...)
+		}
+	}
+	return keys
+}
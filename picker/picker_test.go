@@ -0,0 +1,162 @@
+package picker
+
+import (
+	"testing"
+
+	"github.com/mitander/bitrush/bitfield"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPick(t *testing.T) {
+	tests := map[string]struct {
+		have   bitfield.Bitfield
+		peers  []bitfield.Bitfield
+		peer   bitfield.Bitfield
+		output []int
+	}{
+		"rarest first": {
+			have:   bitfield.Bitfield{0b00000000},
+			peers:  []bitfield.Bitfield{{0b11110000}, {0b11100000}, {0b11000000}},
+			peer:   bitfield.Bitfield{0b11110000},
+			output: []int{3}, // <- only one peer has piece 3
+		},
+		"random tie break": {
+			have:   bitfield.Bitfield{0b00000000},
+			peers:  []bitfield.Bitfield{{0b11110000}, {0b00110000}},
+			peer:   bitfield.Bitfield{0b11110000},
+			output: []int{0, 1},
+		},
+		"only pieces the peer has": {
+			have:   bitfield.Bitfield{0b00000000},
+			peers:  []bitfield.Bitfield{{0b10000000}, {0b01000000}},
+			peer:   bitfield.Bitfield{0b01000000},
+			output: []int{1},
+		},
+		"downloaded pieces skipped": {
+			have:   bitfield.Bitfield{0b11100000},
+			peers:  []bitfield.Bitfield{{0b11110000}},
+			peer:   bitfield.Bitfield{0b11110000},
+			output: []int{3},
+		},
+		"nothing to pick": {
+			have:   bitfield.Bitfield{0b11110000},
+			peers:  []bitfield.Bitfield{{0b11110000}},
+			peer:   bitfield.Bitfield{0b11110000},
+			output: nil,
+		},
+	}
+
+	for name, test := range tests {
+		p := NewPicker(4*BlockSize, BlockSize, test.have)
+		for _, bf := range test.peers {
+			p.AddPeer(bf)
+		}
+		blocks := p.Pick(test.peer, "a", 1)
+		if test.output == nil {
+			assert.Empty(t, blocks, name)
+			continue
+		}
+		assert.Equal(t, 1, len(blocks), name)
+		assert.Contains(t, test.output, blocks[0].Index, name)
+	}
+}
+
+func TestPickBlocks(t *testing.T) {
+	// two pieces of three blocks, the last block is short
+	p := NewPicker(5*BlockSize+100, 3*BlockSize, bitfield.Bitfield{0b00000000})
+	a := bitfield.Bitfield{0b10000000}
+	b := bitfield.Bitfield{0b11000000}
+	p.AddPeer(a)
+	p.AddPeer(b)
+
+	// blocks of one piece are spread over peers
+	blocks := p.Pick(a, "a", 2)
+	assert.Equal(t, []Block{{0, 0, BlockSize}, {0, BlockSize, BlockSize}}, blocks)
+
+	// pieces in progress are finished first
+	blocks = p.Pick(b, "b", 2)
+	assert.Equal(t, Block{0, 2 * BlockSize, BlockSize}, blocks[0])
+	assert.Equal(t, 1, blocks[1].Index)
+
+	// partial pieces are kept when a peer goes away
+	_, ok := p.Write(Block{0, 0, BlockSize}, make([]byte, BlockSize))
+	assert.False(t, ok)
+	p.Abort(Block{0, BlockSize, BlockSize}, "a")
+	blocks = p.Pick(a, "a", 5)
+	assert.Equal(t, []Block{{0, BlockSize, BlockSize}}, blocks)
+
+	// short last block
+	blocks = p.Pick(b, "b", 2)
+	assert.Equal(t, []Block{{1, BlockSize, BlockSize}, {1, 2 * BlockSize, 100}}, blocks)
+	assert.True(t, p.Endgame())
+}
+
+func TestWrite(t *testing.T) {
+	p := NewPicker(2*BlockSize, 2*BlockSize, bitfield.Bitfield{0b00000000})
+	peer := bitfield.Bitfield{0b10000000}
+	p.AddPeer(peer)
+	blocks := p.Pick(peer, "a", 2)
+	assert.Equal(t, 2, len(blocks))
+
+	first := make([]byte, BlockSize)
+	first[0] = 1
+	_, ok := p.Write(blocks[0], first)
+	assert.False(t, ok)
+	assert.True(t, p.Received(blocks[0]))
+
+	// duplicate and malformed blocks are discarded
+	_, ok = p.Write(blocks[0], make([]byte, BlockSize))
+	assert.False(t, ok)
+	_, ok = p.Write(Block{0, 1, BlockSize}, make([]byte, BlockSize))
+	assert.False(t, ok)
+	_, ok = p.Write(blocks[1], make([]byte, 10))
+	assert.False(t, ok)
+
+	piece, ok := p.Write(blocks[1], make([]byte, BlockSize))
+	assert.True(t, ok)
+	assert.Equal(t, 2*BlockSize, len(piece))
+	assert.Equal(t, byte(1), piece[0])
+
+	// failed piece is downloaded again
+	p.Failed(0)
+	assert.False(t, p.Received(blocks[0]))
+	assert.Equal(t, blocks, p.Pick(peer, "a", 2))
+
+	for _, b := range blocks {
+		p.Write(b, make([]byte, BlockSize))
+	}
+	p.Verified(0)
+	assert.Equal(t, 0, p.Left())
+	assert.True(t, p.Received(blocks[0]))
+	assert.Empty(t, p.Pick(peer, "a", 2))
+}
+
+func TestEndgame(t *testing.T) {
+	p := NewPicker(2*BlockSize, BlockSize, bitfield.Bitfield{0b00000000})
+	slow := bitfield.Bitfield{0b11000000}
+	fast := bitfield.Bitfield{0b01000000}
+	p.AddPeer(slow)
+	p.AddPeer(fast)
+
+	blocks := p.Pick(slow, "slow", 5)
+	assert.Equal(t, 2, len(blocks))
+	assert.True(t, p.Endgame())
+
+	// endgame hands a requested block the other peer has out again
+	blocks = p.Pick(fast, "fast", 5)
+	assert.Equal(t, []Block{{1, 0, BlockSize}}, blocks)
+
+	// the same peer is never given a block twice
+	assert.Empty(t, p.Pick(slow, "slow", 5))
+
+	// first peer to deliver wins, the other request can be cancelled
+	_, ok := p.Write(blocks[0], make([]byte, BlockSize))
+	assert.True(t, ok)
+	assert.True(t, p.Received(blocks[0]))
+	_, ok = p.Write(blocks[0], make([]byte, BlockSize)) // <- late duplicate
+	assert.False(t, ok)
+
+	// aborting the only request leaves endgame
+	p.Abort(Block{0, 0, BlockSize}, "slow")
+	assert.False(t, p.Endgame())
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mitander/bitrush/metainfo"
+	"github.com/mitander/bitrush/torrent"
+	"github.com/mitander/bitrush/tracker"
+	log "github.com/sirupsen/logrus"
+)
+
+type scrapeResult struct {
+	announce string
+	res      *tracker.ScrapeResult
+	err      error
+}
+
+// runScrape prints the swarm health reported by every tracker of a torrent.
+func runScrape(args []string) {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	read := fs.String("f", "", "open .torrent file")
+	timeout := fs.Duration("t", 15*time.Second, "time to wait for trackers")
+	debug := fs.Bool("d", false, "enable debug mode")
+	fs.Parse(args)
+
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		// failing trackers are listed in the output
+		log.SetLevel(log.FatalLevel)
+	}
+
+	if *read == "" {
+		printNoArgs()
+		os.Exit(1)
+	}
+
+	m, err := metainfo.NewMetaInfo(*read)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	id, err := torrent.NewPeerID()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var announce []string
+	for _, tier := range m.Announce {
+		announce = append(announce, tier...)
+	}
+
+	// the deadline stops the requests, not only the wait for them
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	results := make([]scrapeResult, len(announce))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for i, a := range announce {
+		results[i] = scrapeResult{announce: a, err: fmt.Errorf("no response within %s", *timeout)}
+		wg.Add(1)
+		go func(i int, a string) {
+			defer wg.Done()
+			res, err := scrape(ctx, a, m.InfoHash, id)
+			mu.Lock()
+			results[i] = scrapeResult{announce: a, res: res, err: err}
+			mu.Unlock()
+		}(i, a)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	fmt.Println(m.Name)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TRACKER\tSEEDERS\tLEECHERS\tCOMPLETED\tERROR")
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t%s\n", r.announce, r.err.Error())
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", r.announce,
+			strconv.Itoa(r.res.Seeders), strconv.Itoa(r.res.Leechers), strconv.Itoa(r.res.Completed))
+	}
+	w.Flush()
+}
+
+func scrape(ctx context.Context, announce string, infoHash [20]byte, peerID [20]byte) (*tracker.ScrapeResult, error) {
+	tr, err := tracker.NewTracker(announce, infoHash, peerID)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := tr.(tracker.Scraper)
+	if !ok {
+		return nil, tracker.ErrScrapeNotSupported
+	}
+
+	res, err := s.Scrape(ctx, [][20]byte{infoHash})
+	if err != nil {
+		return nil, err
+	}
+	return &res[0], nil
+}
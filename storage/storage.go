@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -16,16 +17,26 @@ type File struct {
 	Length int
 }
 
+// FileInfo describes a stored file on disk, used to detect whether the
+// files changed between two runs.
+type FileInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
 type storageWork struct {
 	Data  []byte
 	Index int
+	done  chan error
 }
 
 type storageWorker struct {
 	files       []*os.File
+	paths       []string
 	fileLengths []int
 	queue       chan (storageWork)
 	ctx         context.Context
+	mu          sync.Mutex
 }
 
 func NewStorageWorker(ctx context.Context, dir string, files []File) (*storageWorker, error) {
@@ -48,6 +59,7 @@ func NewStorageWorker(ctx context.Context, dir string, files []File) (*storageWo
 	}
 
 	var fileLengths []int
+	var paths []string
 	var osFiles []*os.File
 	for _, f := range files {
 		if f.Length == 0 {
@@ -55,18 +67,20 @@ func NewStorageWorker(ctx context.Context, dir string, files []File) (*storageWo
 		}
 
 		path := filepath.Join(dir, f.Path)
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0755)
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0755)
 		if err != nil {
-			log.WithFields(log.Fields{"reason": err.Error(), "path": path}).Error("failed to open filex")
+			log.WithFields(log.Fields{"reason": err.Error(), "path": path}).Error("failed to open file")
 			return nil, err
 		}
 
 		osFiles = append(osFiles, file)
+		paths = append(paths, path)
 		fileLengths = append(fileLengths, f.Length)
 	}
 
 	return &storageWorker{
 		files:       osFiles,
+		paths:       paths,
 		fileLengths: fileLengths,
 		queue:       make(chan (storageWork)),
 		ctx:         ctx,
@@ -77,45 +91,105 @@ func (s *storageWorker) StartWorker() {
 	for {
 		select {
 		case w := <-s.queue:
-			index, fileIndex, err := s.getFile(w.Index)
-			if err != nil {
-				log.Errorf("putting piece %d back in queue: could not get file", w.Index)
-				s.queue <- w
-				continue
-			}
-
-			split := s.splitFileBounds(w, index, fileIndex)
-			if split != nil {
-				// piece data overlap file bounds,
-				// split rest data to new storage work
-				s.queue <- *split
-			}
-
-			file := s.files[fileIndex]
-			l, err := s.write(file, w)
-			if err != nil {
-				log.Errorf("putting piece %d back in queue: could not store work", w.Index)
-				s.queue <- w
-				continue
-			}
-
-			log.WithFields(log.Fields{
-				"file":   fileIndex,
-				"index":  index,
-				"length": l,
-			}).Debug("wrote to file")
+			w.done <- s.store(w)
 
 		case <-s.ctx.Done():
-			close(s.queue)
+			s.mu.Lock()
 			for _, f := range s.files {
 				f.Close()
 			}
+			s.mu.Unlock()
 			log.Debug("received exit signal, exiting storage worker")
 			return
 		}
 	}
 }
 
+func (s *storageWorker) store(w storageWork) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(w.Data) > 0 {
+		index, fileIndex, err := s.getFile(w.Index)
+		if err != nil {
+			log.Errorf("failed to store piece %d: could not get file", w.Index)
+			return err
+		}
+
+		// piece data overlapping file bounds is
+		// split and the rest is stored in the next file
+		split := s.splitFileBounds(w, index, fileIndex)
+		if split != nil {
+			w.Data = w.Data[:len(w.Data)-len(split.Data)]
+		}
+
+		l, err := s.write(s.files[fileIndex], storageWork{Data: w.Data, Index: index})
+		if err != nil {
+			log.Errorf("failed to store piece %d: could not write file", w.Index)
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"file":   fileIndex,
+			"index":  index,
+			"length": l,
+		}).Debug("wrote to file")
+
+		if split == nil {
+			break
+		}
+		w = *split
+	}
+	return nil
+}
+
+// Read reads length bytes starting at the torrent offset index,
+// spanning file bounds the same way stored work does. Reads run in
+// parallel with each other and with stored work.
+func (s *storageWorker) Read(index, length int) ([]byte, error) {
+	buf := make([]byte, length)
+	read := 0
+	for read < length {
+		offset, fileIndex, err := s.getFile(index + read)
+		if err != nil {
+			return nil, err
+		}
+		if offset >= s.fileLengths[fileIndex] {
+			return nil, errors.New("index not in range")
+		}
+
+		end := length
+		if remaining := s.fileLengths[fileIndex] - offset; read+remaining < end {
+			end = read + remaining
+		}
+
+		_, err = s.files[fileIndex].ReadAt(buf[read:end], int64(offset))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file":   fileIndex,
+				"index":  offset,
+				"reason": err.Error(),
+			}).Debug("failed reading from file")
+			return nil, err
+		}
+		read = end
+	}
+	return buf, nil
+}
+
+// Stat returns size and modification time of the stored files.
+func (s *storageWorker) Stat() ([]FileInfo, error) {
+	infos := make([]FileInfo, len(s.paths))
+	for i, path := range s.paths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		infos[i] = FileInfo{Size: stat.Size(), ModTime: stat.ModTime()}
+	}
+	return infos, nil
+}
+
 func (s *storageWorker) getFile(index int) (int, int, error) {
 	if len(s.files) == 1 {
 		return index, 0, nil
@@ -202,6 +276,14 @@ func (s *storageWorker) Complete() error {
 	return nil
 }
 
-func (s *storageWorker) AddWork(data []byte, index int) {
-	s.queue <- storageWork{Data: data, Index: index}
+// AddWork stores data at the torrent offset index and returns once it has
+// been written, so the data can be read back as soon as AddWork returns.
+func (s *storageWorker) AddWork(data []byte, index int) error {
+	done := make(chan error, 1)
+	select {
+	case s.queue <- storageWork{Data: data, Index: index, done: done}:
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+	return <-done
 }
@@ -1,10 +1,13 @@
 package storage
 
 import (
+	"context"
 	"crypto/rand"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetFile(t *testing.T) {
@@ -88,3 +91,70 @@ func TestSplitFileBounds(t *testing.T) {
 		}
 	}
 }
+
+func TestReadWrite(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	files := []File{{Path: "root", Length: 0}, {Path: "a", Length: 300}, {Path: "b", Length: 100}, {Path: "c", Length: 200}}
+	sw, err := NewStorageWorker(ctx, t.TempDir(), files)
+	require.Nil(t, err)
+	go sw.StartWorker()
+
+	data := make([]byte, 600)
+	rand.Read(data)
+
+	// piece spans all three files
+	err = sw.AddWork(data[250:450], 250)
+	assert.Nil(t, err)
+	err = sw.AddWork(data[:250], 0)
+	assert.Nil(t, err)
+	err = sw.AddWork(data[450:], 450)
+	assert.Nil(t, err)
+
+	tests := map[string]struct {
+		index  int
+		length int
+		fails  bool
+	}{
+		"single file":       {index: 10, length: 100, fails: false},
+		"across file bound": {index: 290, length: 20, fails: false},
+		"across all files":  {index: 0, length: 600, fails: false},
+		"out of range":      {index: 590, length: 20, fails: true},
+	}
+
+	for name, test := range tests {
+		buf, err := sw.Read(test.index, test.length)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		assert.Nil(t, err, name)
+		assert.Equal(t, data[test.index:test.index+test.length], buf, name)
+	}
+}
+
+func TestParallelRead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sw, err := NewStorageWorker(ctx, t.TempDir(), []File{{Path: "a", Length: 100}})
+	require.Nil(t, err)
+	go sw.StartWorker()
+	require.Nil(t, sw.AddWork(make([]byte, 100), 0))
+
+	// reads do not wait for stored work holding the lock
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	done := make(chan error)
+	go func() {
+		_, err := sw.Read(0, 100)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("read blocked by the storage lock")
+	}
+}
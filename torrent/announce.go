@@ -0,0 +1,195 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mitander/bitrush/peer"
+	"github.com/mitander/bitrush/tracker"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// used when the tracker does not send an interval
+	defaultAnnounceInterval = 30 * time.Minute
+	// used when no tracker responded
+	announceRetryInterval = 30 * time.Second
+	// time given to the stopped announce on shutdown
+	stoppedAnnounceTimeout = 5 * time.Second
+	// interval of announces to the dht
+	dhtAnnounceInterval = 15 * time.Minute
+)
+
+// announce announces to the trackers on the interval they ask for.
+func (t *Torrent) announce(ctx context.Context) {
+	event := tracker.EventStarted
+	next := time.Now()
+
+	t.mu.Lock()
+	t.NextAnnounce = next
+	complete := t.Downloaded == len(t.PieceHashes)
+	t.mu.Unlock()
+
+	// completed is only sent if the download finishes while running
+	completeC := t.seedC
+	if complete {
+		completeC = nil
+	}
+
+	for {
+		select {
+		case <-time.After(time.Until(next)):
+			res, err := t.Trackers.Announce(ctx, t.announceRequest(event))
+			last := time.Now()
+			if err != nil {
+				logAnnounceError(err)
+				next = last.Add(announceRetryInterval)
+				t.setAnnounced(last, next)
+				continue
+			}
+			event = tracker.EventNone
+			next = last.Add(t.announceInterval(res))
+			t.setAnnounced(last, next)
+			t.addPeers(ctx, res.Peers)
+
+		case <-completeC:
+			completeC = nil
+			_, err := t.Trackers.Announce(ctx, t.announceRequest(tracker.EventCompleted))
+			if err == nil {
+				t.setAnnounced(time.Now(), next)
+			}
+
+		case <-ctx.Done():
+			if event == tracker.EventStarted {
+				// never announced, nothing to stop
+				return
+			}
+			t.announceStopped()
+			return
+		}
+	}
+}
+
+// announceDHT finds peers through the DHT like through a tracker.
+func (t *Torrent) announceDHT(ctx context.Context) {
+	for {
+		var peers []peer.Peer
+		var err error
+		if t.DHT.Len() == 0 {
+			err = t.DHT.Bootstrap(ctx, t.Nodes...)
+		}
+		if err == nil {
+			if port := t.Port(); port != 0 {
+				peers, err = t.DHT.Announce(ctx, t.InfoHash, port)
+			} else {
+				peers, err = t.DHT.GetPeers(ctx, t.InfoHash)
+			}
+		}
+
+		interval := dhtAnnounceInterval
+		if err != nil {
+			log.WithFields(log.Fields{"reason": err.Error()}).Warn("dht announce failed")
+			interval = announceRetryInterval
+		} else {
+			log.WithFields(log.Fields{"peers": len(peers)}).Debug("dht announce")
+			t.addPeers(ctx, peers)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *Torrent) setAnnounced(last, next time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.LastAnnounce = last
+	t.NextAnnounce = next
+}
+
+// Announced returns when we last and next announce to the trackers.
+func (t *Torrent) Announced() (last, next time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.LastAnnounce, t.NextAnnounce
+}
+
+// TrackerStatus returns the announce status of every tracker of the torrent.
+func (t *Torrent) TrackerStatus() []tracker.Status {
+	return t.Trackers.Status()
+}
+
+func logAnnounceError(err error) {
+	var trErr *tracker.Error
+	if errors.As(err, &trErr) {
+		log.WithFields(log.Fields{"kind": trErr.Kind, "announce": trErr.URL}).Warn("announce failed")
+		return
+	}
+	log.WithFields(log.Fields{"reason": err.Error()}).Warn("announce failed")
+}
+
+// announceStopped sends the stopped event without holding up shutdown.
+func (t *Torrent) announceStopped() {
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+	defer cancel()
+
+	_, err := t.Trackers.Announce(ctx, t.announceRequest(tracker.EventStopped))
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Debug("stopped announce timed out")
+	}
+}
+
+// announceInterval returns the time until the next regular announce.
+func (t *Torrent) announceInterval(res *tracker.AnnounceResponse) time.Duration {
+	interval := res.Interval
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+	if t.ActiveWorkers.Load() == 0 && res.MinInterval > 0 && res.MinInterval < interval {
+		interval = res.MinInterval
+	}
+	return interval
+}
+
+func (t *Torrent) announceRequest(event tracker.Event) tracker.AnnounceRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	left := 0
+	for i := range t.PieceHashes {
+		if !t.Bitfield.HasPiece(i) {
+			begin, end := t.pieceBounds(i)
+			left += end - begin
+		}
+	}
+
+	return tracker.AnnounceRequest{
+		Event:      event,
+		Uploaded:   t.Uploaded,
+		Downloaded: t.DownloadedBytes,
+		Left:       left,
+		NumWant:    tracker.DefaultNumWant,
+		Port:       t.port,
+	}
+}
+
+func (t *Torrent) addPeers(ctx context.Context, peers []peer.Peer) {
+	t.mu.Lock()
+	peers = t.filterUnique(peers)
+	t.Peers = append(t.Peers, peers...)
+	total := len(t.Peers)
+	t.mu.Unlock()
+	log.Debugf("added %d peers, total peers: %d", len(peers), total)
+
+	for _, p := range peers {
+		select {
+		case t.workerC <- p:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
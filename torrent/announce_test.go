@@ -0,0 +1,173 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mitander/bitrush/bitfield"
+	"github.com/mitander/bitrush/dht"
+	"github.com/mitander/bitrush/extension"
+	"github.com/mitander/bitrush/metainfo"
+	"github.com/mitander/bitrush/peer"
+	"github.com/mitander/bitrush/storage"
+	"github.com/mitander/bitrush/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnounceRequest(t *testing.T) {
+	tests := map[string]struct {
+		bitfield bitfield.Bitfield
+		left     int
+	}{
+		"nothing downloaded": {
+			bitfield: bitfield.Bitfield{0b00000000},
+			left:     10,
+		},
+		"last piece missing": {
+			bitfield: bitfield.Bitfield{0b11000000},
+			left:     2, // <- last piece is 2 bytes
+		},
+		"complete": {
+			bitfield: bitfield.Bitfield{0b11100000},
+			left:     0,
+		},
+	}
+
+	for name, test := range tests {
+		torrent := &Torrent{
+			Length:          10,
+			PieceLength:     4,
+			PieceHashes:     make([][20]byte, 3),
+			Bitfield:        test.bitfield,
+			Uploaded:        7,
+			DownloadedBytes: 4,
+			port:            6881,
+		}
+		req := torrent.announceRequest(tracker.EventStarted)
+		assert.Equal(t, tracker.AnnounceRequest{
+			Event:      tracker.EventStarted,
+			Uploaded:   7,
+			Downloaded: 4,
+			Left:       test.left,
+			NumWant:    tracker.DefaultNumWant,
+			Port:       6881,
+		}, req, name)
+	}
+}
+
+func TestAnnounceInterval(t *testing.T) {
+	tests := map[string]struct {
+		workers  int64
+		res      tracker.AnnounceResponse
+		interval time.Duration
+	}{
+		"tracker interval": {
+			workers:  1,
+			res:      tracker.AnnounceResponse{Interval: time.Hour, MinInterval: time.Minute},
+			interval: time.Hour,
+		},
+		"no interval": {
+			workers:  1,
+			res:      tracker.AnnounceResponse{},
+			interval: defaultAnnounceInterval,
+		},
+		"no peers connected": {
+			workers:  0,
+			res:      tracker.AnnounceResponse{Interval: time.Hour, MinInterval: time.Minute},
+			interval: time.Minute,
+		},
+	}
+
+	for name, test := range tests {
+		torrent := &Torrent{}
+		torrent.ActiveWorkers.Store(test.workers)
+		assert.Equal(t, test.interval, torrent.announceInterval(&test.res), name)
+	}
+}
+
+func TestAnnounceDHT(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	infoHash := [20]byte{0xAB}
+
+	seeder, err := dht.New(dht.Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	go seeder.Serve(ctx)
+	node, err := dht.New(dht.Config{Addr: "127.0.0.1:0"})
+	require.Nil(t, err)
+	go node.Serve(ctx)
+
+	// the seeder joins through our node and announces itself
+	require.Nil(t, seeder.Bootstrap(ctx, node.Addr().String()))
+	_, err = seeder.Announce(ctx, infoHash, 6889)
+	require.Nil(t, err)
+
+	torrent := &Torrent{
+		InfoHash:   infoHash,
+		DHT:        node,
+		Nodes:      []string{seeder.Addr().String()},
+		Extensions: extension.NewRegistry(),
+		workerC:    make(chan peer.Peer),
+	}
+	go torrent.announceDHT(ctx)
+
+	select {
+	case p := <-torrent.workerC:
+		assert.Equal(t, peer.Peer{IP: net.IP{127, 0, 0, 1}, Port: 6889}, p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no peer from dht")
+	}
+}
+
+// run with -race, the announce goroutine reads the download state while
+// pieces are stored
+func TestAnnounceWhileDownloading(t *testing.T) {
+	events := make(chan string, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer srv.Close()
+
+	pieces := [][]byte{{1, 2, 3, 4}, {5, 6, 7, 8}, {9, 10}}
+	m := &metainfo.MetaInfo{
+		Announce:    [][]string{{srv.URL + "/announce"}},
+		PieceLength: 4,
+		Length:      10,
+		Name:        "test",
+		Files:       []storage.File{{Path: "test", Length: 10}},
+	}
+	for _, p := range pieces {
+		m.PieceHashes = append(m.PieceHashes, sha1.Sum(p))
+	}
+	torrent, err := NewTorrent(m)
+	require.Nil(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- torrent.Download(context.Background(), t.TempDir())
+	}()
+
+	// pieces are stored after the started announce is sent
+	require.Equal(t, "started", <-events)
+	for i, p := range pieces {
+		torrent.resultC <- &pieceResult{i, p}
+		torrent.Announced()
+	}
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("download not finished")
+	}
+	last, _ := torrent.Announced()
+	assert.False(t, last.IsZero())
+	assert.Equal(t, 3, torrent.Downloaded)
+}
@@ -0,0 +1,172 @@
+package torrent
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultUploadSlots is the number of peers unchoked at a time, one of
+	// them is the optimistic unchoke.
+	DefaultUploadSlots = 4
+	// interval of choke rounds
+	chokeInterval = 10 * time.Second
+	// the optimistic unchoke moves on every third round
+	optimisticRounds = 3
+)
+
+// choker unchokes the peers uploading the most to us plus one at random.
+type choker struct {
+	slots      int
+	round      int
+	optimistic *worker
+	// transfer counters of the previous round
+	last map[*worker]int64
+	// peers unchoked since the last round
+	unchoked map[*worker]bool
+}
+
+func newChoker(slots int) *choker {
+	if slots <= 0 {
+		slots = DefaultUploadSlots
+	}
+	return &choker{
+		slots:    slots,
+		last:     make(map[*worker]int64),
+		unchoked: make(map[*worker]bool),
+	}
+}
+
+// rechoke returns the workers to unchoke until the next round.
+func (ch *choker) rechoke(workers []*worker, seeding bool) map[*worker]bool {
+	type candidate struct {
+		w    *worker
+		rate int64
+	}
+
+	var candidates []candidate
+	last := make(map[*worker]int64, len(workers))
+	for _, w := range workers {
+		n := w.downloaded.Load()
+		if seeding {
+			n = w.uploaded.Load()
+		}
+		last[w] = n
+		if w.interested.Load() {
+			candidates = append(candidates, candidate{w, n - ch.last[w]})
+		}
+	}
+	ch.last = last
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].rate > candidates[j].rate
+	})
+
+	unchoked := make(map[*worker]bool)
+	for _, c := range candidates {
+		if len(unchoked) == ch.slots-1 {
+			break
+		}
+		unchoked[c.w] = true
+	}
+
+	// keep the optimistic unchoke for a few rounds while it is interested
+	_, connected := last[ch.optimistic]
+	if ch.round%optimisticRounds == 0 || !connected || unchoked[ch.optimistic] || !ch.optimistic.interested.Load() {
+		ch.optimistic = nil
+		var choked []*worker
+		for _, c := range candidates {
+			if !unchoked[c.w] {
+				choked = append(choked, c.w)
+			}
+		}
+		if len(choked) > 0 {
+			ch.optimistic = choked[rand.Intn(len(choked))]
+		}
+	}
+	if ch.optimistic != nil {
+		unchoked[ch.optimistic] = true
+	}
+	ch.round++
+	ch.unchoked = unchoked
+	return unchoked
+}
+
+// fill returns interested peers to unchoke into the free slots.
+func (ch *choker) fill(workers []*worker) []*worker {
+	connected := make(map[*worker]bool, len(workers))
+	for _, w := range workers {
+		connected[w] = true
+	}
+	for w := range ch.unchoked {
+		if !connected[w] {
+			delete(ch.unchoked, w)
+		}
+	}
+
+	var filled []*worker
+	for _, w := range workers {
+		if len(ch.unchoked) >= ch.slots {
+			break
+		}
+		if w.interested.Load() && !ch.unchoked[w] {
+			ch.unchoked[w] = true
+			filled = append(filled, w)
+		}
+	}
+	return filled
+}
+
+// choke runs a choke round every chokeInterval until ctx is done.
+func (t *Torrent) choke(ctx context.Context) {
+	ch := newChoker(t.UploadSlots)
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.unchokeC:
+			for _, w := range ch.fill(t.connected()) {
+				w.setChoke(false)
+			}
+			continue
+		case <-ctx.Done():
+			return
+		}
+
+		seeding := false
+		select {
+		case <-t.seedC:
+			seeding = true
+		default:
+		}
+
+		workers := t.connected()
+		unchoked := ch.rechoke(workers, seeding)
+		for _, w := range workers {
+			w.setChoke(!unchoked[w])
+		}
+	}
+}
+
+// requestUnchoke wakes the choker to hand out free upload slots.
+func (t *Torrent) requestUnchoke() {
+	select {
+	case t.unchokeC <- struct{}{}:
+	default:
+	}
+}
+
+// connected returns the workers of all connected peers.
+func (t *Torrent) connected() []*worker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	workers := make([]*worker, 0, len(t.workers))
+	for w := range t.workers {
+		workers = append(workers, w)
+	}
+	return workers
+}
@@ -0,0 +1,133 @@
+package torrent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mitander/bitrush/peer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestWorker(downloaded, uploaded int64, interested bool) *worker {
+	w := &worker{c: &peer.Client{}, chokeC: make(chan bool, 1)}
+	w.downloaded.Store(downloaded)
+	w.uploaded.Store(uploaded)
+	w.interested.Store(interested)
+	return w
+}
+
+func TestRechoke(t *testing.T) {
+	fast := newTestWorker(300, 0, true)
+	medium := newTestWorker(200, 10, true)
+	slow := newTestWorker(100, 20, true)
+	leecher := newTestWorker(0, 30, true)
+	idle := newTestWorker(1000, 1000, false)
+	workers := []*worker{slow, idle, leecher, fast, medium}
+
+	tests := map[string]struct {
+		slots   int
+		seeding bool
+		regular []*worker
+	}{
+		"top uploaders to us": {
+			slots:   3,
+			regular: []*worker{fast, medium}, // <- idle is not interested
+		},
+		"fastest downloaders when seeding": {
+			slots:   3,
+			seeding: true,
+			regular: []*worker{leecher, slow},
+		},
+		"single slot is optimistic": {
+			slots:   1,
+			regular: nil,
+		},
+	}
+
+	for name, test := range tests {
+		ch := newChoker(test.slots)
+		unchoked := ch.rechoke(workers, test.seeding)
+		assert.Equal(t, test.slots, len(unchoked), name)
+		for _, w := range test.regular {
+			assert.True(t, unchoked[w], name)
+		}
+		assert.NotNil(t, ch.optimistic, name)
+		assert.NotContains(t, test.regular, ch.optimistic, name)
+		assert.False(t, unchoked[idle], name)
+	}
+}
+
+func TestRechokeRates(t *testing.T) {
+	a := newTestWorker(1000, 0, true)
+	b := newTestWorker(0, 0, true)
+	ch := newChoker(2)
+	ch.rechoke([]*worker{a, b}, false)
+
+	// rates are counted per round, not in total
+	a.downloaded.Add(10)
+	b.downloaded.Add(500)
+	unchoked := ch.rechoke([]*worker{a, b}, false)
+	assert.True(t, unchoked[b])
+}
+
+func TestOptimisticRotation(t *testing.T) {
+	var workers []*worker
+	for i := 0; i < 20; i++ {
+		workers = append(workers, newTestWorker(0, 0, true))
+	}
+	ch := newChoker(1)
+
+	first := ch.rechoke(workers, false)
+	for i := 1; i < optimisticRounds; i++ {
+		assert.Equal(t, first, ch.rechoke(workers, false)) // <- kept between rotations
+	}
+
+	// a not interested optimistic unchoke is replaced right away
+	ch.optimistic.interested.Store(false)
+	previous := ch.optimistic
+	ch.rechoke(workers, false)
+	assert.NotEqual(t, previous, ch.optimistic)
+}
+
+func TestSetChoke(t *testing.T) {
+	w := newTestWorker(0, 0, false)
+	w.setChoke(false)
+	w.setChoke(true) // <- replaces the decision not applied yet
+	assert.True(t, <-w.chokeC)
+	assert.Empty(t, w.chokeC)
+}
+
+func TestFill(t *testing.T) {
+	a := newTestWorker(0, 0, true)
+	b := newTestWorker(0, 0, true)
+	c := newTestWorker(0, 0, false)
+	ch := newChoker(2)
+	ch.rechoke([]*worker{a}, false)
+
+	// a holds one slot, the free one goes to an interested peer
+	assert.Equal(t, []*worker{b}, ch.fill([]*worker{a, c, b}))
+	assert.Empty(t, ch.fill([]*worker{a, b, newTestWorker(0, 0, true)}))
+
+	// slots of disconnected peers are free again
+	c.interested.Store(true)
+	assert.Equal(t, []*worker{c}, ch.fill([]*worker{b, c}))
+}
+
+func TestChokeNewPeer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	torrent := &Torrent{seedC: make(chan struct{}), unchokeC: make(chan struct{}, 1)}
+	go torrent.choke(ctx)
+
+	// an interested peer is unchoked before the first round
+	w := newTestWorker(0, 0, true)
+	torrent.addWorker(w)
+	select {
+	case choke := <-w.chokeC:
+		assert.False(t, choke)
+	case <-time.After(time.Second):
+		t.Fatal("peer not unchoked into a free slot")
+	}
+}
@@ -0,0 +1,154 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mitander/bitrush/handshake"
+	"github.com/mitander/bitrush/mse"
+	"github.com/mitander/bitrush/utp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Listener routes incoming peer connections to torrents by info hash.
+type Listener struct {
+	// Encryption is the policy of inbound connections
+	Encryption mse.Policy
+	listener   net.Listener
+	utp        *utp.Socket
+	torrents   map[[20]byte]*Torrent
+	mu         sync.Mutex
+}
+
+func NewListener(port int) (*Listener, error) {
+	addr := net.JoinHostPort("", strconv.Itoa(port))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "port": port}).Error("failed to start listener")
+		return nil, err
+	}
+
+	// utp takes the same port, also when port 0 picked a random one
+	addr = net.JoinHostPort("", strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+	s, err := utp.Listen(addr)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "port": port}).Warn("not accepting utp connections")
+	}
+
+	return &Listener{
+		listener: l,
+		utp:      s,
+		torrents: make(map[[20]byte]*Torrent),
+	}, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// UTP returns the uTP socket of the listener, nil if it failed to open.
+func (l *Listener) UTP() *utp.Socket {
+	return l.utp
+}
+
+// Register routes connections for the torrent to it.
+func (l *Listener) Register(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.torrents[t.InfoHash] = t
+
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		t.setPort(addr.Port)
+	}
+}
+
+func (l *Listener) Unregister(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.torrents, t.InfoHash)
+}
+
+// Serve accepts connections until ctx is cancelled.
+func (l *Listener) Serve(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		l.listener.Close()
+		if l.utp != nil {
+			l.utp.Close()
+		}
+	}()
+
+	if l.utp != nil {
+		go l.accept(ctx, l.utp)
+	}
+	return l.accept(ctx, l.listener)
+}
+
+func (l *Listener) accept(ctx context.Context, listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.WithFields(log.Fields{"reason": err.Error()}).Debug("failed to accept connection")
+			continue
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	sc, err := mse.Accept(conn, l.infoHashes(), l.Encryption)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "peer": conn.RemoteAddr()}).Debug("failed inbound encryption handshake")
+		conn.Close()
+		return
+	}
+	conn = sc
+
+	// remote peer has 3 seconds to send its handshake
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	hs, err := handshake.ReadHandshake(conn)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "peer": conn.RemoteAddr()}).Debug("failed to read inbound handshake")
+		conn.Close()
+		return
+	}
+
+	l.mu.Lock()
+	t, ok := l.torrents[hs.InfoHash]
+	l.mu.Unlock()
+	if !ok {
+		log.WithFields(log.Fields{"peer": conn.RemoteAddr(), "info_hash": hs.InfoHash}).Debug("rejected inbound connection: unknown info hash")
+		conn.Close()
+		return
+	}
+
+	err = t.accept(conn, hs)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "peer": conn.RemoteAddr()}).Debug("failed to accept inbound peer")
+		return
+	}
+	log.Debugf("accepted inbound peer: %s", conn.RemoteAddr())
+}
+
+// infoHashes returns the info hashes of the registered torrents.
+func (l *Listener) infoHashes() [][20]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	infoHashes := make([][20]byte, 0, len(l.torrents))
+	for ih := range l.torrents {
+		infoHashes = append(infoHashes, ih)
+	}
+	return infoHashes
+}
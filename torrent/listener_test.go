@@ -0,0 +1,166 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mitander/bitrush/bitfield"
+	"github.com/mitander/bitrush/handshake"
+	"github.com/mitander/bitrush/message"
+	"github.com/mitander/bitrush/mse"
+	"github.com/mitander/bitrush/peer"
+	"github.com/mitander/bitrush/utp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListener(t *testing.T) {
+	infoHash := [20]byte{134, 212, 200, 0, 36, 164, 105, 190, 76, 80, 188, 90, 16, 44, 247, 23, 128, 49, 0, 116}
+	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	remoteID := [20]byte{20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+
+	tor := &Torrent{
+		InfoHash:    infoHash,
+		PeerID:      peerID,
+		PieceHashes: make([][20]byte, 3),
+		Bitfield:    bitfield.Bitfield{0b10100000},
+		clientC:     make(chan *peer.Client, 1),
+	}
+
+	l, err := NewListener(0)
+	require.Nil(t, err)
+	l.Register(tor)
+	l.Encryption = mse.PreferEncrypted
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Serve(ctx)
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.Nil(t, err)
+
+	tests := map[string]struct {
+		host     string
+		infoHash [20]byte
+		policy   mse.Policy
+		utp      bool
+		fails    bool
+	}{
+		"registered info hash": {
+			host:     "127.0.0.1",
+			infoHash: infoHash,
+			fails:    false,
+		},
+		"encrypted": {
+			host:     "127.0.0.1",
+			infoHash: infoHash,
+			policy:   mse.RequireEncrypted,
+			fails:    false,
+		},
+		"encrypted unknown info hash": {
+			host:     "127.0.0.1",
+			infoHash: [20]byte{1}, // <- fails here
+			policy:   mse.RequireEncrypted,
+			fails:    true,
+		},
+		"utp": {
+			host:     "127.0.0.1",
+			infoHash: infoHash,
+			policy:   mse.RequireEncrypted,
+			utp:      true,
+			fails:    false,
+		},
+		"ipv6 peer": {
+			host:     "::1",
+			infoHash: infoHash,
+			fails:    false,
+		},
+		"unknown info hash": {
+			host:     "127.0.0.1",
+			infoHash: [20]byte{1}, // <- fails here
+			fails:    true,
+		},
+	}
+
+	s, err := utp.Listen("127.0.0.1:0")
+	require.Nil(t, err)
+	defer s.Close()
+
+	for name, test := range tests {
+		var conn net.Conn
+		if test.utp {
+			conn, err = s.Dial(net.JoinHostPort(test.host, port))
+		} else {
+			conn, err = net.Dial("tcp", net.JoinHostPort(test.host, port))
+		}
+		if err != nil && test.host == "::1" {
+			continue // ipv6 loopback not available
+		}
+		require.Nil(t, err, name)
+		if test.policy != mse.Plaintext {
+			ec, err := mse.Initiate(conn, test.infoHash, test.policy)
+			if test.fails {
+				assert.Error(t, err, name)
+				conn.Close()
+				continue
+			}
+			require.Nil(t, err, name)
+			conn = ec
+		}
+
+		hs := handshake.NewHandshake(test.infoHash, remoteID)
+		res, err := hs.Send(conn)
+		if test.fails {
+			assert.Error(t, err, name)
+			conn.Close()
+			continue
+		}
+		require.Nil(t, err, name)
+		assert.Equal(t, peerID, res.PeerID, name)
+
+		bf, err := bitfield.RecvBitfield(conn)
+		require.Nil(t, err, name)
+		assert.Equal(t, tor.Bitfield, bf, name)
+
+		remote := bitfield.Bitfield{0b01000000}
+		_, err = conn.Write((&message.Message{ID: message.MsgBitfield, Payload: remote}).Serialize())
+		require.Nil(t, err, name)
+
+		select {
+		case c := <-tor.clientC:
+			assert.Equal(t, remote, c.Bitfield, name)
+			assert.True(t, net.ParseIP(test.host).Equal(c.Peer().IP), name)
+			assert.Equal(t, remoteID, c.ID, name)
+			assert.Empty(t, tor.Peers, name) // <- source port is not reachable
+			c.Conn.Close()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: connection not handed to torrent", name)
+		}
+		conn.Close()
+	}
+}
+
+func TestAcceptConnectedPeer(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	remoteID := [20]byte{1, 2, 3}
+
+	// the peer was reached through a tracker already
+	tor := &Torrent{PeerID: [20]byte{4, 5, 6}, clientC: make(chan *peer.Client, 1)}
+	require.Nil(t, tor.addWorker(&worker{c: &peer.Client{ID: remoteID}}))
+	assert.ErrorIs(t, tor.addWorker(&worker{c: &peer.Client{ID: remoteID}}), errPeerConnected)
+
+	err := tor.accept(local, handshake.NewHandshake([20]byte{}, remoteID)) // <- fails here
+	assert.ErrorIs(t, err, errPeerConnected)
+
+	// the duplicate connection is closed
+	_, err = remote.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	// connections to ourselves are refused as well
+	local, remote = net.Pipe()
+	defer remote.Close()
+	assert.ErrorIs(t, tor.accept(local, handshake.NewHandshake([20]byte{}, tor.PeerID)), errPeerConnected)
+}
@@ -0,0 +1,120 @@
+package torrent
+
+import (
+	"time"
+
+	"github.com/mitander/bitrush/picker"
+)
+
+const (
+	// DefaultMinRequests is the floor of outstanding block requests per peer.
+	DefaultMinRequests = 2
+	// DefaultMaxRequests is the ceiling of outstanding block requests per peer.
+	DefaultMaxRequests = 250
+	// outstanding requests before the download rate of a peer is known
+	initialRequests = 5
+	// seconds of download the outstanding requests should cover
+	requestQueueTime = 3 * time.Second
+	// the download rate is sampled at most once per interval
+	rateInterval = time.Second
+)
+
+// pipeline adapts the number of outstanding requests to rate and latency.
+type pipeline struct {
+	min   int
+	max   int
+	depth int
+	// smoothed download rate in bytes per second and round trip time
+	rate float64
+	rtt  time.Duration
+	// request measuring the round trip time and when it was sent
+	probe     picker.Block
+	probeSent time.Time
+	// bytes received since the start of the current rate sample
+	sampleStart time.Time
+	sampleBytes int
+}
+
+// newPipeline creates a pipeline, zero values use the defaults.
+func newPipeline(min, max int) *pipeline {
+	if min <= 0 {
+		min = DefaultMinRequests
+	}
+	if max <= 0 {
+		max = DefaultMaxRequests
+	}
+	if max < min {
+		max = min
+	}
+	return &pipeline{
+		min:   min,
+		max:   max,
+		depth: clamp(initialRequests, min, max),
+	}
+}
+
+// sent records a request for b with the number of requests outstanding.
+func (p *pipeline) sent(now time.Time, b picker.Block, outstanding int) {
+	if outstanding == 0 {
+		p.probe = b
+		p.probeSent = now
+	}
+}
+
+// received records a block of n bytes that arrived for the request b.
+func (p *pipeline) received(now time.Time, b picker.Block, n int) {
+	if b == p.probe {
+		rtt := now.Sub(p.probeSent)
+		if p.rtt == 0 {
+			p.rtt = rtt
+		} else {
+			p.rtt += (rtt - p.rtt) / 8
+		}
+		p.probe = picker.Block{}
+	}
+
+	if p.sampleStart.IsZero() {
+		// the rate is measured between blocks, starting at the first one
+		p.sampleStart = now
+		return
+	}
+	p.sampleBytes += n
+	elapsed := now.Sub(p.sampleStart)
+	if elapsed < rateInterval {
+		return
+	}
+
+	sample := float64(p.sampleBytes) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = sample
+	} else {
+		p.rate += (sample - p.rate) / 4
+	}
+	p.sampleStart = now
+	p.sampleBytes = 0
+
+	window := requestQueueTime
+	if 2*p.rtt > window {
+		window = 2 * p.rtt
+	}
+	depth := int(p.rate*window.Seconds()/picker.BlockSize) + 1
+	p.depth = clamp(depth, p.min, p.max)
+}
+
+// size returns the number of requests to keep outstanding.
+func (p *pipeline) size(limit int) int {
+	if limit > 0 && limit < p.depth {
+		return limit
+	}
+	return p.depth
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
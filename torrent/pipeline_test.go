@@ -0,0 +1,102 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mitander/bitrush/picker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeline(t *testing.T) {
+	tests := map[string]struct {
+		min    int
+		max    int
+		rate   int // blocks per second
+		rtt    time.Duration
+		limit  int
+		output int
+	}{
+		"defaults before first sample": {
+			rate:   0,
+			output: initialRequests,
+		},
+		"covers queue time": {
+			rate:   20,
+			rtt:    50 * time.Millisecond,
+			output: 61, // <- 20 blocks/s for 3 seconds plus one
+		},
+		"covers two round trips": {
+			rate:   20,
+			rtt:    4 * time.Second,
+			output: 161, // <- 20 blocks/s for 8 seconds plus one
+		},
+		"slow peer floor": {
+			min:    4,
+			rate:   1,
+			rtt:    100 * time.Millisecond,
+			output: 4,
+		},
+		"fast peer ceiling": {
+			max:    100,
+			rate:   1000,
+			rtt:    100 * time.Millisecond,
+			output: 100,
+		},
+		"peer reqq": {
+			rate:   1000,
+			rtt:    100 * time.Millisecond,
+			limit:  30,
+			output: 30,
+		},
+	}
+
+	for name, test := range tests {
+		p := newPipeline(test.min, test.max)
+		now := time.Now()
+		// steady download for a few seconds, every request sent to an
+		// idle queue
+		for i := 0; i < 5*test.rate; i++ {
+			now = now.Add(time.Second / time.Duration(test.rate))
+			b := picker.Block{Index: i, Length: picker.BlockSize}
+			p.sent(now.Add(-test.rtt), b, 0)
+			p.received(now, b, picker.BlockSize)
+		}
+		assert.Equal(t, test.output, p.size(test.limit), name)
+	}
+}
+
+func TestPipelineQueued(t *testing.T) {
+	// the peer serves 20 blocks/s in request order after 50ms of latency,
+	// queued requests wait for the ones before them
+	const rate = 20
+	latency := 50 * time.Millisecond
+	p := newPipeline(0, 0)
+	now := time.Now()
+	var queue []picker.Block
+	var due []time.Time
+	next := 0
+
+	depths := map[int]int{}
+	for step := 0; step < 60*rate; step++ {
+		for len(queue) < p.size(0) {
+			b := picker.Block{Index: next, Length: picker.BlockSize}
+			next++
+			p.sent(now, b, len(queue))
+			arrival := now.Add(latency)
+			if len(due) > 0 && due[len(due)-1].After(arrival) {
+				arrival = due[len(due)-1]
+			}
+			queue = append(queue, b)
+			due = append(due, arrival.Add(time.Second/rate))
+		}
+		now = due[0]
+		p.received(now, queue[0], picker.BlockSize)
+		queue, due = queue[1:], due[1:]
+		depths[step/rate] = p.size(0)
+	}
+
+	// the depth covers the queue time and does not climb to the ceiling
+	assert.Equal(t, 61, depths[20])
+	assert.Equal(t, 61, depths[59])
+}
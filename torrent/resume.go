@@ -0,0 +1,177 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/mitander/bitrush/bitfield"
+	"github.com/mitander/bitrush/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// resumeData is persisted on shutdown so a restart can skip rehashing.
+type resumeData struct {
+	InfoHash [20]byte
+	Bitfield bitfield.Bitfield
+	Files    []storage.FileInfo
+}
+
+// verifyStorage is the part of the storage worker used to resume a download.
+type verifyStorage interface {
+	blockStorage
+	Stat() ([]storage.FileInfo, error)
+}
+
+// resume marks the pieces already stored on disk as downloaded.
+func (t *Torrent) resume(ctx context.Context, s verifyStorage) error {
+	if bf, ok := t.loadResume(s); ok {
+		t.mu.Lock()
+		copy(t.Bitfield, bf)
+		t.mu.Unlock()
+		log.Debug("resumed download from resume file")
+	} else {
+		err := t.verify(ctx, s)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	t.Downloaded = 0
+	for i := range t.PieceHashes {
+		if t.Bitfield.HasPiece(i) {
+			t.Downloaded++
+		}
+	}
+	t.Progress = float64(t.Downloaded) / float64(len(t.PieceHashes)) * 100
+	downloaded, progress := t.Downloaded, t.Progress
+	t.mu.Unlock()
+
+	if downloaded > 0 {
+		log.Infof("Resuming download: %0.2f%% already downloaded", progress)
+	}
+	return nil
+}
+
+// verify hashes the stored pieces in parallel and marks the valid ones.
+func (t *Torrent) verify(ctx context.Context, s blockStorage) error {
+	indexC := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexC {
+				begin, end := t.pieceBounds(index)
+				buf, err := s.Read(begin, end-begin)
+				if err != nil {
+					// file is missing data for the piece
+					continue
+				}
+
+				hash := sha1.Sum(buf)
+				if !bytes.Equal(hash[:], t.PieceHashes[index][:]) {
+					continue
+				}
+
+				t.mu.Lock()
+				t.Bitfield.SetPiece(index)
+				t.mu.Unlock()
+			}
+		}()
+	}
+
+	var err error
+	for index := range t.PieceHashes {
+		select {
+		case indexC <- index:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(indexC)
+	wg.Wait()
+	return err
+}
+
+func (t *Torrent) loadResume(s verifyStorage) (bitfield.Bitfield, bool) {
+	if t.ResumeFile == "" {
+		return nil, false
+	}
+
+	buf, err := os.ReadFile(t.ResumeFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithFields(log.Fields{"reason": err.Error(), "path": t.ResumeFile}).Warn("failed to read resume file")
+		}
+		return nil, false
+	}
+
+	rd := resumeData{}
+	err = json.Unmarshal(buf, &rd)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "path": t.ResumeFile}).Warn("failed to parse resume file")
+		return nil, false
+	}
+
+	files, err := s.Stat()
+	if err != nil {
+		return nil, false
+	}
+
+	if rd.InfoHash != t.InfoHash || len(rd.Bitfield) != len(t.Bitfield) || !sameFiles(rd.Files, files) {
+		log.WithFields(log.Fields{"path": t.ResumeFile}).Debug("resume file is outdated, verifying stored pieces")
+		return nil, false
+	}
+	return rd.Bitfield, true
+}
+
+func (t *Torrent) saveResume(s verifyStorage) error {
+	if t.ResumeFile == "" {
+		return nil
+	}
+
+	files, err := s.Stat()
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(resumeData{
+		InfoHash: t.InfoHash,
+		Bitfield: t.bitfield(),
+		Files:    files,
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(t.ResumeFile, buf, 0644)
+}
+
+// saveResumeOrWarn saves the resume file, logging a failure.
+func (t *Torrent) saveResumeOrWarn(s verifyStorage) {
+	err := t.saveResume(s)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "path": t.ResumeFile}).Warn("failed to save resume file")
+	}
+}
+
+func sameFiles(a, b []storage.FileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Size != b[i].Size || !a[i].ModTime.Equal(b[i].ModTime) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mitander/bitrush/bitfield"
+	"github.com/mitander/bitrush/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testResumeStorage struct {
+	testStorage
+	files []storage.FileInfo
+}
+
+func (s *testResumeStorage) Stat() ([]storage.FileInfo, error) {
+	return s.files, nil
+}
+
+func newResumeTorrent(data []byte, pieceLength int) *Torrent {
+	var hashes [][20]byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha1.Sum(data[begin:end]))
+	}
+	return &Torrent{
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: hashes,
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Bitfield:    make(bitfield.Bitfield, (len(hashes)+7)/8),
+	}
+}
+
+func TestVerify(t *testing.T) {
+	data := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	torrent := newResumeTorrent(data, 4)
+
+	// second piece is corrupt on disk
+	stored := testStorage{0, 1, 2, 3, 4, 0, 0, 7, 8, 9}
+	err := torrent.verify(context.Background(), stored)
+	assert.Nil(t, err)
+	assert.Equal(t, bitfield.Bitfield{0b10100000}, torrent.Bitfield)
+}
+
+func TestResume(t *testing.T) {
+	data := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	modTime := time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC)
+	stored := &testResumeStorage{
+		testStorage: testStorage(data),
+		files:       []storage.FileInfo{{Size: 10, ModTime: modTime}},
+	}
+
+	path := filepath.Join(t.TempDir(), ".test.resume")
+	torrent := newResumeTorrent(data, 4)
+	torrent.ResumeFile = path
+	torrent.Bitfield.SetPiece(0)
+	err := torrent.saveResume(stored)
+	require.Nil(t, err)
+
+	// failed writes are reported, e.g. for a missing out dir
+	missing := newResumeTorrent(data, 4)
+	missing.ResumeFile = filepath.Join(t.TempDir(), "missing", ".test.resume")
+	assert.Error(t, missing.saveResume(stored))
+
+	tests := map[string]struct {
+		files      []storage.FileInfo
+		downloaded int
+	}{
+		"files unchanged": {
+			// resume file is trusted, stored pieces are not hashed
+			files:      []storage.FileInfo{{Size: 10, ModTime: modTime}},
+			downloaded: 1,
+		},
+		"files changed": {
+			// stored pieces are hashed again
+			files:      []storage.FileInfo{{Size: 10, ModTime: modTime.Add(time.Second)}},
+			downloaded: 3,
+		},
+	}
+
+	for name, test := range tests {
+		stored.files = test.files
+		torrent := newResumeTorrent(data, 4)
+		torrent.ResumeFile = path
+		err := torrent.resume(context.Background(), stored)
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.downloaded, torrent.Downloaded, name)
+	}
+}
@@ -1,23 +1,33 @@
 package torrent
 
 import (
-	"bytes"
 	"context"
 	"crypto/rand"
-	"crypto/sha1"
 	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mitander/bitrush/bitfield"
+	"github.com/mitander/bitrush/dht"
+	"github.com/mitander/bitrush/extension"
+	"github.com/mitander/bitrush/handshake"
 	"github.com/mitander/bitrush/metainfo"
+	"github.com/mitander/bitrush/mse"
 	"github.com/mitander/bitrush/peer"
+	"github.com/mitander/bitrush/pex"
+	"github.com/mitander/bitrush/picker"
 	"github.com/mitander/bitrush/storage"
 	"github.com/mitander/bitrush/tracker"
+	"github.com/mitander/bitrush/utp"
 	log "github.com/sirupsen/logrus"
 )
 
 type PeerID [20]byte
 
-func newPeerID() (PeerID, error) {
+// NewPeerID creates a random peer id with the bitrush client prefix.
+func NewPeerID() (PeerID, error) {
 	var peerID PeerID
 	copy(peerID[:8], "-BR0001-")
 	_, err := rand.Read(peerID[8:])
@@ -33,76 +43,109 @@ type pieceResult struct {
 	buf   []byte
 }
 
-type pieceWork struct {
-	index  int
-	hash   [20]byte
-	length int
-}
-
-func (p *pieceWork) validate(buf []byte) error {
-	hash := sha1.Sum(buf)
-	if !bytes.Equal(hash[:], p.hash[:]) {
-		return errors.New("piece work validation failed")
-	}
-	return nil
+// blockStorage is the part of the storage worker used to serve blocks.
+type blockStorage interface {
+	Read(index, length int) ([]byte, error)
 }
 
 type Torrent struct {
-	Trackers        []tracker.Tracker
-	Peers           []peer.Peer
-	PeerID          [20]byte
-	InfoHash        [20]byte
-	PieceHashes     [][20]byte
-	PieceLength     int
-	Length          int
-	Name            string
-	Files           []storage.File
-	LastPeerRequest time.Time
+	Trackers    *tracker.TierList
+	Peers       []peer.Peer
+	PeerID      [20]byte
+	InfoHash    [20]byte
+	PieceHashes [][20]byte
+	PieceLength int
+	Length      int
+	Name        string
+	Files       []storage.File
+	// announce times, transfer counters and Bitfield are guarded by mu
+	// while downloading
+	LastAnnounce    time.Time
+	NextAnnounce    time.Time
 	Progress        float64
 	Downloaded      int
-	downloadC       chan *pieceWork
-	resultC         chan *pieceResult
-	workerC         chan peer.Peer
-	ActiveWorkers   uint
+	DownloadedBytes int
+	Uploaded        int
+	SeedRatio       float64
+	SeedTime        time.Duration
+	ResumeFile      string
+	// floor and ceiling of outstanding block requests per peer, zero
+	// values use DefaultMinRequests and DefaultMaxRequests
+	MinRequests int
+	MaxRequests int
+	// peers unchoked at a time, zero uses DefaultUploadSlots
+	UploadSlots int
+	// Encryption is the policy of outbound connections
+	Encryption mse.Policy
+	// UTP dials peers over uTP before falling back to TCP when set
+	UTP *utp.Socket
+	// DHT finds peers besides the trackers when set, Nodes of the torrent
+	// are used to join it
+	DHT   *dht.DHT
+	Nodes []string
+	// Extensions are offered to peers supporting the extension protocol
+	Extensions    *extension.Registry
+	Bitfield      bitfield.Bitfield
+	storage       blockStorage
+	picker        *picker.Picker
+	seedC         chan struct{}
+	resultC       chan *pieceResult
+	workerC       chan peer.Peer
+	clientC       chan *peer.Client
+	workers       map[*worker]struct{}
+	pex           *pex.PEX
+	peerC         chan []peer.Peer
+	unchokeC      chan struct{}
+	port          int
+	ActiveWorkers atomic.Int64
+	mu            sync.Mutex
 }
 
 func NewTorrent(m *metainfo.MetaInfo) (*Torrent, error) {
-	id, err := newPeerID()
+	id, err := NewPeerID()
 	if err != nil {
 		return nil, err
 	}
 
-	var trackers []tracker.Tracker
 	var peers []peer.Peer
-	for i := range m.Announce {
-		tr, err := tracker.NewTracker(m.Announce[i], m.Length, m.InfoHash, id)
-		if err != nil {
-			return nil, err
-		}
-		trackers = append(trackers, tr)
+	trackers := tracker.NewTierList(m.Announce, m.InfoHash, id)
+	if trackers.Len() == 0 {
+		log.WithFields(log.Fields{"name": m.Name}).Warn("no usable trackers")
 	}
 
 	t := &Torrent{
-		Trackers:      trackers,
-		Peers:         peers,
-		PeerID:        id,
-		InfoHash:      m.InfoHash,
-		PieceHashes:   m.PieceHashes,
-		PieceLength:   m.PieceLength,
-		Length:        m.Length,
-		Name:          m.Name,
-		Files:         m.Files,
-		downloadC:     make(chan *pieceWork, len(m.PieceHashes)),
-		resultC:       make(chan *pieceResult),
-		workerC:       make(chan peer.Peer),
-		ActiveWorkers: 0,
+		Trackers:    trackers,
+		Peers:       peers,
+		PeerID:      id,
+		InfoHash:    m.InfoHash,
+		PieceHashes: m.PieceHashes,
+		PieceLength: m.PieceLength,
+		Length:      m.Length,
+		Name:        m.Name,
+		Files:       m.Files,
+		Nodes:       m.Nodes,
+		Bitfield:    make(bitfield.Bitfield, (len(m.PieceHashes)+7)/8),
+		resultC:     make(chan *pieceResult),
+		workerC:     make(chan peer.Peer),
+		clientC:     make(chan *peer.Client),
+		seedC:       make(chan struct{}),
+		Extensions:  extension.NewRegistry(),
+		peerC:       make(chan []peer.Peer, 16),
+		unchokeC:    make(chan struct{}, 1),
 	}
 
+	t.Extensions.Port = t.Port
+	t.pex = pex.New(t.AddPeers)
+	err = t.Extensions.Register(t.pex)
+	if err != nil {
+		return nil, err
+	}
 	return t, nil
 }
 
-func (t *Torrent) Download(path string) error {
-	ctx, cancel := context.WithCancel(context.Background())
+// Download downloads the torrent to path and seeds it if configured.
+func (t *Torrent) Download(ctx context.Context, path string) error {
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	sw, err := storage.NewStorageWorker(ctx, path, t.Files)
@@ -110,29 +153,59 @@ func (t *Torrent) Download(path string) error {
 		return err
 	}
 	go sw.StartWorker()
+	t.storage = sw
 
-	go func() {
-		for index, hash := range t.PieceHashes {
-			begin, end := t.pieceBounds(index)
-			length := end - begin
-			t.downloadC <- &pieceWork{index, hash, length}
-		}
-	}()
+	err = t.resume(ctx, sw)
+	if err != nil {
+		return err
+	}
+
+	t.picker = picker.NewPicker(t.Length, t.PieceLength, t.bitfield())
 
 	log.Info("Download started")
 
-	go t.requestPeers(ctx)
+	// wait for the stopped announce before returning
+	announced := make(chan struct{})
+	defer func() {
+		cancel()
+		<-announced
+	}()
+	go func() {
+		t.announce(ctx)
+		close(announced)
+	}()
+	if t.DHT != nil {
+		go t.announceDHT(ctx)
+	}
 	go t.peerDownload(ctx)
+	go t.choke(ctx)
 
 	for t.Downloaded < len(t.PieceHashes) {
-		res := <-t.resultC
+		var res *pieceResult
+		select {
+		case res = <-t.resultC:
+		case <-ctx.Done():
+			t.saveResumeOrWarn(sw)
+			return ctx.Err()
+		}
 		begin, _ := t.pieceBounds(res.index)
 
-		sw.AddWork(res.buf, begin)
+		err = sw.AddWork(res.buf, begin)
+		if err != nil {
+			log.Errorf("failed to store piece %d: %s", res.index, err.Error())
+			return err
+		}
 
+		t.mu.Lock()
+		t.Bitfield.SetPiece(res.index)
+		t.DownloadedBytes += len(res.buf)
 		t.Downloaded++
 		t.Progress = float64(t.Downloaded) / float64(len(t.PieceHashes)) * 100
-		log.Debugf("Downloaded: %0.2f%% - Peers: %d", t.Progress, t.ActiveWorkers)
+		progress := t.Progress
+		t.mu.Unlock()
+
+		t.broadcastHave(res.index)
+		log.Debugf("Downloaded: %0.2f%% - Peers: %d", progress, t.ActiveWorkers.Load())
 	}
 
 	err = sw.Complete()
@@ -140,71 +213,188 @@ func (t *Torrent) Download(path string) error {
 		log.Errorf("failed to complete storage work: %s", err.Error())
 		return err
 	}
+	t.saveResumeOrWarn(sw)
 
+	close(t.seedC)
+	t.seed(ctx)
 	return nil
 }
 
-func (t *Torrent) peerDownload(ctx context.Context) {
+// seed serves peers until the upload ratio or seed time is reached.
+func (t *Torrent) seed(ctx context.Context) {
+	if t.SeedRatio <= 0 && t.SeedTime <= 0 {
+		return
+	}
+	log.Info("Seeding started")
+
+	var deadline <-chan time.Time
+	if t.SeedTime > 0 {
+		deadline = time.After(t.SeedTime)
+	}
+
 	for {
 		select {
-		case p := <-t.workerC:
-			go t.startWorker(ctx, p)
+		case <-deadline:
+			log.Infof("Seeding finished: seed time %s reached", t.SeedTime)
+			return
 		case <-ctx.Done():
 			return
+		case <-time.After(time.Second):
+			t.mu.Lock()
+			ratio := float64(t.Uploaded) / float64(t.Length)
+			t.mu.Unlock()
+			if t.SeedRatio > 0 && ratio >= t.SeedRatio {
+				log.Infof("Seeding finished: ratio %0.2f reached", ratio)
+				return
+			}
 		}
 	}
 }
 
-func (t *Torrent) startWorker(ctx context.Context, p peer.Peer) {
-	cooldown := 5 * time.Second
-	c, err := peer.NewClient(p, t.PeerID, t.InfoHash)
+// ReadBlock reads a block of a piece we have to serve it to a peer.
+func (t *Torrent) ReadBlock(index, begin, length int) ([]byte, error) {
+	t.mu.Lock()
+	has := t.Bitfield.HasPiece(index)
+	t.mu.Unlock()
+	if !has {
+		return nil, errors.New("piece not downloaded")
+	}
+
+	pieceBegin, pieceEnd := t.pieceBounds(index)
+	if begin < 0 || length <= 0 || pieceBegin+begin+length > pieceEnd {
+		return nil, errors.New("block out of piece bounds")
+	}
+
+	block, err := t.storage.Read(pieceBegin+begin, length)
 	if err != nil {
-		time.Sleep(cooldown)
-		t.workerC <- p
-		return
+		return nil, err
 	}
-	defer c.Conn.Close()
-	t.ActiveWorkers++
 
-	c.SendUnchoke()
-	c.SendInterested()
+	t.mu.Lock()
+	t.Uploaded += length
+	t.mu.Unlock()
+	return block, nil
+}
 
-	for {
-		select {
-		case pw := <-t.downloadC:
-			if !c.Bitfield.HasPiece(pw.index) {
-				t.downloadC <- pw
-				log.Debugf("putting piece '%d' back in queue: not in bitfield", pw.index)
-				time.Sleep(cooldown)
-				continue
-			}
+var errPeerConnected = errors.New("peer is connected already")
 
-			buf, err := c.DownloadPiece(pw.index, pw.length)
-			if err != nil {
-				t.downloadC <- pw
-				log.WithFields(log.Fields{"reason": err.Error(), "index": pw.index}).Debug("putting piece back in queue")
-				time.Sleep(cooldown)
-				continue
-			}
+// connectedTo reports whether a worker runs for the peer id, or it is ours.
+func (t *Torrent) connectedTo(id [20]byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.connectedToLocked(id)
+}
 
-			err = pw.validate(buf)
-			if err != nil {
-				t.downloadC <- pw
-				log.WithFields(log.Fields{"reason": err.Error(), "index": pw.index}).Debug("putting piece back in queue")
-				time.Sleep(cooldown)
-				continue
-			}
+func (t *Torrent) connectedToLocked(id [20]byte) bool {
+	if id == ([20]byte{}) {
+		return false
+	}
+	if id == t.PeerID {
+		return true
+	}
+	for w := range t.workers {
+		if w.c.ID == id {
+			return true
+		}
+	}
+	return false
+}
 
-			c.SendHave(pw.index)
-			t.resultC <- &pieceResult{pw.index, buf}
+// addWorker registers the worker, it fails if the peer is connected already.
+func (t *Torrent) addWorker(w *worker) error {
+	t.mu.Lock()
+	if t.connectedToLocked(w.c.ID) {
+		t.mu.Unlock()
+		return errPeerConnected
+	}
+	if t.workers == nil {
+		t.workers = make(map[*worker]struct{})
+	}
+	t.workers[w] = struct{}{}
+	t.mu.Unlock()
+	t.requestUnchoke()
+	return nil
+}
 
+func (t *Torrent) removeWorker(w *worker) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.workers, w)
+}
+
+// Port returns the port we accept peers on, zero when not accepting.
+func (t *Torrent) Port() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.port
+}
+
+func (t *Torrent) setPort(port int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.port = port
+}
+
+// broadcastHave tells every connected peer about a piece we stored.
+func (t *Torrent) broadcastHave(index int) {
+	for _, w := range t.connected() {
+		w.have(index)
+	}
+}
+
+// AddPeers hands peers found besides the trackers to the download.
+func (t *Torrent) AddPeers(peers []peer.Peer) {
+	select {
+	case t.peerC <- peers:
+	default:
+	}
+}
+
+func (t *Torrent) peerDownload(ctx context.Context) {
+	for {
+		select {
+		case p := <-t.workerC:
+			go t.startWorker(ctx, p)
+		case c := <-t.clientC:
+			go t.runWorker(ctx, c)
+		case peers := <-t.peerC:
+			go t.addPeers(ctx, peers)
 		case <-ctx.Done():
-			t.ActiveWorkers--
 			return
 		}
 	}
 }
 
+// bitfield returns a copy of the pieces we have, safe to send to peers.
+func (t *Torrent) bitfield() bitfield.Bitfield {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bf := make(bitfield.Bitfield, len(t.Bitfield))
+	copy(bf, t.Bitfield)
+	return bf
+}
+
+// accept completes an inbound connection routed to the torrent.
+func (t *Torrent) accept(conn net.Conn, hs *handshake.Handshake) error {
+	if t.connectedTo(hs.PeerID) {
+		conn.Close()
+		return errPeerConnected
+	}
+
+	c, err := peer.AcceptClient(conn, hs, t.PeerID, t.InfoHash, t.bitfield(), len(t.PieceHashes), t.Extensions)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case t.clientC <- c:
+		return nil
+	case <-time.After(5 * time.Second):
+		c.Conn.Close()
+		return errors.New("torrent is not accepting peers")
+	}
+}
+
 func (t *Torrent) pieceBounds(index int) (begin int, end int) {
 	begin = index * t.PieceLength
 	end = begin + t.PieceLength
@@ -214,27 +404,13 @@ func (t *Torrent) pieceBounds(index int) (begin int, end int) {
 	return begin, end
 }
 
-func (t *Torrent) requestPeers(ctx context.Context) {
-	for {
-		select {
-		// request new peers from trackers every 5 seconds
-		case <-time.After(time.Until(t.LastPeerRequest.Add(5 * time.Second))):
-			for _, tr := range t.Trackers {
-				peers, err := tr.RequestPeers()
-				if err != nil {
-					continue
-				}
-				peers = t.filterUnique(peers)
-				t.Peers = append(t.Peers, peers...)
-				log.Debugf("added %d peers, total peers: %d", len(peers), len(t.Peers))
-
-				for _, p := range peers {
-					t.workerC <- p
-				}
-			}
-			t.LastPeerRequest = time.Now()
-
-		case <-ctx.Done():
+// removePeer forgets a peer that is no longer connected.
+func (t *Torrent) removePeer(p peer.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, kp := range t.Peers {
+		if kp.String() == p.String() {
+			t.Peers = append(t.Peers[:i], t.Peers[i+1:]...)
 			return
 		}
 	}
@@ -4,6 +4,7 @@ import (
 	"net"
 	"testing"
 
+	"github.com/mitander/bitrush/bitfield"
 	"github.com/mitander/bitrush/peer"
 	"github.com/stretchr/testify/assert"
 )
@@ -99,3 +100,68 @@ func TestPieceBounds(t *testing.T) {
 		assert.Equal(t, test.end, end, name)
 	}
 }
+
+type testStorage []byte
+
+func (s testStorage) Read(index, length int) ([]byte, error) {
+	return s[index : index+length], nil
+}
+
+func TestReadBlock(t *testing.T) {
+	data := testStorage{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	tests := map[string]struct {
+		index  int
+		begin  int
+		length int
+		output []byte
+		fails  bool
+	}{
+		"correct input": {
+			index:  1,
+			begin:  1,
+			length: 2,
+			output: []byte{5, 6},
+		},
+		"last piece": {
+			index:  2,
+			begin:  0,
+			length: 2,
+			output: []byte{8, 9},
+		},
+		"piece not downloaded": {
+			index:  0, // <- fails here
+			begin:  0,
+			length: 2,
+			fails:  true,
+		},
+		"block out of bounds": {
+			index:  2,
+			begin:  1,
+			length: 2, // <- fails here: last piece is 2 bytes
+			fails:  true,
+		},
+	}
+
+	for name, test := range tests {
+		torrent := &Torrent{Length: 10, PieceLength: 4, Bitfield: bitfield.Bitfield{0b01100000}, storage: data}
+		block, err := torrent.ReadBlock(test.index, test.begin, test.length)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			assert.Equal(t, 0, torrent.Uploaded, name)
+			continue
+		}
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, block, name)
+		assert.Equal(t, test.length, torrent.Uploaded, name)
+	}
+}
+
+func TestRemovePeer(t *testing.T) {
+	a := peer.Peer{IP: net.IP{192, 168, 1, 0}, Port: 1337}
+	b := peer.Peer{IP: net.IP{192, 168, 1, 1}, Port: 1337}
+	torrent := &Torrent{Peers: []peer.Peer{a, b}}
+
+	torrent.removePeer(a)
+	assert.Equal(t, []peer.Peer{b}, torrent.Peers)
+	assert.Equal(t, []peer.Peer{a}, torrent.filterUnique([]peer.Peer{a, b}))
+}
@@ -0,0 +1,416 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mitander/bitrush/bitfield"
+	"github.com/mitander/bitrush/message"
+	"github.com/mitander/bitrush/mse"
+	"github.com/mitander/bitrush/peer"
+	"github.com/mitander/bitrush/pex"
+	"github.com/mitander/bitrush/picker"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// requests not answered in time are given back to the picker
+	requestTimeout = 30 * time.Second
+	// interval of the request timeout and endgame cancel checks
+	tickInterval = time.Second
+	// peers that can not be reached are dropped after this many dials
+	maxDialAttempts = 3
+	// wait between dials of an unreachable peer
+	dialCooldown = 5 * time.Second
+)
+
+// worker is the download state of a single peer connection.
+type worker struct {
+	t           *Torrent
+	c           *peer.Client
+	key         string
+	downloading bool
+	// outstanding block requests and when they were sent
+	requests map[picker.Block]time.Time
+	pipeline *pipeline
+	// transfer counters and interest of the peer read by the choker
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	interested atomic.Bool
+	// choke decisions of the choker
+	chokeC chan bool
+	// pieces we got since the last have messages to the peer
+	haves  []int
+	haveC  chan struct{}
+	haveMu sync.Mutex
+}
+
+func (t *Torrent) startWorker(ctx context.Context, p peer.Peer) {
+	defer t.removePeer(p)
+	c, err := t.dial(ctx, p)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "peer": p.String()}).Debug("dropping unreachable peer")
+		return
+	}
+	if t.connectedTo(c.ID) {
+		c.Conn.Close()
+		return
+	}
+
+	// peers we reached are passed on through peer exchange
+	if t.pex != nil {
+		flags := pex.FlagReachable
+		if bytes.Equal(c.Bitfield, bitfield.Full(len(t.PieceHashes))) {
+			flags |= pex.FlagSeed
+		}
+		if ec, ok := c.Conn.(*mse.Conn); ok && ec.Encrypted {
+			flags |= pex.FlagEncryption
+		}
+		if c.Conn.RemoteAddr().Network() == "udp" {
+			flags |= pex.FlagUTP
+		}
+		t.pex.Connected(p, flags)
+		defer t.pex.Disconnected(p)
+	}
+	t.runWorker(ctx, c)
+}
+
+// dial connects to the peer, up to maxDialAttempts times.
+func (t *Torrent) dial(ctx context.Context, p peer.Peer) (*peer.Client, error) {
+	d := &peer.Dialer{Encryption: t.Encryption, UTP: t.UTP}
+	for attempt := 1; ; attempt++ {
+		c, err := peer.NewClient(p, t.PeerID, t.InfoHash, t.bitfield(), len(t.PieceHashes), t.Extensions, d)
+		if err == nil || attempt == maxDialAttempts {
+			return c, err
+		}
+
+		select {
+		case <-time.After(dialCooldown):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// runWorker exchanges blocks with a connected peer until ctx is done.
+func (t *Torrent) runWorker(ctx context.Context, c *peer.Client) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer c.Conn.Close()
+	if c.Extensions != nil {
+		defer c.Extensions.Close()
+	}
+	t.ActiveWorkers.Add(1)
+	defer t.ActiveWorkers.Add(-1)
+	c.Blocks = t
+
+	w := &worker{
+		t:        t,
+		c:        c,
+		key:      c.Peer().String(),
+		requests: make(map[picker.Block]time.Time),
+		pipeline: newPipeline(t.MinRequests, t.MaxRequests),
+		chokeC:   make(chan bool, 1),
+		haveC:    make(chan struct{}, 1),
+	}
+	w.interested.Store(c.Interested)
+	defer w.release()
+
+	if t.DHT != nil {
+		// nodes of peers are added to the routing table once they answer
+		c.OnPort = func(port int) {
+			addr := net.JoinHostPort(c.Peer().IP.String(), strconv.Itoa(port))
+			go t.DHT.Ping(ctx, addr)
+		}
+	}
+
+	err := t.addWorker(w)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "peer": w.key}).Debug("closing connection")
+		return
+	}
+	defer t.removeWorker(w)
+
+	seedC := t.seedC
+	select {
+	case <-seedC:
+		seedC = nil
+	default:
+		w.downloading = true
+		c.SendInterested()
+		t.picker.AddPeer(c.Bitfield)
+		c.OnHave = t.picker.Have
+		defer func() { t.picker.RemovePeer(c.Bitfield) }()
+	}
+
+	msgC := c.Recv(ctx)
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		if w.downloading {
+			err := w.request()
+			if err != nil {
+				return
+			}
+		}
+
+		var err error
+		select {
+		case msg, ok := <-msgC:
+			if !ok {
+				log.WithFields(log.Fields{"reason": c.Err().Error(), "peer": w.key}).Debug("closing connection")
+				return
+			}
+			err = w.handle(ctx, msg)
+		case <-ticker.C:
+			err = w.expire()
+			if err == nil {
+				err = w.exchange()
+			}
+			if err == nil {
+				err = c.KeepAlive()
+			}
+		case choke := <-w.chokeC:
+			err = w.choke(choke)
+		case <-w.haveC:
+			err = w.sendHaves()
+		case <-seedC:
+			seedC = nil
+			w.downloading = false
+			w.release()
+			err = c.SendNotInterested()
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"reason": err.Error(), "peer": w.key}).Debug("closing connection")
+			return
+		}
+	}
+}
+
+// request fills the request queue of the peer with picked blocks.
+func (w *worker) request() error {
+	n := w.pipeline.size(w.c.MaxRequests) - len(w.requests)
+	if n <= 0 {
+		return nil
+	}
+
+	var blocks []picker.Block
+	switch {
+	case w.c.Choked && len(w.c.AllowedFast) == 0:
+		return nil
+	case w.c.Choked:
+		blocks = w.t.picker.Pick(only(w.c.Bitfield, w.c.AllowedFast), w.key, n)
+	default:
+		if len(w.c.Suggested) > 0 {
+			blocks = w.t.picker.Pick(only(w.c.Bitfield, w.c.Suggested), w.key, n)
+		}
+		if len(blocks) < n {
+			blocks = append(blocks, w.t.picker.Pick(w.c.Bitfield, w.key, n-len(blocks))...)
+		}
+	}
+
+	for _, b := range blocks {
+		w.pipeline.sent(time.Now(), b, len(w.requests))
+		w.requests[b] = time.Now()
+		err := w.c.SendRequest(b.Index, b.Begin, b.Length)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *worker) handle(ctx context.Context, msg *message.Message) error {
+	if msg != nil && msg.ID == message.MsgPiece {
+		return w.receive(ctx, msg)
+	}
+	if msg != nil && msg.ID == message.MsgRejectRequest {
+		return w.reject(msg)
+	}
+
+	choked := w.c.Choked
+	err := w.c.HandleMessage(msg)
+	if err != nil {
+		return err
+	}
+	if !choked && w.c.Choked && !w.c.Fast {
+		// without the fast extension choking discards our requests
+		w.release()
+	}
+	if !w.interested.Swap(w.c.Interested) && w.c.Interested {
+		w.t.requestUnchoke()
+	}
+
+	err = w.c.ServeRequests()
+	w.uploaded.Store(int64(w.c.Uploaded))
+	return err
+}
+
+// reject gives a block the peer will not send back to the picker.
+func (w *worker) reject(msg *message.Message) error {
+	index, begin, length, err := message.ParseRequestMsg(msg)
+	if err != nil {
+		return err
+	}
+
+	b := picker.Block{Index: index, Begin: begin, Length: length}
+	if _, ok := w.requests[b]; !ok {
+		return nil
+	}
+	delete(w.requests, b)
+	w.t.picker.Abort(b, w.key)
+
+	if w.c.Choked {
+		// the piece is no longer allowed fast
+		for i, p := range w.c.AllowedFast {
+			if p == index {
+				w.c.AllowedFast = append(w.c.AllowedFast[:i], w.c.AllowedFast[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// choke applies a decision of the choker to the connection.
+func (w *worker) choke(choke bool) error {
+	switch {
+	case choke && !w.c.Choking:
+		return w.c.SendChoke()
+	case !choke && w.c.Choking:
+		return w.c.SendUnchoke()
+	}
+	return nil
+}
+
+// setChoke hands a choke decision to the worker.
+func (w *worker) setChoke(choke bool) {
+	select {
+	case <-w.chokeC:
+	default:
+	}
+	w.chokeC <- choke
+}
+
+// have queues a have message for a piece we got.
+func (w *worker) have(index int) {
+	w.haveMu.Lock()
+	w.haves = append(w.haves, index)
+	w.haveMu.Unlock()
+
+	select {
+	case w.haveC <- struct{}{}:
+	default:
+	}
+}
+
+func (w *worker) sendHaves() error {
+	w.haveMu.Lock()
+	haves := w.haves
+	w.haves = nil
+	w.haveMu.Unlock()
+
+	for _, index := range haves {
+		err := w.c.SendHave(index)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receive stores a block and verifies its piece once all blocks are in.
+func (w *worker) receive(ctx context.Context, msg *message.Message) error {
+	index, begin, data, err := message.ParseBlockMsg(msg)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(w.t.PieceHashes) {
+		return message.InvalidMessageIndex
+	}
+
+	b := picker.Block{Index: index, Begin: begin, Length: len(data)}
+	if _, ok := w.requests[b]; ok {
+		w.pipeline.received(time.Now(), b, len(data))
+		delete(w.requests, b)
+	}
+	w.downloaded.Add(int64(len(data)))
+
+	// late duplicates are discarded by the picker
+	piece, complete := w.t.picker.Write(b, data)
+	if !complete {
+		return w.expire()
+	}
+
+	if sha1.Sum(piece) != w.t.PieceHashes[index] {
+		w.t.picker.Failed(index)
+		log.WithFields(log.Fields{"index": index, "peer": w.key}).Debug("piece failed verification")
+		return nil
+	}
+	w.t.picker.Verified(index)
+
+	select {
+	case w.t.resultC <- &pieceResult{index, piece}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return w.expire()
+}
+
+// expire cancels received and timed out requests.
+func (w *worker) expire() error {
+	now := time.Now()
+	for b, sent := range w.requests {
+		received := w.t.picker.Received(b)
+		if !received && now.Sub(sent) < requestTimeout {
+			continue
+		}
+
+		delete(w.requests, b)
+		if !received {
+			w.t.picker.Abort(b, w.key)
+			log.WithFields(log.Fields{"index": b.Index, "begin": b.Begin, "peer": w.key}).Debug("block request timed out")
+		}
+		err := w.c.SendCancel(b.Index, b.Begin, b.Length)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exchange sends the changes of the swarm to a peer supporting peer exchange.
+func (w *worker) exchange() error {
+	if w.c.Extensions == nil || w.t.pex == nil {
+		return nil
+	}
+	return w.t.pex.Update(w.c.Extensions)
+}
+
+// release gives the outstanding requests back to the picker.
+func (w *worker) release() {
+	for b := range w.requests {
+		w.t.picker.Abort(b, w.key)
+		delete(w.requests, b)
+	}
+}
+
+// only returns the pieces of bf that are in the list.
+func only(bf bitfield.Bitfield, pieces []int) bitfield.Bitfield {
+	res := make(bitfield.Bitfield, len(bf))
+	for _, p := range pieces {
+		if p < len(bf)*8 && bf.HasPiece(p) {
+			res.SetPiece(p)
+		}
+	}
+	return res
+}
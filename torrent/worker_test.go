@@ -0,0 +1,188 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mitander/bitrush/bitfield"
+	"github.com/mitander/bitrush/message"
+	"github.com/mitander/bitrush/peer"
+	"github.com/mitander/bitrush/picker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// servePeer is a stand-in seeder answering every request with data,
+// corrupt is served once for the first block to fail verification.
+func servePeer(conn net.Conn, data []byte, pieceLength int, corrupt bool) {
+	for {
+		msg, err := message.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		switch msg.ID {
+		case message.MsgInterested:
+			conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+		case message.MsgRequest:
+			index, begin, length, _ := message.ParseRequestMsg(msg)
+			offset := index*pieceLength + begin
+			block := append([]byte(nil), data[offset:offset+length]...)
+			if corrupt {
+				block[0]++
+				corrupt = false
+			}
+			conn.Write(message.FormatPieceMsg(index, begin, block).Serialize())
+		}
+	}
+}
+
+func TestWorker(t *testing.T) {
+	// two pieces of two blocks and one short block
+	pieceLength := 2 * picker.BlockSize
+	data := make([]byte, 3*picker.BlockSize-100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	for _, corrupt := range []bool{false, true} {
+		torrent := &Torrent{
+			PieceHashes: [][20]byte{sha1.Sum(data[:pieceLength]), sha1.Sum(data[pieceLength:])},
+			PieceLength: pieceLength,
+			Length:      len(data),
+			Bitfield:    bitfield.Bitfield{0b00000000},
+			resultC:     make(chan *pieceResult),
+			seedC:       make(chan struct{}),
+		}
+		torrent.picker = picker.NewPicker(torrent.Length, torrent.PieceLength, torrent.Bitfield)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.Nil(t, err)
+		remote, err := l.Accept()
+		require.Nil(t, err)
+		l.Close()
+		go servePeer(remote, data, pieceLength, corrupt)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		c := &peer.Client{Conn: conn, Choked: true, Choking: true, Bitfield: bitfield.Bitfield{0b11000000}}
+		done := make(chan struct{})
+		go func() {
+			torrent.runWorker(ctx, c)
+			close(done)
+		}()
+
+		got := make(map[int][]byte)
+		for len(got) < 2 {
+			select {
+			case res := <-torrent.resultC:
+				got[res.index] = res.buf
+			case <-time.After(5 * time.Second):
+				t.Fatal("pieces not downloaded")
+			}
+		}
+		assert.Equal(t, data[:pieceLength], got[0])
+		assert.Equal(t, data[pieceLength:], got[1])
+		assert.Equal(t, 0, torrent.picker.Left())
+
+		cancel()
+		<-done
+		remote.Close()
+	}
+}
+
+func TestWorkerReject(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go func() {
+		for {
+			if _, err := message.ReadMessage(remote); err != nil {
+				return
+			}
+		}
+	}()
+
+	torrent := &Torrent{PieceLength: picker.BlockSize, Length: 3 * picker.BlockSize}
+	torrent.picker = picker.NewPicker(torrent.Length, torrent.PieceLength, bitfield.Bitfield{0b00000000})
+	c := &peer.Client{Conn: local, Choked: true, Fast: true, Bitfield: bitfield.Bitfield{0b11100000}, AllowedFast: []int{1}}
+	w := &worker{
+		t:        torrent,
+		c:        c,
+		key:      "a",
+		requests: make(map[picker.Block]time.Time),
+		pipeline: newPipeline(0, 0),
+	}
+	torrent.picker.AddPeer(c.Bitfield)
+
+	// only allowed fast pieces are requested while choked
+	assert.Nil(t, w.request())
+	assert.Equal(t, 1, len(w.requests))
+	b := picker.Block{Index: 1, Begin: 0, Length: picker.BlockSize}
+	assert.Contains(t, w.requests, b)
+
+	// a rejected block is given back to the picker right away
+	assert.Nil(t, w.handle(context.Background(), message.FormatRejectMsg(1, 0, picker.BlockSize)))
+	assert.Empty(t, w.requests)
+	assert.Empty(t, c.AllowedFast)
+	assert.Equal(t, []picker.Block{b}, torrent.picker.Pick(bitfield.Bitfield{0b01000000}, "b", 1))
+}
+
+func TestStartWorkerUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close() // <- dials are refused
+
+	p := peer.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	torrent := &Torrent{PieceHashes: make([][20]byte, 1), Peers: []peer.Peer{p}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		torrent.startWorker(ctx, p)
+		close(done)
+	}()
+
+	// the cooldown between dials ends with ctx
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("worker still dialing after shutdown")
+	}
+
+	// a peer given up on is dialed again when reported again
+	assert.Empty(t, torrent.Peers)
+	assert.Equal(t, []peer.Peer{p}, torrent.filterUnique([]peer.Peer{p}))
+}
+
+func TestBroadcastHave(t *testing.T) {
+	torrent := &Torrent{}
+	var workers []*worker
+	var remotes []net.Conn
+	for i := 0; i < 2; i++ {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		w := &worker{t: torrent, c: &peer.Client{Conn: local}, haveC: make(chan struct{}, 1)}
+		torrent.addWorker(w)
+		workers = append(workers, w)
+		remotes = append(remotes, remote)
+	}
+
+	// every connected peer learns about the piece
+	torrent.broadcastHave(2)
+	for i, w := range workers {
+		<-w.haveC
+		go w.sendHaves()
+		msg, err := message.ReadMessage(remotes[i])
+		require.Nil(t, err)
+		assert.Equal(t, message.FormatHaveMsg(2), msg)
+	}
+
+	// send errors close the connection
+	workers[0].have(3)
+	remotes[0].Close()
+	assert.Error(t, workers[0].sendHaves())
+}
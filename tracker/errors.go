@@ -0,0 +1,79 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrorKind tells why an announce or scrape failed.
+type ErrorKind int
+
+const (
+	// ErrNetwork is returned when the tracker could not be reached
+	ErrNetwork ErrorKind = iota
+	// ErrTimeout is returned when the tracker did not respond in time
+	ErrTimeout
+	// ErrStatus is returned when a http tracker responds with a non-200 status
+	ErrStatus
+	// ErrMalformed is returned when the response could not be decoded
+	ErrMalformed
+	// ErrFailure is returned when the tracker sent a failure reason
+	ErrFailure
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrNetwork:
+		return "network"
+	case ErrTimeout:
+		return "timeout"
+	case ErrStatus:
+		return "status"
+	case ErrMalformed:
+		return "malformed"
+	case ErrFailure:
+		return "failure"
+	default:
+		return fmt.Sprintf("unknown kind %d", k)
+	}
+}
+
+// Error is the error returned by tracker requests, use errors.As to inspect it.
+type Error struct {
+	Kind ErrorKind
+	URL  string
+	// failure reason sent by the tracker
+	Reason string
+	// http status code for ErrStatus
+	StatusCode int
+	Err        error
+}
+
+func (e *Error) Error() string {
+	switch e.Kind {
+	case ErrFailure:
+		return fmt.Sprintf("tracker %s: failure: %s", e.URL, e.Reason)
+	case ErrStatus:
+		return fmt.Sprintf("tracker %s: unexpected status %d", e.URL, e.StatusCode)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("tracker %s: %s: %s", e.URL, e.Kind, e.Err.Error())
+	}
+	return fmt.Sprintf("tracker %s: %s", e.URL, e.Kind)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newRequestError wraps a failed request as a network or timeout error.
+func newRequestError(url string, err error) *Error {
+	kind := ErrNetwork
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		kind = ErrTimeout
+	}
+	return &Error{Kind: kind, URL: url, Err: err}
+}
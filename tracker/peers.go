@@ -0,0 +1,53 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+
+	"github.com/mitander/bitrush/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// parsePeers decodes the peers of a http tracker response, which are either
+// a compact string or a list of dictionaries with ip, port and peer id.
+func parsePeers(v interface{}, unmarshal func([]byte) ([]peer.Peer, error)) ([]peer.Peer, error) {
+	switch peers := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return unmarshal([]byte(peers))
+	case []interface{}:
+		return parseDictPeers(peers)
+	default:
+		return nil, errors.New("invalid peers type")
+	}
+}
+
+// [https://wiki.theory.org/BitTorrentSpecification#Tracker_Response]
+func parseDictPeers(list []interface{}) ([]peer.Peer, error) {
+	peers := make([]peer.Peer, 0, len(list))
+	for _, entry := range list {
+		d, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid peer dictionary")
+		}
+
+		host, _ := d["ip"].(string)
+		ip := net.ParseIP(host)
+		port, ok := d["port"].(int64)
+		if ip == nil || !ok || port <= 0 || port > 65535 {
+			log.WithFields(log.Fields{"ip": host, "port": d["port"]}).Debug("skipping invalid peer")
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		p := peer.Peer{IP: ip, Port: uint16(port)}
+		if id, ok := d["peer id"].(string); ok && len(id) == 20 {
+			copy(p.ID[:], id)
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
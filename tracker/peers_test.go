@@ -0,0 +1,59 @@
+package tracker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mitander/bitrush/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePeers(t *testing.T) {
+	peerID := [20]byte{'-', 'T', 'R', '3', '0', '0', '0', '-', 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l'}
+
+	tests := map[string]struct {
+		input  interface{}
+		output []peer.Peer
+		fails  bool
+	}{
+		"compact": {
+			input:  string([]byte{192, 0, 2, 210, 0x1A, 0xE8}),
+			output: []peer.Peer{{IP: net.IP{192, 0, 2, 210}, Port: 6888}},
+		},
+		"dictionary": {
+			input: []interface{}{
+				map[string]interface{}{"ip": "192.0.2.210", "port": int64(6888), "peer id": string(peerID[:])},
+				map[string]interface{}{"ip": "2001:db8::1", "port": int64(6889)},
+			},
+			output: []peer.Peer{
+				{IP: net.IP{192, 0, 2, 210}, Port: 6888, ID: peerID},
+				{IP: net.ParseIP("2001:db8::1"), Port: 6889},
+			},
+		},
+		"invalid entries skipped": {
+			input: []interface{}{
+				map[string]interface{}{"ip": "not an ip", "port": int64(6888)},
+				map[string]interface{}{"ip": "192.0.2.210", "port": int64(70000)},
+			},
+			output: []peer.Peer{},
+		},
+		"missing peers": {
+			input:  nil,
+			output: nil,
+		},
+		"invalid type": {
+			input: int64(1), // <- fails here
+			fails: true,
+		},
+	}
+
+	for name, test := range tests {
+		peers, err := parsePeers(test.input, peer.Unmarshal)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, peers, name)
+	}
+}
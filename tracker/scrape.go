@@ -0,0 +1,125 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/jackpal/bencode-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// ScrapeResult holds the swarm statistics a tracker reports for one info hash.
+type ScrapeResult struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// Scraper is implemented by trackers that report swarm statistics,
+// results are returned in the order of the requested info hashes.
+type Scraper interface {
+	Scrape(ctx context.Context, infoHashes [][20]byte) ([]ScrapeResult, error)
+}
+
+// ErrScrapeNotSupported is returned when no scrape url can be derived
+// from the announce url.
+var ErrScrapeNotSupported = errors.New("tracker does not support scrape")
+
+// scrapeURL derives the scrape url from an announce url, which is only
+// possible when the last path element starts with "announce".
+// [https://wiki.theory.org/BitTorrentSpecification#Tracker_.27scrape.27_Convention]
+func scrapeURL(u *url.URL) (*url.URL, error) {
+	dir, file := path.Split(u.Path)
+	if !strings.HasPrefix(file, "announce") {
+		return nil, ErrScrapeNotSupported
+	}
+
+	s := *u
+	s.Path = dir + "scrape" + strings.TrimPrefix(file, "announce")
+	s.RawPath = ""
+	return &s, nil
+}
+
+// Scrape requests swarm statistics for the info hashes, info hashes the
+// tracker does not know are reported with zero counts. The request is
+// bound by ctx.
+func (t *HTTPTracker) Scrape(ctx context.Context, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	u, err := scrapeURL(t.url)
+	if err != nil {
+		log.WithFields(log.Fields{"announce": t.URL}).Debug(err.Error())
+		return nil, err
+	}
+
+	q := u.Query()
+	for _, ih := range infoHashes {
+		q.Add("info_hash", string(ih[:]))
+	}
+	u.RawQuery = q.Encode()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to create request")
+		return nil, err
+	}
+
+	c := http.Client{}
+	res, err := c.Do(r)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to send request")
+		return nil, newRequestError(t.URL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err := &Error{Kind: ErrStatus, URL: t.URL, StatusCode: res.StatusCode}
+		log.WithFields(log.Fields{"status": res.StatusCode}).Error(err.Error())
+		return nil, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to read response")
+		return nil, newRequestError(t.URL, err)
+	}
+
+	// files is keyed by raw info hash, decode untyped
+	raw, err := bencode.Decode(bytes.NewReader(body))
+	dict, ok := raw.(map[string]interface{})
+	if err != nil || !ok {
+		err := &Error{Kind: ErrMalformed, URL: t.URL, Err: errors.New("invalid scrape response")}
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	if reason, ok := dict["failure reason"].(string); ok {
+		err := &Error{Kind: ErrFailure, URL: t.URL, Reason: reason}
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	files, _ := dict["files"].(map[string]interface{})
+	scrapes := make([]ScrapeResult, len(infoHashes))
+	for i, ih := range infoHashes {
+		f, ok := files[string(ih[:])].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		scrapes[i] = ScrapeResult{
+			Seeders:   intValue(f["complete"]),
+			Completed: intValue(f["downloaded"]),
+			Leechers:  intValue(f["incomplete"]),
+		}
+	}
+	return scrapes, nil
+}
+
+func intValue(v interface{}) int {
+	i, _ := v.(int64)
+	return int(i)
+}
@@ -0,0 +1,78 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := map[string]struct {
+		announce string
+		scrape   string
+		fails    bool
+	}{
+		"announce": {
+			announce: "http://example.com/announce",
+			scrape:   "http://example.com/scrape",
+		},
+		"announce with suffix and query": {
+			announce: "http://example.com/x/announce.php?passkey=abc",
+			scrape:   "http://example.com/x/scrape.php?passkey=abc",
+		},
+		"not supported": {
+			announce: "http://example.com/a", // <- fails here
+			fails:    true,
+		},
+		"announce not last element": {
+			announce: "http://example.com/announce/x", // <- fails here
+			fails:    true,
+		},
+	}
+
+	for name, test := range tests {
+		u, err := url.Parse(test.announce)
+		require.Nil(t, err, name)
+
+		s, err := scrapeURL(u)
+		if test.fails {
+			assert.ErrorIs(t, err, ErrScrapeNotSupported, name)
+			continue
+		}
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.scrape, s.String(), name)
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	known := [20]byte{1, 2, 3}
+	unknown := [20]byte{4, 5, 6}
+
+	var query url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query = r.URL.Query()
+		w.Write([]byte("d" + "5:files" + "d" + "20:" + string(known[:]) +
+			"d" + "8:completei5e" + "10:downloadedi50e" + "10:incompletei10e" + "e" + "e" + "e"))
+	}))
+	defer srv.Close()
+
+	tr, err := NewHTTPTracker(srv.URL+"/announce", [20]byte{}, [20]byte{})
+	require.Nil(t, err)
+
+	res, err := tr.Scrape(context.Background(), [][20]byte{known, unknown})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{string(known[:]), string(unknown[:])}, query["info_hash"])
+	assert.Equal(t, []ScrapeResult{
+		{Seeders: 5, Completed: 50, Leechers: 10},
+		{}, // <- not tracked, zero counts
+	}, res)
+}
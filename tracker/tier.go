@@ -0,0 +1,182 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TierList implements the multitracker extension: trackers are tried tier by
+// tier in order and a tracker that responds is moved to the front of its tier.
+// [https://www.bittorrent.org/beps/bep_0012.html]
+type TierList struct {
+	tiers [][]Tracker
+	mu    sync.Mutex
+	// status is locked separately so it can be read during an announce
+	status   map[Tracker]*Status
+	order    []Tracker
+	statusMu sync.Mutex
+}
+
+// Status is the announce state of a single tracker.
+type Status struct {
+	URL          string
+	LastAnnounce time.Time
+	LastSuccess  time.Time
+	LastError    error
+	Warning      string
+	// time the tracker asked to be announced to again
+	NextAnnounce time.Time
+	Seeders      int
+	Leechers     int
+}
+
+// NewTierList creates the trackers of every tier, shuffling each tier once.
+// Trackers that can not be created are skipped.
+func NewTierList(announce [][]string, infoHash [20]byte, peerID [20]byte) *TierList {
+	var tiers [][]Tracker
+	var order []Tracker
+	status := make(map[Tracker]*Status)
+	for _, urls := range announce {
+		var tier []Tracker
+		for _, u := range urls {
+			tr, err := NewTracker(u, infoHash, peerID)
+			if err != nil {
+				continue
+			}
+			tier = append(tier, tr)
+			status[tr] = &Status{URL: u}
+			order = append(order, tr)
+		}
+		if len(tier) == 0 {
+			continue
+		}
+
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+		tiers = append(tiers, tier)
+	}
+	return &TierList{tiers: tiers, status: status, order: order}
+}
+
+// Announce announces to the first tracker that responds within
+// AnnounceTimeout or the deadline of ctx, whichever comes first.
+func (l *TierList) Announce(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, AnnounceTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	tiers := l.tierOrder()
+	left := 0
+	for _, tier := range tiers {
+		left += len(tier)
+	}
+
+	err := errors.New("no trackers available")
+	for i, tier := range tiers {
+		for _, tr := range tier {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			// dead trackers leave time for the ones after them
+			actx, cancel := context.WithTimeout(ctx, time.Until(deadline)/time.Duration(left))
+			left--
+			var res *AnnounceResponse
+			res, err = tr.Announce(actx, req)
+			cancel()
+			l.record(tr, res, err)
+			if err != nil {
+				continue
+			}
+			l.promote(i, tr)
+			return res, nil
+		}
+	}
+
+	log.WithFields(log.Fields{"reason": err.Error()}).Debug("no tracker responded")
+	return nil, err
+}
+
+// tierOrder returns a copy of the tiers so announces run without the lock.
+func (l *TierList) tierOrder() [][]Tracker {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tiers := make([][]Tracker, len(l.tiers))
+	for i, tier := range l.tiers {
+		tiers[i] = append([]Tracker{}, tier...)
+	}
+	return tiers
+}
+
+// promote moves a responding tracker to the front of its tier.
+func (l *TierList) promote(i int, tr Tracker) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tier := l.tiers[i]
+	for j := range tier {
+		if tier[j] == tr {
+			copy(tier[1:j+1], tier[:j])
+			tier[0] = tr
+			return
+		}
+	}
+}
+
+// Len returns the number of usable trackers in all tiers.
+func (l *TierList) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for _, tier := range l.tiers {
+		n += len(tier)
+	}
+	return n
+}
+
+// Status returns the status of every tracker in the order they were listed.
+func (l *TierList) Status() []Status {
+	l.statusMu.Lock()
+	defer l.statusMu.Unlock()
+
+	status := make([]Status, len(l.order))
+	for i, tr := range l.order {
+		status[i] = *l.status[tr]
+	}
+	return status
+}
+
+func (l *TierList) record(tr Tracker, res *AnnounceResponse, err error) {
+	l.statusMu.Lock()
+	defer l.statusMu.Unlock()
+
+	if l.status == nil {
+		l.status = make(map[Tracker]*Status)
+	}
+	s, ok := l.status[tr]
+	if !ok {
+		s = &Status{}
+		l.status[tr] = s
+		l.order = append(l.order, tr)
+	}
+
+	s.LastAnnounce = time.Now()
+	s.LastError = err
+	if err != nil {
+		s.NextAnnounce = time.Time{}
+		return
+	}
+	s.LastSuccess = s.LastAnnounce
+	s.NextAnnounce = s.LastAnnounce.Add(res.Interval)
+	s.Warning = res.Warning
+	s.Seeders = res.Seeders
+	s.Leechers = res.Leechers
+}
@@ -0,0 +1,119 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mitander/bitrush/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTracker struct {
+	name  string
+	fails bool
+	calls int
+	// block waits until the announce is cancelled
+	block bool
+}
+
+func (t *testTracker) Announce(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error) {
+	t.calls++
+	if t.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if t.fails {
+		return nil, errors.New("tracker not responding")
+	}
+	return &AnnounceResponse{Peers: []peer.Peer{{IP: net.IP{127, 0, 0, 1}, Port: 6889}}}, nil
+}
+
+func TestTierList(t *testing.T) {
+	a := &testTracker{name: "a", fails: true}
+	b := &testTracker{name: "b", fails: false}
+	c := &testTracker{name: "c", fails: true}
+	d := &testTracker{name: "d", fails: false}
+	l := &TierList{tiers: [][]Tracker{{a, b}, {c, d}}}
+
+	// b responds and is promoted within the first tier
+	res, err := l.Announce(context.Background(), AnnounceRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res.Peers))
+	assert.Equal(t, [][]Tracker{{b, a}, {c, d}}, l.tiers)
+
+	// promoted tracker is asked first
+	_, err = l.Announce(context.Background(), AnnounceRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, a.calls)
+	assert.Equal(t, 2, b.calls)
+
+	// first tier fails, falls back to the second tier
+	b.fails = true
+	_, err = l.Announce(context.Background(), AnnounceRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, [][]Tracker{{b, a}, {d, c}}, l.tiers)
+	assert.Equal(t, 1, d.calls)
+
+	// every tracker fails
+	d.fails = true
+	_, err = l.Announce(context.Background(), AnnounceRequest{})
+	assert.NotNil(t, err)
+
+	// status is kept for every tracker that was asked
+	status := l.Status()
+	assert.Equal(t, 4, len(status))
+	for _, s := range status {
+		assert.NotNil(t, s.LastError)
+	}
+	assert.False(t, status[1].LastSuccess.IsZero()) // <- b responded before failing
+}
+
+func TestTierListBlockingTracker(t *testing.T) {
+	a := &testTracker{name: "a", block: true}
+	b := &testTracker{name: "b", fails: false}
+	l := &TierList{tiers: [][]Tracker{{a, b}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := l.Announce(ctx, AnnounceRequest{})
+		done <- err
+	}()
+
+	// the list is not locked while a tracker is being asked
+	assert.Equal(t, 2, l.Len())
+
+	cancel()
+	err := <-done
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, b.calls) // <- not asked once ctx is done
+}
+
+func TestNewTierList(t *testing.T) {
+	announce := [][]string{
+		{"http://first.tracker.org/announce", "udp://second.tracker.org:1337"},
+		{"wss://unsupported.tracker.org"},
+		{"udp://backup.tracker.org:1337"},
+	}
+	l := NewTierList(announce, [20]byte{}, [20]byte{})
+	assert.Equal(t, 3, l.Len())
+	assert.Equal(t, 2, len(l.tiers))
+}
+
+func TestTierListHangingTracker(t *testing.T) {
+	a := &testTracker{name: "a", block: true}
+	b := &testTracker{name: "b", fails: false}
+	l := &TierList{tiers: [][]Tracker{{a}, {b}}}
+
+	// the hanging tracker does not use up the whole deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	res, err := l.Announce(ctx, AnnounceRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(res.Peers))
+	assert.Equal(t, 1, a.calls)
+	assert.Equal(t, 1, b.calls)
+}
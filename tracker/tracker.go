@@ -1,7 +1,13 @@
 package tracker
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -12,70 +18,272 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// TrackerPort is the port we try to accept peers on.
 const TrackerPort = 6889
 
-type Tracker struct {
-	Announce string
-	Query    string
+// DefaultNumWant is the number of peers we ask trackers for.
+const DefaultNumWant = 50
+
+// AnnounceTimeout bounds an announce over all tiers, the time left is
+// shared evenly by the trackers still to be asked.
+const AnnounceTimeout = 45 * time.Second
+
+type Event int
+
+// [https://wiki.theory.org/BitTorrentSpecification#Tracker_Request_Parameters]
+const (
+	EventNone Event = iota
+	EventStarted
+	EventCompleted
+	EventStopped
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventStarted:
+		return "started"
+	case EventCompleted:
+		return "completed"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+// AnnounceRequest carries the transfer state of the torrent at the time
+// of the announce.
+type AnnounceRequest struct {
+	Event      Event
+	Uploaded   int
+	Downloaded int
+	Left       int
+	NumWant    int
+	// Port we accept peers on, zero when we do not accept incoming peers
+	Port int
+}
+
+type AnnounceResponse struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	Seeders     int
+	Leechers    int
+	Peers       []peer.Peer
+	// warning message sent by the tracker, the announce still succeeded
+	Warning string
+}
+
+// Tracker is a tracker client, HTTP and UDP trackers are used the same way.
+// Announce gives up when ctx is done.
+type Tracker interface {
+	Announce(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error)
+}
+
+// NewTracker creates a tracker client for the announce url based on its scheme.
+func NewTracker(announce string, infoHash [20]byte, peerID [20]byte) (Tracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to create tracker")
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		tr, err := NewHTTPTracker(announce, infoHash, peerID)
+		if err != nil {
+			return nil, err
+		}
+		return tr, nil
+	case "udp":
+		tr, err := NewUDPTracker(announce, infoHash, peerID)
+		if err != nil {
+			return nil, err
+		}
+		return tr, nil
+	default:
+		err := errors.New("unsupported tracker scheme")
+		log.WithFields(log.Fields{"scheme": u.Scheme, "announce": announce}).Error(err.Error())
+		return nil, err
+	}
+}
+
+type HTTPTracker struct {
+	URL      string
 	PeerId   [20]byte
 	InfoHash [20]byte
-	Peers    []peer.Peer
+	url      *url.URL
+	key      uint32
+	// tracker id returned by the tracker, sent back on every announce
+	trackerID string
+	// public addresses sent so the tracker learns both address families
+	ipv4 net.IP
+	ipv6 net.IP
 }
 
-func NewTracker(announce string, length int, infoHash [20]byte, peerID [20]byte) (Tracker, error) {
+func NewHTTPTracker(announce string, infoHash [20]byte, peerID [20]byte) (*HTTPTracker, error) {
 	u, err := url.Parse(announce)
 	if err != nil {
 		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to create tracker")
-		return Tracker{}, err
+		return nil, err
 	}
 
+	ipv4, ipv6 := publicAddrs()
+	return &HTTPTracker{
+		URL:      announce,
+		PeerId:   peerID,
+		InfoHash: infoHash,
+		url:      u,
+		key:      randUint32(),
+		ipv4:     ipv4,
+		ipv6:     ipv6,
+	}, nil
+}
+
+func (t *HTTPTracker) query(req AnnounceRequest) string {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, t.key)
+
 	p := url.Values{
-		"info_hash":  []string{string(infoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(TrackerPort))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"info_hash":  []string{string(t.InfoHash[:])},
+		"peer_id":    []string{string(t.PeerId[:])},
+		"port":       []string{strconv.Itoa(req.Port)},
+		"uploaded":   []string{strconv.Itoa(req.Uploaded)},
+		"downloaded": []string{strconv.Itoa(req.Downloaded)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(length)},
+		"left":       []string{strconv.Itoa(req.Left)},
+		"key":        []string{hex.EncodeToString(key)},
+	}
+	if req.Event != EventNone {
+		p.Set("event", req.Event.String())
+	}
+	if req.NumWant > 0 {
+		p.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+	if t.trackerID != "" {
+		p.Set("trackerid", t.trackerID)
+	}
+	// [https://www.bittorrent.org/beps/bep_0007.html]
+	if t.ipv4 != nil {
+		p.Set("ipv4", t.ipv4.String())
+	}
+	if t.ipv6 != nil {
+		p.Set("ipv6", t.ipv6.String())
 	}
 
+	u := *t.url
 	u.RawQuery = p.Encode()
-	return Tracker{
-		Announce: announce,
-		Query:    u.String(),
-		PeerId:   peerID,
-		InfoHash: infoHash,
-	}, nil
+	return u.String()
 }
 
 type bencodeResponse struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason  string `bencode:"failure reason"`
+	WarningMessage string `bencode:"warning message"`
+	Interval       int    `bencode:"interval"`
+	MinInterval    int    `bencode:"min interval"`
+	TrackerID      string `bencode:"tracker id"`
+	Complete       int    `bencode:"complete"`
+	Incomplete     int    `bencode:"incomplete"`
 }
 
-func (t *Tracker) RequestPeers() ([]peer.Peer, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func (t *HTTPTracker) Announce(ctx context.Context, req AnnounceRequest) (*AnnounceResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.Query, nil)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, t.query(req), nil)
 	if err != nil {
 		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to create request")
 		return nil, err
 	}
 
 	c := http.Client{}
-	res, err := c.Do(req)
+	res, err := c.Do(r)
 	if err != nil {
 		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to send request")
-		return nil, err
+		return nil, newRequestError(t.URL, err)
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode != http.StatusOK {
+		err := &Error{Kind: ErrStatus, URL: t.URL, StatusCode: res.StatusCode}
+		log.WithFields(log.Fields{"status": res.StatusCode}).Error(err.Error())
+		return nil, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to read response")
+		return nil, newRequestError(t.URL, err)
+	}
+
 	response := bencodeResponse{}
-	err = bencode.Unmarshal(res.Body, &response)
+	err = bencode.Unmarshal(bytes.NewReader(body), &response)
 	if err != nil {
 		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to unmarshal bencode")
+		return nil, &Error{Kind: ErrMalformed, URL: t.URL, Err: err}
+	}
+
+	// peers are either compact or a list of dictionaries, decode them untyped
+	raw, err := bencode.Decode(bytes.NewReader(body))
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to decode bencode")
+		return nil, &Error{Kind: ErrMalformed, URL: t.URL, Err: err}
+	}
+	dict, _ := raw.(map[string]interface{})
+
+	if response.FailureReason != "" {
+		err := &Error{Kind: ErrFailure, URL: t.URL, Reason: response.FailureReason}
+		log.Error(err.Error())
 		return nil, err
 	}
-	return peer.Unmarshal([]byte(response.Peers))
+	if response.WarningMessage != "" {
+		log.WithFields(log.Fields{"announce": t.URL, "warning": response.WarningMessage}).Warn("tracker warning")
+	}
+
+	if response.TrackerID != "" {
+		t.trackerID = response.TrackerID
+	}
+
+	peers, err := parsePeers(dict["peers"], peer.Unmarshal)
+	if err != nil {
+		return nil, &Error{Kind: ErrMalformed, URL: t.URL, Err: err}
+	}
+	peers6, err := parsePeers(dict["peers6"], peer.Unmarshal6)
+	if err != nil {
+		return nil, &Error{Kind: ErrMalformed, URL: t.URL, Err: err}
+	}
+	peers = append(peers, peers6...)
+
+	return &AnnounceResponse{
+		Interval:    time.Duration(response.Interval) * time.Second,
+		MinInterval: time.Duration(response.MinInterval) * time.Second,
+		Seeders:     response.Complete,
+		Leechers:    response.Incomplete,
+		Peers:       peers,
+		Warning:     response.WarningMessage,
+	}, nil
+}
+
+// publicAddrs returns the first public ipv4 and ipv6 address of the host,
+// private addresses are left out as the tracker can not reach them.
+func publicAddrs() (net.IP, net.IP) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, nil
+	}
+
+	var ipv4, ipv6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() || ipNet.IP.IsPrivate() {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			if ipv4 == nil {
+				ipv4 = ip4
+			}
+		} else if ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+	return ipv4, ipv6
 }
@@ -1,51 +1,203 @@
 package tracker
 
 import (
+	"context"
+	"errors"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/mitander/bitrush/peer"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestNewTrackerUrl(t *testing.T) {
+func TestQuery(t *testing.T) {
 	announce := "http://test.tracker.org:6969/announce"
-	length := 351272960
 	infoHash := [20]byte{148, 102, 213, 85, 174, 246, 146, 126, 127, 246, 85, 15, 22, 6, 186, 128, 220, 105, 12, 15}
 	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
 
-	tr, err := NewTracker(announce, length, infoHash, peerID)
+	tr, err := NewHTTPTracker(announce, infoHash, peerID)
 	assert.Equal(t, err, nil)
-	expected := "http://test.tracker.org:6969/announce?compact=1&downloaded=0&info_hash=%94f%D5U%AE%F6%92~%7F%F6U%0F%16%06%BA%80%DCi%0C%0F&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6889&uploaded=0"
-	assert.Equal(t, tr.Query, expected)
+	tr.key = 0x0a0b0c0d
+
+	tests := map[string]struct {
+		req       AnnounceRequest
+		trackerID string
+		ipv4      net.IP
+		ipv6      net.IP
+		expected  string
+	}{
+		"started": {
+			req:      AnnounceRequest{Event: EventStarted, Left: 351272960, NumWant: 50, Port: 6889},
+			expected: "http://test.tracker.org:6969/announce?compact=1&downloaded=0&event=started&info_hash=%94f%D5U%AE%F6%92~%7F%F6U%0F%16%06%BA%80%DCi%0C%0F&key=0a0b0c0d&left=351272960&numwant=50&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6889&uploaded=0",
+		},
+		"regular announce with tracker id": {
+			req:       AnnounceRequest{Uploaded: 1024, Downloaded: 2048, Left: 351270912, Port: 6889},
+			trackerID: "abc",
+			expected:  "http://test.tracker.org:6969/announce?compact=1&downloaded=2048&info_hash=%94f%D5U%AE%F6%92~%7F%F6U%0F%16%06%BA%80%DCi%0C%0F&key=0a0b0c0d&left=351270912&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6889&trackerid=abc&uploaded=1024",
+		},
+		"public addresses": {
+			req:      AnnounceRequest{Left: 351272960, Port: 6889},
+			ipv4:     net.IP{203, 0, 113, 5},
+			ipv6:     net.ParseIP("2001:db8::5"),
+			expected: "http://test.tracker.org:6969/announce?compact=1&downloaded=0&info_hash=%94f%D5U%AE%F6%92~%7F%F6U%0F%16%06%BA%80%DCi%0C%0F&ipv4=203.0.113.5&ipv6=2001%3Adb8%3A%3A5&key=0a0b0c0d&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=6889&uploaded=0",
+		},
+		"not accepting peers": {
+			req:      AnnounceRequest{Left: 351272960},
+			expected: "http://test.tracker.org:6969/announce?compact=1&downloaded=0&info_hash=%94f%D5U%AE%F6%92~%7F%F6U%0F%16%06%BA%80%DCi%0C%0F&key=0a0b0c0d&left=351272960&peer_id=%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13%14&port=0&uploaded=0",
+		},
+	}
+
+	for name, test := range tests {
+		tr.trackerID = test.trackerID
+		tr.ipv4 = test.ipv4
+		tr.ipv6 = test.ipv6
+		assert.Equal(t, test.expected, tr.query(test.req), name)
+	}
 }
 
-func TestRequestPeers(t *testing.T) {
+func TestAnnounce(t *testing.T) {
+	var query url.Values
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
 		response := []byte(
-			"d" + "8:interval" + "i900e" + "5:peers" + "12:" +
+			"d" + "8:complete" + "i5e" + "10:incomplete" + "i7e" + "8:interval" + "i900e" + "12:min interval" + "i60e" + "5:peers" + "12:" +
 				string([]byte{
 					192, 0, 2, 210, 0x1A, 0xE8, // 0x1AE8 = 6888
 					127, 0, 0, 21, 0x1A, 0xE9, // 0x1AE9 = 6889
-				}) + "e")
+				}) + "6:peers6" + "18:" +
+				string([]byte{
+					0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xEA, // 0x1AEA = 6890
+				}) + "10:tracker id" + "3:abc" + "e")
 		w.Write(response)
 	}))
 	defer srv.Close()
 
 	announce := srv.URL
 	infoHash := [20]byte{148, 102, 213, 85, 174, 246, 146, 126, 127, 246, 85, 15, 22, 6, 186, 128, 220, 105, 12, 15}
-	length := 351272960
 	peerID := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
 
-	expected := []peer.Peer{
-		{IP: net.IP{192, 0, 2, 210}, Port: 6888},
-		{IP: net.IP{127, 0, 0, 21}, Port: 6889},
+	expected := &AnnounceResponse{
+		Interval:    900 * time.Second,
+		MinInterval: 60 * time.Second,
+		Seeders:     5,
+		Leechers:    7,
+		Peers: []peer.Peer{
+			{IP: net.IP{192, 0, 2, 210}, Port: 6888},
+			{IP: net.IP{127, 0, 0, 21}, Port: 6889},
+			{IP: net.ParseIP("2001:db8::1"), Port: 6890},
+		},
 	}
-	tr, err := NewTracker(announce, length, infoHash, peerID)
+	tr, err := NewTracker(announce, infoHash, peerID)
 	assert.Nil(t, err)
-	p, err := tr.RequestPeers()
+	res, err := tr.Announce(context.Background(), AnnounceRequest{Event: EventStarted, Left: 351272960})
 	assert.Nil(t, err)
-	assert.Equal(t, expected, p)
+	assert.Equal(t, expected, res)
+	assert.Equal(t, "started", query.Get("event"))
+
+	// tracker id is sent back on the next announce
+	_, err = tr.Announce(context.Background(), AnnounceRequest{Left: 351272960})
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", query.Get("trackerid"))
+	assert.Equal(t, "", query.Get("event"))
+}
+
+func TestAnnounceErrors(t *testing.T) {
+	tests := map[string]struct {
+		status   int
+		response string
+		kind     ErrorKind
+		reason   string
+		warning  string
+		fails    bool
+	}{
+		"failure reason": {
+			status:   http.StatusOK,
+			response: "d14:failure reason17:torrent not founde",
+			kind:     ErrFailure,
+			reason:   "torrent not found",
+			fails:    true,
+		},
+		"warning message": {
+			status:   http.StatusOK,
+			response: "d8:intervali900e5:peers0:15:warning message13:slow down plze",
+			warning:  "slow down plz",
+			fails:    false,
+		},
+		"dictionary peers": {
+			status:   http.StatusOK,
+			response: "d8:intervali900e5:peersld2:ip11:192.0.2.2107:peer id20:-TR3000-abcdefghijkl4:porti6888eeee",
+			fails:    false,
+		},
+		"bad status": {
+			status:   http.StatusServiceUnavailable,
+			response: "",
+			kind:     ErrStatus,
+			fails:    true,
+		},
+		"malformed response": {
+			status:   http.StatusOK,
+			response: "<html>not bencode</html>",
+			kind:     ErrMalformed,
+			fails:    true,
+		},
+	}
+
+	for name, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.response))
+		}))
+
+		tr, err := NewHTTPTracker(srv.URL, [20]byte{}, [20]byte{})
+		assert.Nil(t, err, name)
+		res, err := tr.Announce(context.Background(), AnnounceRequest{})
+		srv.Close()
+
+		if !test.fails {
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.warning, res.Warning, name)
+			continue
+		}
+
+		var trErr *Error
+		assert.True(t, errors.As(err, &trErr), name)
+		assert.Equal(t, test.kind, trErr.Kind, name)
+		assert.Equal(t, test.reason, trErr.Reason, name)
+		assert.Equal(t, srv.URL, trErr.URL, name)
+	}
+}
+
+func TestNewTracker(t *testing.T) {
+	tests := map[string]struct {
+		announce string
+		fails    bool
+	}{
+		"http tracker": {
+			announce: "http://test.tracker.org:6969/announce",
+			fails:    false,
+		},
+		"udp tracker": {
+			announce: "udp://test.tracker.org:6969",
+			fails:    false,
+		},
+		"unsupported scheme": {
+			announce: "wss://test.tracker.org:6969", // <- fails here
+			fails:    true,
+		},
+	}
+
+	for name, test := range tests {
+		tr, err := NewTracker(test.announce, [20]byte{}, [20]byte{})
+		if test.fails {
+			assert.NotNil(t, err, name)
+			assert.Nil(t, tr, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.NotNil(t, tr, name)
+		}
+	}
 }
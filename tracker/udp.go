@@ -0,0 +1,326 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mitander/bitrush/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// [https://www.bittorrent.org/beps/bep_0015.html]
+const (
+	udpProtocolID = 0x41727101980
+
+	actionConnect  uint32 = 0
+	actionAnnounce uint32 = 1
+	actionScrape   uint32 = 2
+	actionError    uint32 = 3
+
+	// connection id can be used for one minute after it was received
+	connectionIDTTL = time.Minute
+	// retransmission timeout is 15 * 2^n seconds for n up to 8, callers
+	// bound the whole exchange by the deadline of their context
+	udpTimeout    = 15 * time.Second
+	udpMaxRetries = 8
+	// info hashes that fit in a single scrape packet
+	udpMaxScrape = 74
+)
+
+// udp trackers number announce events differently than http trackers
+var udpEvents = map[Event]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+var errConnectionExpired = errors.New("udp tracker connection id expired")
+
+type UDPTracker struct {
+	URL      string
+	PeerId   [20]byte
+	InfoHash [20]byte
+	addr     string
+	key      uint32
+	connID   uint64
+	connTime time.Time
+	timeout  time.Duration
+	retries  int
+	mu       sync.Mutex
+}
+
+func NewUDPTracker(announce string, infoHash [20]byte, peerID [20]byte) (*UDPTracker, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error()}).Error("failed to create tracker")
+		return nil, err
+	}
+
+	if u.Port() == "" {
+		err := errors.New("missing udp tracker port")
+		log.WithFields(log.Fields{"announce": announce}).Error(err.Error())
+		return nil, err
+	}
+
+	return &UDPTracker{
+		URL:      announce,
+		PeerId:   peerID,
+		InfoHash: infoHash,
+		addr:     u.Host,
+		key:      randUint32(),
+		timeout:  udpTimeout,
+		retries:  udpMaxRetries,
+	}, nil
+}
+
+func (t *UDPTracker) Announce(ctx context.Context, ar AnnounceRequest) (*AnnounceResponse, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", t.addr)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "announce": t.URL}).Error("failed to dial udp tracker")
+		return nil, newRequestError(t.URL, err)
+	}
+	defer conn.Close()
+
+	// announce: <connection_id><action><transaction_id><info_hash><peer_id>
+	// <downloaded><left><uploaded><event><ip><key><num_want><port>
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint32(req[8:12], actionAnnounce)
+	copy(req[16:36], t.InfoHash[:])
+	copy(req[36:56], t.PeerId[:])
+	binary.BigEndian.PutUint64(req[56:64], uint64(ar.Downloaded))
+	binary.BigEndian.PutUint64(req[64:72], uint64(ar.Left))
+	binary.BigEndian.PutUint64(req[72:80], uint64(ar.Uploaded))
+	binary.BigEndian.PutUint32(req[80:84], udpEvents[ar.Event])
+	binary.BigEndian.PutUint32(req[84:88], 0)
+	binary.BigEndian.PutUint32(req[88:92], t.key)
+	numWant := int32(-1) // tracker default
+	if ar.NumWant > 0 {
+		numWant = int32(ar.NumWant)
+	}
+	binary.BigEndian.PutUint32(req[92:96], uint32(numWant))
+	binary.BigEndian.PutUint16(req[96:98], uint16(ar.Port))
+
+	// announce response: <action><transaction_id><interval><leechers><seeders><peers>
+	res, err := t.request(ctx, conn, req, actionAnnounce, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	// trackers reached over ipv6 respond with ipv6 peers
+	unmarshal := peer.Unmarshal
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		unmarshal = peer.Unmarshal6
+	}
+	peers, err := unmarshal(res[20:])
+	if err != nil {
+		return nil, &Error{Kind: ErrMalformed, URL: t.URL, Err: err}
+	}
+
+	return &AnnounceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(res[8:12])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(res[12:16])),
+		Seeders:  int(binary.BigEndian.Uint32(res[16:20])),
+		Peers:    peers,
+	}, nil
+}
+
+// Scrape requests swarm statistics for the info hashes, split into
+// requests of at most udpMaxScrape info hashes.
+func (t *UDPTracker) Scrape(ctx context.Context, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	var scrapes []ScrapeResult
+	for len(infoHashes) > 0 {
+		n := len(infoHashes)
+		if n > udpMaxScrape {
+			n = udpMaxScrape
+		}
+		res, err := t.scrape(ctx, infoHashes[:n])
+		if err != nil {
+			return nil, err
+		}
+		scrapes = append(scrapes, res...)
+		infoHashes = infoHashes[n:]
+	}
+	return scrapes, nil
+}
+
+func (t *UDPTracker) scrape(ctx context.Context, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", t.addr)
+	if err != nil {
+		log.WithFields(log.Fields{"reason": err.Error(), "announce": t.URL}).Error("failed to dial udp tracker")
+		return nil, newRequestError(t.URL, err)
+	}
+	defer conn.Close()
+
+	// scrape: <connection_id><action><transaction_id><info_hash>...
+	req := make([]byte, 16+20*len(infoHashes))
+	binary.BigEndian.PutUint32(req[8:12], actionScrape)
+	for i, ih := range infoHashes {
+		copy(req[16+20*i:], ih[:])
+	}
+
+	// scrape response: <action><transaction_id>(<seeders><completed><leechers>)...
+	res, err := t.request(ctx, conn, req, actionScrape, 8+12*len(infoHashes))
+	if err != nil {
+		return nil, err
+	}
+
+	scrapes := make([]ScrapeResult, len(infoHashes))
+	for i := range scrapes {
+		offset := 8 + 12*i
+		scrapes[i] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(res[offset : offset+4])),
+			Completed: int(binary.BigEndian.Uint32(res[offset+4 : offset+8])),
+			Leechers:  int(binary.BigEndian.Uint32(res[offset+8 : offset+12])),
+		}
+	}
+	return scrapes, nil
+}
+
+// request sends an announce or scrape request, connecting first and
+// reconnecting whenever the connection id expires while retransmitting.
+func (t *UDPTracker) request(ctx context.Context, conn net.Conn, req []byte, action uint32, minLength int) ([]byte, error) {
+	// a blocked read returns once ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	for {
+		connID, err := t.connect(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint64(req[0:8], connID)
+
+		res, err := t.roundTrip(ctx, conn, req, action, minLength)
+		if errors.Is(err, errConnectionExpired) {
+			t.connID = 0
+			continue
+		}
+		return res, err
+	}
+}
+
+// connect returns the cached connection id or requests a new one when expired.
+func (t *UDPTracker) connect(ctx context.Context, conn net.Conn) (uint64, error) {
+	if t.connID != 0 && time.Since(t.connTime) < connectionIDTTL {
+		return t.connID, nil
+	}
+
+	// connect: <protocol_id><action><transaction_id>
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], actionConnect)
+
+	// connect response: <action><transaction_id><connection_id>
+	res, err := t.roundTrip(ctx, conn, req, actionConnect, 16)
+	if err != nil {
+		return 0, err
+	}
+
+	t.connID = binary.BigEndian.Uint64(res[8:16])
+	t.connTime = time.Now()
+	return t.connID, nil
+}
+
+// roundTrip sends the request with a new transaction id and retransmits it
+// with exponential backoff until a matching response arrives or ctx is done.
+func (t *UDPTracker) roundTrip(ctx context.Context, conn net.Conn, req []byte, action uint32, minLength int) ([]byte, error) {
+	transactionID := randUint32()
+	binary.BigEndian.PutUint32(req[12:16], transactionID)
+
+	buf := make([]byte, 2048)
+	for n := 0; n <= t.retries; n++ {
+		_, err := conn.Write(req)
+		if err != nil {
+			log.WithFields(log.Fields{"reason": err.Error(), "announce": t.URL}).Error("failed to send udp tracker request")
+			return nil, newRequestError(t.URL, err)
+		}
+
+		// the last wait is cut short by the deadline of ctx
+		deadline := time.Now().Add(t.timeout * (1 << n))
+		d, bounded := ctx.Deadline()
+		bounded = bounded && d.Before(deadline)
+		if bounded {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		if ctx.Err() != nil {
+			// done before the deadline was set
+			return nil, t.cancelled(ctx)
+		}
+
+		for {
+			l, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					if ctx.Err() != nil || bounded {
+						return nil, t.cancelled(ctx)
+					}
+					log.WithFields(log.Fields{"announce": t.URL, "attempt": n + 1}).Debug("udp tracker request timed out")
+					if action != actionConnect && time.Since(t.connTime) >= connectionIDTTL {
+						return nil, errConnectionExpired
+					}
+					break
+				}
+				return nil, newRequestError(t.URL, err)
+			}
+
+			res := buf[:l]
+			if l < 8 || binary.BigEndian.Uint32(res[4:8]) != transactionID {
+				// stale response to an earlier transmission
+				continue
+			}
+
+			resAction := binary.BigEndian.Uint32(res[0:4])
+			if resAction == actionError {
+				err := &Error{Kind: ErrFailure, URL: t.URL, Reason: string(res[8:])}
+				log.Error(err.Error())
+				return nil, err
+			}
+
+			if resAction != action || l < minLength {
+				err := &Error{Kind: ErrMalformed, URL: t.URL, Err: errors.New("invalid udp tracker response")}
+				log.WithFields(log.Fields{"action": resAction, "length": l}).Error(err.Error())
+				return nil, err
+			}
+			return append([]byte(nil), res...), nil
+		}
+	}
+
+	err := &Error{Kind: ErrTimeout, URL: t.URL, Err: errors.New("no response after retransmissions")}
+	log.Error(err.Error())
+	return nil, err
+}
+
+// cancelled returns the error of an exchange ended by ctx.
+func (t *UDPTracker) cancelled(ctx context.Context) error {
+	err := ctx.Err()
+	if err == nil {
+		err = context.DeadlineExceeded
+	}
+	log.WithFields(log.Fields{"reason": err.Error(), "announce": t.URL}).Debug("udp tracker request cancelled")
+	return &Error{Kind: ErrTimeout, URL: t.URL, Err: err}
+}
+
+func randUint32() uint32 {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
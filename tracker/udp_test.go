@@ -0,0 +1,252 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mitander/bitrush/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConnID = 0x1122334455667788
+
+// udpServer is a stand-in udp tracker, it drops the first packets to
+// exercise retransmission and answers with an error if fails is set
+type udpServer struct {
+	conn  net.PacketConn
+	drop  int
+	fails bool
+	peers []byte
+}
+
+func newUDPServer(t *testing.T, drop int, fails bool) *udpServer {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.Nil(t, err)
+	return startUDPServer(conn, drop, fails, []byte{192, 0, 2, 210, 0x1A, 0xE8, 127, 0, 0, 21, 0x1A, 0xE9})
+}
+
+func startUDPServer(conn net.PacketConn, drop int, fails bool, peers []byte) *udpServer {
+	s := &udpServer{
+		conn:  conn,
+		drop:  drop,
+		fails: fails,
+		peers: peers,
+	}
+	go s.serve()
+	return s
+}
+
+func (s *udpServer) announce() string {
+	return "udp://" + s.conn.LocalAddr().String()
+}
+
+func (s *udpServer) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if s.drop > 0 {
+			s.drop--
+			continue
+		}
+
+		req := buf[:n]
+		action := binary.BigEndian.Uint32(req[8:12])
+		transactionID := req[12:16]
+
+		var res []byte
+		switch {
+		case s.fails:
+			res = append(make([]byte, 8), []byte("torrent not registered")...)
+			binary.BigEndian.PutUint32(res[0:4], actionError)
+		case action == actionConnect && binary.BigEndian.Uint64(req[0:8]) == udpProtocolID:
+			res = make([]byte, 16)
+			binary.BigEndian.PutUint64(res[8:16], testConnID)
+		case action == actionAnnounce && binary.BigEndian.Uint64(req[0:8]) == testConnID && n == 98:
+			res = make([]byte, 20)
+			binary.BigEndian.PutUint32(res[0:4], actionAnnounce)
+			binary.BigEndian.PutUint32(res[8:12], 1800)
+			res = append(res, s.peers...)
+		case action == actionScrape && binary.BigEndian.Uint64(req[0:8]) == testConnID:
+			count := (n - 16) / 20
+			res = make([]byte, 8+12*count)
+			binary.BigEndian.PutUint32(res[0:4], actionScrape)
+			for i := 0; i < count; i++ {
+				binary.BigEndian.PutUint32(res[8+12*i:], uint32(10*(i+1)))
+				binary.BigEndian.PutUint32(res[12+12*i:], uint32(20*(i+1)))
+				binary.BigEndian.PutUint32(res[16+12*i:], uint32(30*(i+1)))
+			}
+		default:
+			continue
+		}
+		copy(res[4:8], transactionID)
+		s.conn.WriteTo(res, addr)
+	}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	tests := map[string]struct {
+		drop   int
+		fails  bool
+		kind   ErrorKind
+		output []peer.Peer
+	}{
+		"correct input": {
+			drop:  0,
+			fails: false,
+			output: []peer.Peer{
+				{IP: net.IP{192, 0, 2, 210}, Port: 6888},
+				{IP: net.IP{127, 0, 0, 21}, Port: 6889},
+			},
+		},
+		"retransmission": {
+			drop:  2, // <- connect and first announce are lost
+			fails: false,
+			output: []peer.Peer{
+				{IP: net.IP{192, 0, 2, 210}, Port: 6888},
+				{IP: net.IP{127, 0, 0, 21}, Port: 6889},
+			},
+		},
+		"tracker error": {
+			drop:   0,
+			fails:  true,
+			kind:   ErrFailure,
+			output: nil,
+		},
+		"tracker unreachable": {
+			drop:   100,
+			fails:  false,
+			kind:   ErrTimeout,
+			output: nil,
+		},
+	}
+
+	for name, test := range tests {
+		srv := newUDPServer(t, test.drop, test.fails)
+		tr, err := NewUDPTracker(srv.announce(), [20]byte{1}, [20]byte{2})
+		require.Nil(t, err, name)
+		tr.timeout = 20 * time.Millisecond
+		tr.retries = 2
+
+		res, err := tr.Announce(context.Background(), AnnounceRequest{Event: EventStarted, Left: 351272960})
+		if test.output == nil {
+			var trErr *Error
+			assert.True(t, errors.As(err, &trErr), name)
+			assert.Equal(t, test.kind, trErr.Kind, name)
+			assert.Nil(t, res, name)
+		} else {
+			assert.Nil(t, err, name)
+			assert.Equal(t, uint64(testConnID), tr.connID, name)
+			assert.Equal(t, 1800*time.Second, res.Interval, name)
+			assert.Equal(t, test.output, res.Peers, name)
+		}
+		srv.conn.Close()
+	}
+}
+
+func TestUDPAnnounceDeadline(t *testing.T) {
+	srv := newUDPServer(t, 100, false) // <- every packet is lost
+	defer srv.conn.Close()
+
+	tr, err := NewUDPTracker(srv.announce(), [20]byte{1}, [20]byte{2})
+	require.Nil(t, err)
+
+	// default backoff would wait for hours, the deadline cuts it short
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = tr.Announce(ctx, AnnounceRequest{})
+	assert.Less(t, time.Since(start), time.Second)
+
+	var terr *Error
+	require.True(t, errors.As(err, &terr))
+	assert.Equal(t, ErrTimeout, terr.Kind)
+}
+
+func TestUDPAnnounceIPv6(t *testing.T) {
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback not available")
+	}
+	srv := startUDPServer(conn, 0, false, []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1A, 0xE9})
+	defer srv.conn.Close()
+
+	tr, err := NewUDPTracker(srv.announce(), [20]byte{1}, [20]byte{2})
+	require.Nil(t, err)
+	tr.timeout = 20 * time.Millisecond
+
+	res, err := tr.Announce(context.Background(), AnnounceRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, []peer.Peer{{IP: net.ParseIP("2001:db8::1"), Port: 6889}}, res.Peers)
+}
+
+func TestUDPConnectionIDCache(t *testing.T) {
+	srv := newUDPServer(t, 0, false)
+	defer srv.conn.Close()
+
+	tr, err := NewUDPTracker(srv.announce(), [20]byte{1}, [20]byte{2})
+	require.Nil(t, err)
+	tr.timeout = 20 * time.Millisecond
+
+	_, err = tr.Announce(context.Background(), AnnounceRequest{})
+	require.Nil(t, err)
+	connTime := tr.connTime
+
+	// cached connection id is reused
+	_, err = tr.Announce(context.Background(), AnnounceRequest{})
+	require.Nil(t, err)
+	assert.Equal(t, connTime, tr.connTime)
+
+	// expired connection id is renewed
+	tr.connTime = time.Now().Add(-connectionIDTTL)
+	_, err = tr.Announce(context.Background(), AnnounceRequest{})
+	require.Nil(t, err)
+	assert.True(t, tr.connTime.After(connTime))
+}
+
+func TestUDPScrape(t *testing.T) {
+	srv := newUDPServer(t, 0, false)
+	defer srv.conn.Close()
+
+	tr, err := NewUDPTracker(srv.announce(), [20]byte{1}, [20]byte{2})
+	require.Nil(t, err)
+	tr.timeout = 20 * time.Millisecond
+
+	res, err := tr.Scrape(context.Background(), [][20]byte{{1}, {2}})
+	assert.Nil(t, err)
+	assert.Equal(t, []ScrapeResult{
+		{Seeders: 10, Completed: 20, Leechers: 30},
+		{Seeders: 20, Completed: 40, Leechers: 60},
+	}, res)
+
+	// more info hashes than fit in one packet are split into requests
+	res, err = tr.Scrape(context.Background(), make([][20]byte, udpMaxScrape+1))
+	assert.Nil(t, err)
+	assert.Equal(t, udpMaxScrape+1, len(res))
+	assert.Equal(t, ScrapeResult{Seeders: 10, Completed: 20, Leechers: 30}, res[udpMaxScrape])
+}
+
+func TestUDPScrapeDeadline(t *testing.T) {
+	srv := newUDPServer(t, 100, false) // <- every packet is lost
+	defer srv.conn.Close()
+
+	tr, err := NewUDPTracker(srv.announce(), [20]byte{1}, [20]byte{2})
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = tr.Scrape(ctx, [][20]byte{{1}})
+	assert.Less(t, time.Since(start), time.Second)
+
+	var terr *Error
+	require.True(t, errors.As(err, &terr))
+	assert.Equal(t, ErrTimeout, terr.Kind)
+}
@@ -0,0 +1,452 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// receive window advertised to the peer
+	recvWindow = 1 << 20
+	// packets received further ahead than this are dropped
+	reorderLimit = recvWindow / maxPayload
+	// retransmission timeouts, doubled on every timeout
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 30 * time.Second
+	// connections fail once a packet was sent this many times
+	maxTransmissions = 6
+	// closed connections wait this long for the fin of the peer
+	lingerTimeout = 30 * time.Second
+)
+
+var (
+	ErrReset   error = errors.New("utp connection reset by peer")
+	ErrTimeout error = errors.New("utp connection timed out")
+)
+
+type packet struct {
+	typ     uint8
+	seq     uint16
+	payload []byte
+	sent    time.Time
+	// transmissions counts the times the packet was sent, resend marks it
+	// for retransmission once the window allows
+	transmissions int
+	resend        bool
+}
+
+// Conn is a uTP connection, it implements net.Conn.
+type Conn struct {
+	s      *Socket
+	raddr  *net.UDPAddr
+	recvID uint16
+	sendID uint16
+
+	connected bool
+	// seq of the next packet we send and of the last packet received in order
+	seq uint16
+	ack uint16
+	// sent packets not acked yet and the bytes of their payloads
+	outgoing []*packet
+	inflight int
+	cc       *ledbat
+	peerWnd  int
+	dupAcks  int
+	rtt      time.Duration
+	rttVar   time.Duration
+	rto      time.Duration
+	timer    *time.Timer
+	// received data not read yet and packets received out of order
+	buf     []byte
+	reorder map[uint16]*packet
+	// delay of the last packet received, reported back to the peer
+	replyMicro uint32
+	eof        bool
+	closed     bool
+	err        error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	mu            sync.Mutex
+	cond          *sync.Cond
+}
+
+func newConn(s *Socket, raddr *net.UDPAddr, recvID uint16, sendID uint16) *Conn {
+	c := &Conn{
+		s:       s,
+		raddr:   raddr,
+		recvID:  recvID,
+		sendID:  sendID,
+		cc:      newLedbat(),
+		peerWnd: recvWindow,
+		rto:     initialTimeout,
+		reorder: make(map[uint16]*packet),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Read reads data received in order, it returns io.EOF once the peer
+// closed the connection and all data was read.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.buf) == 0 {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.err != nil:
+			return 0, c.err
+		case c.eof:
+			return 0, io.EOF
+		case expired(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.wait(c.readDeadline)
+	}
+
+	full := len(c.buf) >= recvWindow/2
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	if full && len(c.buf) < recvWindow/2 {
+		// the peer may be waiting for the window to open
+		c.sendState()
+	}
+	return n, nil
+}
+
+// Write sends b in packets, it blocks while the congestion window or the
+// window of the peer is full.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for n < len(b) {
+		switch {
+		case c.closed:
+			return n, net.ErrClosed
+		case c.err != nil:
+			return n, c.err
+		case expired(c.writeDeadline):
+			return n, os.ErrDeadlineExceeded
+		}
+
+		size := min(maxPayload, len(b)-n)
+		if c.inflight > 0 && c.inflight+size > c.window() {
+			c.wait(c.writeDeadline)
+			continue
+		}
+		c.queue(stData, append([]byte(nil), b[n:n+size]...))
+		n += size
+	}
+	return n, nil
+}
+
+// Close sends a fin after the data written so far, the connection stays
+// with the socket until the peer acked everything.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	if c.err != nil {
+		return nil
+	}
+
+	c.queue(stFin, nil)
+	time.AfterFunc(lingerTimeout, func() { c.s.remove(c) })
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+// receive handles a packet the socket read for the connection.
+func (c *Conn) receive(h *header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	now := time.Now()
+	c.replyMicro = timestamp(now) - h.timestamp
+	c.peerWnd = int(h.wnd)
+
+	switch h.typ {
+	case stReset:
+		c.fail(ErrReset)
+		return
+	case stSyn:
+		// our state packet got lost
+		c.sendState()
+		return
+	}
+
+	if !c.connected {
+		if h.typ != stState {
+			return
+		}
+		// the first data packet of the peer reuses the seq of its state packet
+		c.connected = true
+		c.ack = h.seq - 1
+	}
+
+	c.acked(now, h)
+	if h.typ == stData || h.typ == stFin {
+		c.deliver(h, payload)
+		c.sendState()
+	}
+
+	if c.closed && c.eof && len(c.outgoing) == 0 {
+		c.s.remove(c)
+	}
+}
+
+// acked removes the packets acked by h and adapts the congestion window.
+func (c *Conn) acked(now time.Time, h *header) {
+	if !seqLess(h.ack, c.seq) {
+		// acks a packet we never sent
+		return
+	}
+
+	n, bytes := 0, 0
+	var sample time.Duration
+	for len(c.outgoing) > 0 && !seqLess(h.ack, c.outgoing[0].seq) {
+		p := c.outgoing[0]
+		c.outgoing = c.outgoing[1:]
+		c.inflight -= len(p.payload)
+		n++
+		bytes += len(p.payload)
+
+		// packets acked only once a lost packet before them was resent
+		// would overestimate the round trip time
+		if p.transmissions > 1 {
+			sample = -1
+		} else if sample >= 0 {
+			sample = now.Sub(p.sent)
+		}
+	}
+	if n > 0 && sample >= 0 {
+		c.updateRTT(sample)
+	}
+
+	if n == 0 {
+		// the same ack three times over means the next packet is lost
+		if h.typ == stState && len(c.outgoing) > 0 && h.ack == c.outgoing[0].seq-1 {
+			c.dupAcks++
+			if c.dupAcks == 3 {
+				c.cc.lost()
+				c.transmit(c.outgoing[0])
+			}
+		}
+		return
+	}
+
+	// the peer is reachable again, undo the backoff of timeouts
+	c.dupAcks = 0
+	c.rto = max(c.rtt+4*c.rttVar, minTimeout)
+	c.cc.acked(now, bytes, h.timestampDiff)
+	if len(c.outgoing) == 0 {
+		c.timer.Stop()
+		return
+	}
+	c.timer.Reset(c.rto)
+	c.flush()
+}
+
+// deliver buffers the payload of a data or fin packet, packets are kept
+// until the packets before them arrived.
+func (c *Conn) deliver(h *header, payload []byte) {
+	if !seqLess(c.ack, h.seq) || h.seq-c.ack > reorderLimit || c.eof {
+		return
+	}
+	c.reorder[h.seq] = &packet{typ: h.typ, seq: h.seq, payload: append([]byte(nil), payload...)}
+
+	for {
+		p, ok := c.reorder[c.ack+1]
+		if !ok {
+			return
+		}
+		delete(c.reorder, p.seq)
+		c.ack++
+
+		if p.typ == stFin {
+			c.eof = true
+			c.reorder = make(map[uint16]*packet)
+			return
+		}
+		if !c.closed {
+			c.buf = append(c.buf, p.payload...)
+		}
+	}
+}
+
+// queue sends a packet taking the next seq and keeps it until it is acked.
+func (c *Conn) queue(typ uint8, payload []byte) {
+	p := &packet{typ: typ, seq: c.seq, payload: payload}
+	c.seq++
+	c.outgoing = append(c.outgoing, p)
+	c.inflight += len(payload)
+	c.transmit(p)
+
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.rto, c.timeout)
+	} else if len(c.outgoing) == 1 {
+		c.timer.Reset(c.rto)
+	}
+}
+
+// transmit sends or resends a packet with the current ack and window.
+func (c *Conn) transmit(p *packet) {
+	p.transmissions++
+	p.resend = false
+	p.sent = time.Now()
+
+	id := c.sendID
+	if p.typ == stSyn {
+		id = c.recvID
+	}
+	c.send(&header{typ: p.typ, connID: id, seq: p.seq}, p.payload)
+}
+
+// sendState acks the packets received so far, state packets take no seq.
+func (c *Conn) sendState() {
+	c.send(&header{typ: stState, connID: c.sendID, seq: c.seq}, nil)
+}
+
+func (c *Conn) send(h *header, payload []byte) {
+	h.timestamp = timestamp(time.Now())
+	h.timestampDiff = c.replyMicro
+	h.wnd = uint32(max(0, recvWindow-len(c.buf)))
+	h.ack = c.ack
+	c.s.send(c.raddr, h, payload)
+}
+
+// timeout resends packets not acked within the retransmission timeout.
+func (c *Conn) timeout() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.outgoing) == 0 || c.err != nil {
+		return
+	}
+	if c.outgoing[0].transmissions >= maxTransmissions {
+		c.fail(ErrTimeout)
+		return
+	}
+
+	c.cc.timeout()
+	c.rto = min(2*c.rto, maxTimeout)
+	for _, p := range c.outgoing {
+		p.resend = true
+	}
+	c.flush()
+	c.timer.Reset(c.rto)
+}
+
+// flush resends packets marked for retransmission as far as the window
+// allows, at least one packet is sent.
+func (c *Conn) flush() {
+	budget := c.window()
+	for _, p := range c.outgoing {
+		if budget <= 0 {
+			return
+		}
+		if p.resend {
+			c.transmit(p)
+			budget -= max(len(p.payload), 1)
+		}
+	}
+}
+
+// window returns the bytes allowed in flight.
+func (c *Conn) window() int {
+	return min(int(c.cc.window), c.peerWnd)
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = max(c.rtt+4*c.rttVar, minTimeout)
+}
+
+// fail ends the connection with err and removes it from the socket.
+func (c *Conn) fail(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.outgoing = nil
+	c.inflight = 0
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.cond.Broadcast()
+	c.s.remove(c)
+}
+
+// wait blocks until the connection changes or the deadline passes.
+func (c *Conn) wait(deadline time.Time) {
+	if !deadline.IsZero() {
+		t := time.AfterFunc(time.Until(deadline), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+		defer t.Stop()
+	}
+	c.cond.Wait()
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
@@ -0,0 +1,69 @@
+package utp
+
+import (
+	"math"
+	"time"
+)
+
+// LEDBAT congestion control, the window grows while the delay our packets
+// see stays below the target and shrinks as soon as queues build up, so
+// uTP yields to other traffic.
+// [https://www.bittorrent.org/beps/bep_0029.html#congestion-control]
+const (
+	// queuing delay we aim for, in microseconds
+	targetDelay = 100000
+	// window growth per round trip at zero queuing delay, in packets
+	gain          = 1.0
+	minWindow     = maxPayload
+	maxWindow     = recvWindow
+	initialWindow = 4 * maxPayload
+	// the base delay is the lowest delay of the last two minutes
+	delayHistoryInterval = time.Minute
+)
+
+type ledbat struct {
+	// window is the number of bytes allowed in flight
+	window float64
+	// lowest delays of the current and the previous minute
+	minima [2]uint32
+	minute time.Time
+}
+
+func newLedbat() *ledbat {
+	return &ledbat{
+		window: initialWindow,
+		minima: [2]uint32{math.MaxUint32, math.MaxUint32},
+	}
+}
+
+func (l *ledbat) baseDelay() uint32 {
+	return min(l.minima[0], l.minima[1])
+}
+
+// acked adapts the window to n bytes acked by a packet reporting the
+// one-way delay of our packets in microseconds.
+func (l *ledbat) acked(now time.Time, n int, delay uint32) {
+	if now.Sub(l.minute) >= delayHistoryInterval {
+		l.minima[1] = l.minima[0]
+		l.minima[0] = math.MaxUint32
+		l.minute = now
+	}
+	l.minima[0] = min(l.minima[0], delay)
+
+	// delays are measured against clocks of both ends, only the difference
+	// to the base delay is meaningful
+	queuing := float64(delay - l.baseDelay())
+	offTarget := (targetDelay - queuing) / targetDelay
+	l.window += gain * offTarget * float64(n) * maxPayload / l.window
+	l.window = math.Max(minWindow, math.Min(l.window, maxWindow))
+}
+
+// lost halves the window after a packet loss.
+func (l *ledbat) lost() {
+	l.window = math.Max(minWindow, l.window/2)
+}
+
+// timeout resets the window after a retransmission timeout.
+func (l *ledbat) timeout() {
+	l.window = minWindow
+}
@@ -0,0 +1,42 @@
+package utp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedbat(t *testing.T) {
+	now := time.Now()
+	// clocks of both ends differ, the base delay absorbs the offset
+	base := uint32(5000000)
+
+	l := newLedbat()
+	for i := 0; i < 10; i++ {
+		l.acked(now, maxPayload, base)
+	}
+	assert.Equal(t, base, l.baseDelay())
+	assert.Greater(t, l.window, float64(initialWindow))
+
+	// queuing delay above the target shrinks the window
+	grown := l.window
+	for i := 0; i < 10; i++ {
+		l.acked(now, maxPayload, base+3*targetDelay)
+	}
+	assert.Less(t, l.window, grown)
+
+	// the base delay follows the delays of the last two minutes
+	l.acked(now.Add(delayHistoryInterval), maxPayload, base+targetDelay)
+	assert.Equal(t, base, l.baseDelay())
+	l.acked(now.Add(2*delayHistoryInterval), maxPayload, base+targetDelay)
+	assert.Equal(t, base+targetDelay, l.baseDelay())
+
+	window := l.window
+	l.lost()
+	assert.Equal(t, window/2, l.window)
+	l.timeout()
+	assert.Equal(t, float64(minWindow), l.window)
+	l.acked(now, maxPayload, base+100*targetDelay)
+	assert.Equal(t, float64(minWindow), l.window)
+}
@@ -0,0 +1,90 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// [https://www.bittorrent.org/beps/bep_0029.html]
+const (
+	version = 1
+
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+
+	headerLen = 20
+	// payload of a single packet, keeps packets below common path MTUs
+	maxPayload = 1380
+)
+
+var errInvalidPacket = errors.New("invalid utp packet")
+
+// header: <type|version><extension><connection_id><timestamp_microseconds>
+// <timestamp_difference_microseconds><wnd_size><seq_nr><ack_nr>
+type header struct {
+	typ           uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wnd           uint32
+	seq           uint16
+	ack           uint16
+}
+
+// marshal returns the packet of the header and payload, we send no
+// extensions.
+func (h *header) marshal(payload []byte) []byte {
+	b := make([]byte, headerLen+len(payload))
+	b[0] = h.typ<<4 | version
+	binary.BigEndian.PutUint16(b[2:4], h.connID)
+	binary.BigEndian.PutUint32(b[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:16], h.wnd)
+	binary.BigEndian.PutUint16(b[16:18], h.seq)
+	binary.BigEndian.PutUint16(b[18:20], h.ack)
+	copy(b[headerLen:], payload)
+	return b
+}
+
+// unmarshal parses a packet, extensions such as selective acks are skipped.
+func unmarshal(b []byte) (*header, []byte, error) {
+	if len(b) < headerLen || b[0]&0x0F != version || b[0]>>4 > stSyn {
+		return nil, nil, errInvalidPacket
+	}
+
+	h := &header{
+		typ:           b[0] >> 4,
+		connID:        binary.BigEndian.Uint16(b[2:4]),
+		timestamp:     binary.BigEndian.Uint32(b[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:12]),
+		wnd:           binary.BigEndian.Uint32(b[12:16]),
+		seq:           binary.BigEndian.Uint16(b[16:18]),
+		ack:           binary.BigEndian.Uint16(b[18:20]),
+	}
+
+	// extension: <next extension><len><data>
+	i := headerLen
+	for ext := b[1]; ext != 0; {
+		if len(b) < i+2 || len(b) < i+2+int(b[i+1]) {
+			return nil, nil, errInvalidPacket
+		}
+		ext = b[i]
+		i += 2 + int(b[i+1])
+	}
+	return h, b[i:], nil
+}
+
+// timestamp returns the microseconds of t as sent in packets, wrapping
+// every 71 minutes.
+func timestamp(t time.Time) uint32 {
+	return uint32(t.UnixMicro())
+}
+
+// seqLess compares sequence numbers, allowing them to wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
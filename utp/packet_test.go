@@ -0,0 +1,74 @@
+package utp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacket(t *testing.T) {
+	h := &header{typ: stData, connID: 0x1234, timestamp: 1, timestampDiff: 2, wnd: 3, seq: 0xFFFF, ack: 5}
+	packet := h.marshal([]byte("payload"))
+
+	tests := map[string]struct {
+		input   []byte
+		output  *header
+		payload string
+		fails   bool
+	}{
+		"data": {
+			input:   packet,
+			output:  h,
+			payload: "payload",
+			fails:   false,
+		},
+		"selective ack extension": {
+			input:   append(append([]byte{0x01, 0x01}, packet[2:headerLen]...), append([]byte{0x00, 0x04, 1, 2, 3, 4}, "payload"...)...),
+			output:  h,
+			payload: "payload",
+			fails:   false,
+		},
+		"truncated extension": {
+			input:   append(append([]byte{0x01, 0x01}, packet[2:headerLen]...), 0x00, 0x04, 1), // <- fails here
+			output:  nil,
+			payload: "",
+			fails:   true,
+		},
+		"wrong version": {
+			input:   append([]byte{0x02}, packet[1:]...), // <- fails here
+			output:  nil,
+			payload: "",
+			fails:   true,
+		},
+		"unknown type": {
+			input:   append([]byte{0x51}, packet[1:]...), // <- fails here
+			output:  nil,
+			payload: "",
+			fails:   true,
+		},
+		"short": {
+			input:   packet[:headerLen-1], // <- fails here
+			output:  nil,
+			payload: "",
+			fails:   true,
+		},
+	}
+
+	for name, test := range tests {
+		got, payload, err := unmarshal(test.input)
+		if test.fails {
+			assert.NotNil(t, err, name)
+			continue
+		}
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.output, got, name)
+		assert.Equal(t, test.payload, string(payload), name)
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	assert.True(t, seqLess(1, 2))
+	assert.False(t, seqLess(2, 2))
+	assert.True(t, seqLess(0xFFFF, 0))
+	assert.False(t, seqLess(0, 0xFFFF))
+}
@@ -0,0 +1,246 @@
+package utp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// connections accepted by the socket but not by the caller yet
+	acceptBacklog = 32
+	maxPacketSize = 65536
+)
+
+var ErrDialTimeout error = errors.New("utp dial timed out")
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes uTP connections over a UDP socket, connections are told
+// apart by the address and the connection id of the peer. It implements
+// net.Listener.
+type Socket struct {
+	conn    net.PacketConn
+	conns   map[connKey]*Conn
+	acceptC chan *Conn
+	closeC  chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+}
+
+// Listen opens a socket on the UDP address, e.g. ":6881".
+func Listen(addr string) (*Socket, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.WithFields(log.Fields{"addr": addr, "error": err.Error()}).Debug("failed to open utp socket")
+		return nil, err
+	}
+	return newSocket(conn), nil
+}
+
+func newSocket(conn net.PacketConn) *Socket {
+	s := &Socket{
+		conn:    conn,
+		conns:   make(map[connKey]*Conn),
+		acceptC: make(chan *Conn, acceptBacklog),
+		closeC:  make(chan struct{}),
+	}
+	go s.read()
+	return s
+}
+
+// Accept waits for a connection of a peer.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.acceptC:
+		return c, nil
+	case <-s.closeC:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr returns the local address of the socket.
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close closes the socket, failing its connections.
+func (s *Socket) Close() error {
+	err := net.ErrClosed
+	s.once.Do(func() {
+		close(s.closeC)
+		err = s.conn.Close()
+
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(net.ErrClosed)
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+// Dial connects to the peer at addr, e.g. "127.0.0.1:6881".
+func (s *Socket) Dial(addr string) (net.Conn, error) {
+	return s.DialTimeout(addr, maxTransmissions*initialTimeout)
+}
+
+// DialTimeout connects to the peer at addr, failing with ErrDialTimeout
+// when the peer does not answer in time.
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	id := uint16(rand.Intn(1 << 16))
+	for s.exists(raddr, id) || s.exists(raddr, id+1) {
+		id++
+	}
+	c := newConn(s, raddr, id, id+1)
+	s.conns[connKey{raddr.String(), id}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq = 1
+	c.queue(stSyn, nil)
+	deadline := time.Now().Add(timeout)
+	for !c.connected && c.err == nil && !expired(deadline) {
+		c.wait(deadline)
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if !c.connected {
+		c.fail(ErrDialTimeout)
+		return nil, ErrDialTimeout
+	}
+	return c, nil
+}
+
+func (s *Socket) read() {
+	b := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.WithFields(log.Fields{"error": err.Error()}).Debug("failed to read utp packet")
+			continue
+		}
+		raddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		h, payload, err := unmarshal(b[:n])
+		if err != nil {
+			log.WithFields(log.Fields{"addr": raddr.String(), "error": err.Error()}).Debug("invalid utp packet")
+			continue
+		}
+		s.dispatch(raddr, h, payload)
+	}
+}
+
+// dispatch passes a packet to its connection, a syn of an unknown
+// connection is accepted and other unknown packets are reset.
+func (s *Socket) dispatch(raddr *net.UDPAddr, h *header, payload []byte) {
+	s.mu.Lock()
+	c, ok := s.conns[connKey{raddr.String(), h.connID}]
+	switch {
+	case ok:
+	case h.typ == stSyn:
+		// retransmitted syn of an accepted connection
+		c, ok = s.conns[connKey{raddr.String(), h.connID + 1}]
+	case h.typ == stReset:
+		// resets carry the id the peer sends with
+		for _, conn := range s.conns {
+			if conn.sendID == h.connID && conn.raddr.String() == raddr.String() {
+				c, ok = conn, true
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	switch {
+	case ok:
+		c.receive(h, payload)
+	case h.typ == stSyn:
+		s.accept(raddr, h)
+	case h.typ != stReset:
+		s.send(raddr, &header{typ: stReset, connID: h.connID, ack: h.seq}, nil)
+	}
+}
+
+// accept answers the syn of a peer and queues the connection for Accept.
+func (s *Socket) accept(raddr *net.UDPAddr, h *header) {
+	c := newConn(s, raddr, h.connID+1, h.connID)
+	c.connected = true
+	c.seq = uint16(rand.Intn(1 << 16))
+	c.ack = h.seq
+	c.replyMicro = timestamp(time.Now()) - h.timestamp
+	c.peerWnd = int(h.wnd)
+
+	select {
+	case <-s.closeC:
+		return
+	default:
+	}
+	s.mu.Lock()
+	s.conns[connKey{raddr.String(), c.recvID}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.sendState()
+	c.mu.Unlock()
+
+	select {
+	case s.acceptC <- c:
+	default:
+		log.WithFields(log.Fields{"addr": raddr.String()}).Debug("utp accept backlog full")
+		c.mu.Lock()
+		c.fail(ErrReset)
+		c.send(&header{typ: stReset, connID: c.sendID}, nil)
+		c.mu.Unlock()
+	}
+}
+
+func (s *Socket) send(raddr *net.UDPAddr, h *header, payload []byte) {
+	_, err := s.conn.WriteTo(h.marshal(payload), raddr)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.WithFields(log.Fields{"addr": raddr.String(), "error": err.Error()}).Debug("failed to send utp packet")
+	}
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) exists(raddr *net.UDPAddr, id uint16) bool {
+	_, ok := s.conns[connKey{raddr.String(), id}]
+	return ok
+}
@@ -0,0 +1,173 @@
+package utp
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lossy drops every nth packet written to the socket.
+type lossy struct {
+	net.PacketConn
+	n       int64
+	written atomic.Int64
+}
+
+func (l *lossy) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if l.written.Add(1)%l.n == 0 {
+		return len(b), nil
+	}
+	return l.PacketConn.WriteTo(b, addr)
+}
+
+func socket(t *testing.T, loss int64) *Socket {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	if loss > 0 {
+		return newSocket(&lossy{PacketConn: conn, n: loss})
+	}
+	return newSocket(conn)
+}
+
+func TestConn(t *testing.T) {
+	tests := map[string]struct {
+		size int
+		loss int64
+	}{
+		"transfer": {
+			size: 1 << 20,
+			loss: 0,
+		},
+		"packet loss": {
+			size: 1 << 17,
+			loss: 20,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			a := socket(t, test.loss)
+			defer a.Close()
+			b := socket(t, test.loss)
+			defer b.Close()
+
+			data := make([]byte, test.size)
+			rand.Read(data)
+			go func() {
+				conn, err := b.Accept()
+				if err != nil {
+					return
+				}
+				// echo back and close once the peer closed
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+
+			conn, err := a.Dial(b.Addr().String())
+			require.Nil(t, err)
+			go func() {
+				conn.Write(data)
+			}()
+
+			got := make([]byte, len(data))
+			_, err = io.ReadFull(conn, got)
+			require.Nil(t, err)
+			assert.Equal(t, data, got)
+
+			require.Nil(t, conn.Close())
+			assert.Equal(t, net.ErrClosed, conn.Close())
+			_, err = conn.Read(got)
+			assert.Equal(t, net.ErrClosed, err)
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	a := socket(t, 0)
+	defer a.Close()
+	b := socket(t, 0)
+	defer b.Close()
+
+	conn, err := a.Dial(b.Addr().String())
+	require.Nil(t, err)
+	accepted, err := b.Accept()
+	require.Nil(t, err)
+
+	_, err = conn.Write([]byte("bye"))
+	require.Nil(t, err)
+	require.Nil(t, conn.Close())
+
+	// data written before close is read before EOF
+	got, err := io.ReadAll(accepted)
+	assert.Nil(t, err)
+	assert.Equal(t, "bye", string(got))
+	require.Nil(t, accepted.Close())
+
+	assert.Eventually(t, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(a.conns) == 0 && len(b.conns) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReset(t *testing.T) {
+	a := socket(t, 0)
+	defer a.Close()
+	b := socket(t, 0)
+
+	conn, err := a.Dial(b.Addr().String())
+	require.Nil(t, err)
+	_, err = b.Accept()
+	require.Nil(t, err)
+
+	// the peer forgot the connection and resets it
+	b.Close()
+	b = newSocket(mustListen(t, b.Addr().String()))
+	defer b.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.Nil(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, ErrReset, err)
+}
+
+func TestDeadline(t *testing.T) {
+	a := socket(t, 0)
+	defer a.Close()
+	b := socket(t, 0)
+	defer b.Close()
+
+	conn, err := a.Dial(b.Addr().String())
+	require.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	nerr, ok := err.(net.Error)
+	assert.True(t, ok && nerr.Timeout())
+}
+
+func TestDialTimeout(t *testing.T) {
+	a := socket(t, 0)
+	defer a.Close()
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer silent.Close()
+
+	_, err = a.DialTimeout(silent.LocalAddr().String(), 100*time.Millisecond)
+	assert.Equal(t, ErrDialTimeout, err)
+	assert.Empty(t, a.conns)
+}
+
+func mustListen(t *testing.T, addr string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", addr)
+	require.Nil(t, err)
+	return conn
+}